@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Access log formats.
+const (
+	AccessLogJSON = "json"
+	AccessLogCSV  = "csv"
+)
+
+// AccessLogConfig writes a line per sampled packet forwarded or dropped, in
+// JSON lines or CSV, read from "access_log". The file is rotated once it
+// holds MaxSize bytes or was opened MaxAge ago, renamed to the file name
+// with the time it was opened appended; 0 disables either.
+type AccessLogConfig struct {
+	// File is the log file, empty disables the access log.
+	File    string        `mapstructure:"file"`
+	Format  string        `mapstructure:"format"`
+	Sample  float64       `mapstructure:"sample"`
+	MaxSize int64         `mapstructure:"max_size"`
+	MaxAge  time.Duration `mapstructure:"max_age"`
+}
+
+var accessLogConfig = AccessLogConfig{Format: AccessLogJSON, Sample: 1}
+
+func (c AccessLogConfig) validate() error {
+	if c.Format != AccessLogJSON && c.Format != AccessLogCSV {
+		return fmt.Errorf("access_log: unknown format %q", c.Format)
+	}
+	if c.Sample < 0 || c.Sample > 1 {
+		return fmt.Errorf("access_log: sample %v is not a fraction", c.Sample)
+	}
+	if c.MaxSize < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("access_log: max_size and max_age must not be negative")
+	}
+	return nil
+}
+
+// Actions of an access log entry.
+const (
+	accessForwarded = "forwarded"
+	accessDropped   = "dropped"
+)
+
+// accessEntry is one line of the access log.
+type accessEntry struct {
+	Time      string `json:"time"`
+	Direction string `json:"direction"`
+	Src       string `json:"src"`
+	Dst       string `json:"dst"`
+	SrcPort   uint16 `json:"src_port,omitempty"`
+	DstPort   uint16 `json:"dst_port,omitempty"`
+	Proto     uint8  `json:"proto"`
+	Size      int    `json:"size"`
+	Peer      string `json:"peer,omitempty"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+var accessCSVHeader = []string{"time", "direction", "src", "dst", "src_port", "dst_port", "proto", "size", "peer", "action", "reason"}
+
+func (e accessEntry) record() []string {
+	return []string{e.Time, e.Direction, e.Src, e.Dst, strconv.Itoa(int(e.SrcPort)), strconv.Itoa(int(e.DstPort)),
+		strconv.Itoa(int(e.Proto)), strconv.Itoa(e.Size), e.Peer, e.Action, e.Reason}
+}
+
+// accessLogWriter writes the access log and rotates its file.
+type accessLogWriter struct {
+	mu     sync.Mutex
+	conf   AccessLogConfig
+	rng    *rand.Rand
+	f      *os.File
+	opened time.Time
+	size   int64
+}
+
+// accessLog is the running access log, nil if disabled.
+var accessLog *accessLogWriter
+
+func newAccessLogWriter(conf AccessLogConfig, seed int64) (*accessLogWriter, error) {
+	w := &accessLogWriter{conf: conf, rng: rand.New(rand.NewSource(seed))}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open starts a new file, CSV files with the header.
+func (w *accessLogWriter) open() error {
+	f, err := os.OpenFile(w.conf.File, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w.f, w.opened, w.size = f, clock.Now(), 0
+	if w.conf.Format == AccessLogCSV {
+		return w.writeCSV(accessCSVHeader)
+	}
+	return nil
+}
+
+// rotate moves the current file aside and opens a new one.
+func (w *accessLogWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.conf.File, w.conf.File+"."+w.opened.Format("20060102T150405.000000000")); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *accessLogWriter) writeCSV(record []string) error {
+	cw := csv.NewWriter(w)
+	cw.Write(record)
+	cw.Flush()
+	return cw.Error()
+}
+
+// Write appends to the file, counting its size.
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) write(e accessEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conf.Sample < 1 && w.rng.Float64() >= w.conf.Sample {
+		return nil
+	}
+	now := clock.Now()
+	if w.conf.MaxSize > 0 && w.size >= w.conf.MaxSize || w.conf.MaxAge > 0 && now.Sub(w.opened) >= w.conf.MaxAge {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	e.Time = now.UTC().Format(time.RFC3339Nano)
+	if w.conf.Format == AccessLogCSV {
+		return w.writeCSV(e.record())
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+func (w *accessLogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// logAccess records packet travelling in dir for peer in the access log,
+// dropped for reason or forwarded if reason is empty.
+func logAccess(dir Direction, packet []byte, peer net.IP, reason string) {
+	if accessLog == nil {
+		return
+	}
+	flow, ok := parseFlowKey(packet)
+	if !ok {
+		return
+	}
+	e := accessEntry{Direction: dir.String(), Src: flow.Src.String(), Dst: flow.Dst.String(), Proto: flow.Proto, Size: len(packet), Action: accessForwarded, Reason: reason}
+	if !flow.isICMP() {
+		e.SrcPort, e.DstPort = flow.SrcPort, flow.DstPort
+	}
+	if peer != nil {
+		e.Peer = peer.String()
+	}
+	if reason != "" {
+		e.Action = accessDropped
+	}
+	if err := accessLog.write(e); err != nil {
+		slog.Error("write access log failed", "err", err)
+	}
+}
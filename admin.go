@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var adminAddr string
+
+// DeviceInfo describes a tun device the simulator created or would create.
+type DeviceInfo struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	// Up and MTU come from the OS and are only known for existing devices.
+	Exists bool `json:"exists"`
+	Up     bool `json:"up"`
+	MTU    int  `json:"mtu,omitempty"`
+	// AvgWriteBatch is the average packets per tun write when batching.
+	AvgWriteBatch float64 `json:"avg_write_batch,omitempty"`
+	// WriteQueue, WriteDrops and WriteTimeouts are the packets waiting for
+	// and dropped in front of the device with a write queue.
+	WriteQueue    int    `json:"write_queue,omitempty"`
+	WriteDrops    uint64 `json:"write_drops,omitempty"`
+	WriteTimeouts uint64 `json:"write_timeouts,omitempty"`
+	// Read and Written are the packets the simulator read from and wrote
+	// to the device, Kernel the OS counters where they can be read.
+	Read    uint64 `json:"read"`
+	Written uint64 `json:"written"`
+	// RPFDrops are packets read dropped by the reverse path filter.
+	RPFDrops uint64             `json:"rpf_drops,omitempty"`
+	Kernel   *KernelDeviceStats `json:"kernel,omitempty"`
+}
+
+func (t *DevTable) Range(f func(dev *TunDevice) bool) {
+	(*sync.Map)(t).Range(func(_, value any) bool {
+		return f(value.(*TunDevice))
+	})
+}
+
+func (dev *TunDevice) info() DeviceInfo {
+	info := DeviceInfo{Name: dev.name, Addr: (&net.IPNet{IP: net.ParseIP(dev.ip), Mask: dev.mask}).String()}
+	if iface, err := net.InterfaceByName(dev.name); err == nil {
+		info.Exists = true
+		info.Up = iface.Flags&net.FlagUp != 0
+		info.MTU = iface.MTU
+	}
+	if dev.writer != nil {
+		info.AvgWriteBatch = dev.writer.AvgBatch()
+		info.WriteQueue = dev.writer.QueueLen()
+		info.WriteDrops = dev.writer.Drops.Load()
+		info.WriteTimeouts = dev.writer.Timeouts.Load()
+	}
+	info.Read, info.Written = dev.read.Load(), dev.written.Load()
+	if dev.rpf != nil {
+		info.RPFDrops = dev.rpf.drops.Load()
+	}
+	if stats, err := dev.KernelStats(); err == nil {
+		info.Kernel = &stats
+	}
+	return info
+}
+
+// deviceInfos lists the tun devices of the running simulator.
+func deviceInfos() []DeviceInfo {
+	var infos []DeviceInfo
+	devTable.Range(func(dev *TunDevice) bool {
+		infos = append(infos, dev.info())
+		return true
+	})
+	return infos
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("write admin response failed", "err", err)
+	}
+}
+
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, deviceInfos())
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, statsSnapshot())
+	})
+	// GET /healthz is 200 while ready and 503 while draining
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		health := struct {
+			Status string `json:"status"`
+			Active int64  `json:"active"`
+		}{"ready", activeConnections()}
+		if draining.Load() {
+			health.Status = "draining"
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(w, health)
+	})
+	// POST /drain stops taking new connections and shuts down once the
+	// existing ones closed
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		Drain()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	// POST /connections/cycle closes the client connections one at a time
+	// so they reconnect
+	mux.HandleFunc("/connections/cycle", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !CycleConnections() {
+			http.Error(w, "cycle already running", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	// POST /pause and /resume stop and restart forwarding
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		Pause()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		Resume()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	// GET /hexdump shows the hexdump filter, POST /hexdump?src=&dst=&proto=
+	// &src_port=&dst_port=&rate= replaces it and DELETE /hexdump disables it
+	mux.HandleFunc("/hexdump", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			d := hexdumps.Load()
+			if d == nil {
+				writeJSON(w, struct {
+					Enable bool `json:"enable"`
+				}{})
+				return
+			}
+			writeJSON(w, struct {
+				Enable  bool   `json:"enable"`
+				Src     string `json:"src,omitempty"`
+				Dst     string `json:"dst,omitempty"`
+				Proto   string `json:"proto,omitempty"`
+				SrcPort uint16 `json:"src_port,omitempty"`
+				DstPort uint16 `json:"dst_port,omitempty"`
+				Rate    int    `json:"rate"`
+			}{true, d.conf.Src, d.conf.Dst, d.conf.Proto, d.conf.SrcPort, d.conf.DstPort, d.conf.Rate})
+		case http.MethodPost:
+			conf, err := hexdumpFromQuery(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			setHexdump(conf)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			setHexdump(HexdumpConfig{})
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	// GET /route/explain?src=&dst=&proto=&src_port=&dst_port=&icmp_type=
+	// &icmp_code= shows where a packet of that flow would go without sending
+	// one, see ExplainRoute.
+	mux.HandleFunc("/route/explain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		flow, err := flowFromQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d, err := ExplainRoute(flow)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, d)
+	})
+	// POST /peers/link?vip=<virtual ip>&state=down|up[&teardown=true] takes
+	// the link to the peer down, optionally closing the connection, or
+	// brings it back up.
+	mux.HandleFunc("/peers/link", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		p, ok := peerTable.Get(net.ParseIP(q.Get("vip")))
+		if !ok {
+			http.Error(w, "unknown peer", http.StatusNotFound)
+			return
+		}
+		switch q.Get("state") {
+		case "down":
+			p.SetLink(false, q.Get("teardown") == "true")
+		case "up":
+			p.SetLink(true, false)
+		default:
+			http.Error(w, "state must be down or up", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	// POST /peers/impairments?vip=<virtual ip>&state=off|on switches the
+	// impairments of the peer off, forwarding unimpaired, or back on.
+	mux.HandleFunc("/peers/impairments", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		p, ok := peerTable.Get(net.ParseIP(q.Get("vip")))
+		if !ok {
+			http.Error(w, "unknown peer", http.StatusNotFound)
+			return
+		}
+		switch q.Get("state") {
+		case "off":
+			p.SetImpairments(false)
+		case "on":
+			p.SetImpairments(true)
+		default:
+			http.Error(w, "state must be off or on", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	// POST /peers/migrate?vip=<virtual ip>&local=<ip:port> re-dials the peer
+	// from the given local address, empty lets the OS pick one.
+	mux.HandleFunc("/peers/migrate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p, ok := peerTable.Get(net.ParseIP(r.URL.Query().Get("vip")))
+		if !ok {
+			http.Error(w, "unknown peer", http.StatusNotFound)
+			return
+		}
+		local := r.URL.Query().Get("local")
+		if local != "" {
+			if _, err := net.ResolveUDPAddr("udp", local); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if !p.Migrate(local) {
+			http.Error(w, "migration already pending", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	return mux
+}
+
+// runAdmin serves the admin API on addr until the server shutdown phase.
+func runAdmin(addr string) {
+	srv := &http.Server{Addr: addr, Handler: adminHandler()}
+	OnShutdown(PhaseServer, "admin", func() error {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	})
+	slog.Info("admin api listening", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("admin api failed", "err", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// aggregateWindow is how many seconds the aggregate rates are averaged over.
+const aggregateWindow = 10
+
+// AggregateSnapshot is the throughput of all peers together, averaged over
+// the last WindowSeconds.
+type AggregateSnapshot struct {
+	TxPPS         float64 `json:"tx_pps"`
+	TxBPS         float64 `json:"tx_bps"`
+	RxPPS         float64 `json:"rx_pps"`
+	RxBPS         float64 `json:"rx_bps"`
+	WindowSeconds float64 `json:"window_seconds"`
+}
+
+type aggregateTotals struct {
+	txPackets, txBytes, rxPackets, rxBytes uint64
+}
+
+type aggregateSample struct {
+	at time.Time
+	aggregateTotals
+}
+
+// aggregator sums the peer counters once a second off the data path, the
+// counters are only read so forwarding never waits for it.
+type aggregator struct {
+	mu      sync.Mutex
+	samples []aggregateSample // oldest first, at most aggregateWindow+1
+	// last are the counters of every peer at the previous sample, so peers
+	// that come and go do not make the totals jump
+	last  map[*Peer]aggregateTotals
+	total aggregateTotals
+}
+
+var aggregate = aggregator{last: make(map[*Peer]aggregateTotals)}
+
+func (a *aggregator) sample() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	seen := make(map[*Peer]aggregateTotals, len(a.last))
+	peerTable.Range(func(p *Peer) bool {
+		cur := aggregateTotals{p.stats.TxPackets.Load(), p.stats.TxBytes.Load(), p.stats.RxPackets.Load(), p.stats.RxBytes.Load()}
+		prev := a.last[p]
+		a.total.txPackets += cur.txPackets - prev.txPackets
+		a.total.txBytes += cur.txBytes - prev.txBytes
+		a.total.rxPackets += cur.rxPackets - prev.rxPackets
+		a.total.rxBytes += cur.rxBytes - prev.rxBytes
+		seen[p] = cur
+		return true
+	})
+	a.last = seen
+	a.samples = append(a.samples, aggregateSample{clock.Now(), a.total})
+	if len(a.samples) > aggregateWindow+1 {
+		a.samples = a.samples[1:]
+	}
+}
+
+func (a *aggregator) snapshot() AggregateSnapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.samples) < 2 {
+		return AggregateSnapshot{}
+	}
+	first, last := a.samples[0], a.samples[len(a.samples)-1]
+	secs := last.at.Sub(first.at).Seconds()
+	if secs <= 0 {
+		return AggregateSnapshot{}
+	}
+	return AggregateSnapshot{
+		TxPPS:         float64(last.txPackets-first.txPackets) / secs,
+		TxBPS:         float64(last.txBytes-first.txBytes) * 8 / secs,
+		RxPPS:         float64(last.rxPackets-first.rxPackets) / secs,
+		RxBPS:         float64(last.rxBytes-first.rxBytes) * 8 / secs,
+		WindowSeconds: secs,
+	}
+}
+
+// runAggregate samples the peer counters every second until ctx is done.
+func runAggregate(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	aggregate.sample()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			aggregate.sample()
+		}
+	}
+}
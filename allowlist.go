@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+)
+
+// allowlist holds the real addresses or prefixes the server accepts
+// connections from, read from "allowlist". Empty accepts every client.
+var allowlist []netip.Prefix
+
+func loadAllowlist(entries []string) error {
+	loaded := make([]netip.Prefix, 0, len(entries))
+	for i, s := range entries {
+		prefix, err := parsePrefix(s)
+		if err != nil || !prefix.IsValid() {
+			return fmt.Errorf("allowlist[%d]: %q is not an address or prefix", i, s)
+		}
+		loaded = append(loaded, prefix.Masked())
+	}
+	allowlist = loaded
+	return nil
+}
+
+// allowed reports whether a client connecting from remote may connect,
+// logging and counting it on stats if not.
+func allowed(remote net.Addr, stats *ListenerStats) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	if addrPort, err := netip.ParseAddrPort(remote.String()); err == nil {
+		addr := addrPort.Addr().Unmap()
+		for _, prefix := range allowlist {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	stats.Rejected.Add(1)
+	slog.Warn("reject client not in allowlist", "remote", remote.String(), "transport", stats.Transport)
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// BackoffConfig is the wait between failed connection attempts to a peer:
+// Initial after the first failure, growing by Multiplier per further
+// failure up to Max. It is read from "backoff" and can be overridden per
+// peer, zero fields keep the global value.
+type BackoffConfig struct {
+	Initial    time.Duration `mapstructure:"initial"`
+	Max        time.Duration `mapstructure:"max"`
+	Multiplier float64       `mapstructure:"multiplier"`
+	// MinInterval spaces the connection attempts also when connections
+	// succeed and reset the backoff, MaxPerMinute opens the circuit breaker
+	// once that many attempts were made within a minute; 0 disables either.
+	MinInterval  time.Duration `mapstructure:"min_interval"`
+	MaxPerMinute int           `mapstructure:"max_per_minute"`
+	// StreamRetries is how often opening the stream is retried on an
+	// established connection before it is closed and redialed, each attempt
+	// given StreamTimeout.
+	StreamRetries int           `mapstructure:"stream_retries" comment:"retries opening the stream on a connection that is up, each attempt cut\noff after stream_timeout, before it is closed and redialed"`
+	StreamTimeout time.Duration `mapstructure:"stream_timeout"`
+}
+
+var backoffConfig = BackoffConfig{Initial: 3 * time.Second, Max: 3 * time.Second, Multiplier: 1, StreamRetries: defaultStreamRetries, StreamTimeout: defaultStreamTimeout}
+
+// merge fills the zero fields of c from def.
+func (c BackoffConfig) merge(def BackoffConfig) BackoffConfig {
+	if c.Initial == 0 {
+		c.Initial = def.Initial
+	}
+	if c.Max == 0 {
+		c.Max = def.Max
+	}
+	if c.Multiplier == 0 {
+		c.Multiplier = def.Multiplier
+	}
+	if c.MinInterval == 0 {
+		c.MinInterval = def.MinInterval
+	}
+	if c.MaxPerMinute == 0 {
+		c.MaxPerMinute = def.MaxPerMinute
+	}
+	if c.StreamRetries == 0 {
+		c.StreamRetries = def.StreamRetries
+	}
+	if c.StreamTimeout == 0 {
+		c.StreamTimeout = def.StreamTimeout
+	}
+	return c
+}
+
+func (c BackoffConfig) validate() error {
+	if c.Initial <= 0 || c.Initial > c.Max {
+		return fmt.Errorf("initial must be positive and not above max")
+	}
+	if c.Multiplier < 1 {
+		return fmt.Errorf("multiplier must be at least 1")
+	}
+	if c.MinInterval < 0 || c.MaxPerMinute < 0 {
+		return fmt.Errorf("min_interval and max_per_minute must not be negative")
+	}
+	if c.StreamRetries < 0 || c.StreamTimeout <= 0 {
+		return fmt.Errorf("stream_retries must not be negative and stream_timeout positive")
+	}
+	return nil
+}
+
+// backoff returns the peer's backoff with the global defaults applied.
+func (pc *PeerConfig) backoff() BackoffConfig {
+	return pc.Backoff.merge(backoffConfig)
+}
+
+// Backoff tracks the wait before the next connection attempt.
+type Backoff struct {
+	conf BackoffConfig
+	next time.Duration
+}
+
+func newBackoff(conf BackoffConfig) *Backoff {
+	return &Backoff{conf: conf, next: conf.Initial}
+}
+
+// Next returns the wait after a failure and grows the following one.
+func (b *Backoff) Next() time.Duration {
+	d := b.next
+	b.next = min(time.Duration(float64(b.next)*b.conf.Multiplier), b.conf.Max)
+	return d
+}
+
+// Reset starts over from the initial wait after a success.
+func (b *Backoff) Reset() { b.next = b.conf.Initial }
+
+// reconnectLimiter bounds how often connectPeer dials a peer, whatever the
+// backoff. It is not safe for concurrent use.
+type reconnectLimiter struct {
+	conf   BackoffConfig
+	recent []time.Time // attempts within the last minute
+}
+
+// wait returns how long until the next attempt is allowed by MinInterval.
+func (l *reconnectLimiter) wait() time.Duration {
+	if l.conf.MinInterval == 0 || len(l.recent) == 0 {
+		return 0
+	}
+	return max(0, l.conf.MinInterval-clock.Now().Sub(l.recent[len(l.recent)-1]))
+}
+
+// exceeded reports whether MaxPerMinute attempts were made within the last
+// minute.
+func (l *reconnectLimiter) exceeded() bool {
+	if l.conf.MaxPerMinute == 0 {
+		return false
+	}
+	cutoff := clock.Now().Add(-time.Minute)
+	for len(l.recent) > 0 && !l.recent[0].After(cutoff) {
+		l.recent = l.recent[1:]
+	}
+	return len(l.recent) >= l.conf.MaxPerMinute
+}
+
+// attempt records an attempt made now.
+func (l *reconnectLimiter) attempt() {
+	l.recent = append(l.recent, clock.Now())
+	if l.conf.MaxPerMinute == 0 {
+		// only the last one is needed for MinInterval
+		l.recent = l.recent[len(l.recent)-1:]
+	}
+}
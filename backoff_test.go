@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrows(t *testing.T) {
+	b := newBackoff(BackoffConfig{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2})
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := b.Next(); got != want {
+			t.Fatalf("Next = %v, want %v", got, want)
+		}
+	}
+	b.Reset()
+	if got := b.Next(); got != time.Second {
+		t.Fatalf("Next after Reset = %v, want the initial wait", got)
+	}
+}
+
+func TestReconnectLimiter(t *testing.T) {
+	c := useFakeClock(t)
+	l := reconnectLimiter{conf: BackoffConfig{MinInterval: 10 * time.Second, MaxPerMinute: 3}}
+	if l.wait() != 0 || l.exceeded() {
+		t.Fatal("first attempt held back")
+	}
+	l.attempt()
+	c.Advance(4 * time.Second)
+	if got := l.wait(); got != 6*time.Second {
+		t.Fatalf("wait = %v, want the rest of min_interval", got)
+	}
+	for i := 0; i < 2; i++ {
+		c.Advance(10 * time.Second)
+		l.attempt()
+	}
+	if !l.exceeded() {
+		t.Fatal("three attempts within a minute not counted")
+	}
+	// the first attempt leaves the minute
+	c.Advance(37 * time.Second)
+	if l.exceeded() {
+		t.Fatal("attempts older than a minute still counted")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BottleneckConfig is a link shared by several peers, read from
+// "bottlenecks" by name. Peers joining it with their bottleneck setting
+// draw from its capacity in proportion to their weight.
+type BottleneckConfig struct {
+	// Bandwidth is the capacity of the link in bits per second.
+	Bandwidth int64 `mapstructure:"bandwidth"`
+}
+
+var bottlenecks map[string]*Bottleneck
+
+func loadBottlenecks(confs map[string]*BottleneckConfig) error {
+	loaded := make(map[string]*Bottleneck, len(confs))
+	for name, bc := range confs {
+		if bc == nil || bc.Bandwidth <= 0 {
+			return fmt.Errorf("bottlenecks.%s: bandwidth must be positive", name)
+		}
+		loaded[name] = newBottleneck(name, bc.Bandwidth)
+	}
+	bottlenecks = loaded
+	return nil
+}
+
+// Bottleneck is the parent token bucket of the peers sharing a link. Each
+// peer's shaper asks it for the tokens of every packet, and the waiting
+// requests are granted by start-time fair queueing so backlogged peers get
+// the link in proportion to their weights.
+type Bottleneck struct {
+	name  string
+	rate  float64 // bytes per second
+	burst float64
+
+	mu      sync.Mutex
+	waiting bottleneckHeap
+	vtime   float64 // start tag of the packet last granted
+	seq     uint64
+	wake    chan struct{}
+
+	Granted atomic.Uint64 // bytes
+}
+
+func newBottleneck(name string, bandwidth int64) *Bottleneck {
+	b := &Bottleneck{name: name, rate: float64(bandwidth) / 8, wake: make(chan struct{}, 1)}
+	b.burst = max(b.rate/100, BUFSIZE)
+	return b
+}
+
+// bottleneckShare is one peer's share of a bottleneck.
+type bottleneckShare struct {
+	b      *Bottleneck
+	weight float64
+	finish float64 // finish tag of the peer's last request
+}
+
+type bottleneckReq struct {
+	start, finish float64
+	seq           uint64
+	n             int
+	grant         chan struct{}
+}
+
+type bottleneckHeap []*bottleneckReq
+
+func (h bottleneckHeap) Len() int { return len(h) }
+func (h bottleneckHeap) Less(i, j int) bool {
+	if h[i].start == h[j].start {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].start < h[j].start
+}
+func (h bottleneckHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *bottleneckHeap) Push(x any)   { *h = append(*h, x.(*bottleneckReq)) }
+func (h *bottleneckHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// acquire blocks until the bottleneck granted n bytes to the share, it
+// reports false if ctx was done first.
+func (s *bottleneckShare) acquire(ctx context.Context, n int) bool {
+	b := s.b
+	b.mu.Lock()
+	req := &bottleneckReq{start: max(b.vtime, s.finish), n: n, grant: make(chan struct{})}
+	req.finish = req.start + float64(n)/s.weight
+	s.finish = req.finish
+	b.seq++
+	req.seq = b.seq
+	heap.Push(&b.waiting, req)
+	b.mu.Unlock()
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-req.grant:
+		return true
+	}
+}
+
+// Waiting returns the number of packets waiting for the bottleneck.
+func (b *Bottleneck) Waiting() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.waiting)
+}
+
+// run grants the waiting requests at the link rate until ctx is done.
+func (b *Bottleneck) run(ctx context.Context) {
+	tokens := b.burst
+	last := clock.Now()
+	for {
+		b.mu.Lock()
+		if len(b.waiting) == 0 {
+			b.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-b.wake:
+			}
+			continue
+		}
+		// the head is only taken once its tokens are there, so a peer
+		// queueing its next packet meanwhile can still go first
+		now := clock.Now()
+		tokens = min(b.burst, tokens+now.Sub(last).Seconds()*b.rate)
+		last = now
+		if need := float64(b.waiting[0].n) - tokens; need > 0 {
+			b.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-clock.After(time.Duration(need / b.rate * float64(time.Second))):
+			}
+			continue
+		}
+		req := heap.Pop(&b.waiting).(*bottleneckReq)
+		b.vtime = req.start
+		b.mu.Unlock()
+		tokens -= float64(req.n)
+		b.Granted.Add(uint64(req.n))
+		close(req.grant)
+	}
+}
+
+// runBottlenecks runs every configured bottleneck until ctx is done.
+func runBottlenecks(ctx context.Context) {
+	for _, b := range bottlenecks {
+		go b.run(ctx)
+	}
+}
+
+// BottleneckSnapshot is a point-in-time copy of a bottleneck's stats.
+type BottleneckSnapshot struct {
+	Name         string `json:"name"`
+	Bandwidth    int64  `json:"bandwidth"`
+	Waiting      int    `json:"waiting"`
+	GrantedBytes uint64 `json:"granted_bytes"`
+}
+
+func bottleneckSnapshots() []BottleneckSnapshot {
+	var snaps []BottleneckSnapshot
+	for _, b := range bottlenecks {
+		snaps = append(snaps, BottleneckSnapshot{
+			Name:         b.name,
+			Bandwidth:    int64(b.rate * 8),
+			Waiting:      b.Waiting(),
+			GrantedBytes: b.Granted.Load(),
+		})
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Name < snaps[j].Name })
+	return snaps
+}
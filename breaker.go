@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerConfig tunes the per-peer circuit breakers, read from "breaker".
+type BreakerConfig struct {
+	// Threshold is the number of consecutive connect failures that open the breaker.
+	Threshold int `mapstructure:"threshold"`
+	// Cooldown is how long an open breaker blocks reconnection attempts.
+	Cooldown time.Duration `mapstructure:"cooldown"`
+}
+
+var breakerConfig = BreakerConfig{Threshold: 5, Cooldown: 30 * time.Second}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops reconnecting to a peer that keeps failing. After
+// Threshold consecutive failures it opens for Cooldown, then half-opens to
+// let a single attempt through; that attempt closes or reopens it.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// Allow reports whether a connection attempt may be made now.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if clock.Now().Sub(b.openedAt) < breakerConfig.Cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a successful connection and closes the breaker.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// Failure records a failed connection attempt and reports whether the
+// breaker opened because of it.
+func (b *CircuitBreaker) Failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.state == breakerHalfOpen || b.failures >= breakerConfig.Threshold {
+		opened := b.state != breakerOpen
+		b.state = breakerOpen
+		b.openedAt = clock.Now()
+		return opened
+	}
+	return false
+}
+
+// Trip opens the breaker regardless of the failures counted.
+func (b *CircuitBreaker) Trip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerOpen
+	b.openedAt = clock.Now()
+	b.trial = false
+}
+
+// Open reports whether the breaker currently blocks the peer.
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerOpen
+}
+
+// RetryIn returns how long until an open breaker half-opens.
+func (b *CircuitBreaker) RetryIn() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return 0
+	}
+	return breakerConfig.Cooldown - clock.Now().Sub(b.openedAt)
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state.String()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerCooldown(t *testing.T) {
+	c := useFakeClock(t)
+	defer func(old BreakerConfig) { breakerConfig = old }(breakerConfig)
+	breakerConfig = BreakerConfig{Threshold: 3, Cooldown: 30 * time.Second}
+	var b CircuitBreaker
+	for i := 0; i < 2; i++ {
+		if b.Failure() {
+			t.Fatalf("opened after %d failures, want 3", i+1)
+		}
+	}
+	if !b.Failure() || b.Allow() {
+		t.Fatal("breaker not open after the threshold")
+	}
+	c.Advance(10 * time.Second)
+	if b.Allow() || b.RetryIn() != 20*time.Second {
+		t.Fatalf("allowed or retries in %v within the cooldown, want 20s", b.RetryIn())
+	}
+	c.Advance(20 * time.Second)
+	if !b.Allow() || b.State() != "half-open" {
+		t.Fatal("breaker not half-open after the cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("half-open breaker let a second attempt through")
+	}
+	if !b.Failure() || b.RetryIn() != 30*time.Second {
+		t.Fatal("failed trial did not reopen the breaker for the cooldown")
+	}
+	c.Advance(30 * time.Second)
+	b.Allow()
+	b.Success()
+	if b.State() != "closed" || !b.Allow() {
+		t.Fatal("successful trial did not close the breaker")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// CaptureConfig writes forwarded packets to a pcap file, read from "capture".
+type CaptureConfig struct {
+	// File is the pcap file, empty disables the capture.
+	File string `mapstructure:"file"`
+	// Sample is the fraction of the matching packets written.
+	Sample float64       `mapstructure:"sample"`
+	Filter CaptureFilter `mapstructure:"filter"`
+}
+
+// CaptureFilter selects the captured packets, on top of the 5-tuple by
+// DSCP, -1 is any, and by impaired: "impaired" only keeps packets an
+// impairment dropped or delayed, "normal" only the others.
+type CaptureFilter struct {
+	FlowMatch `mapstructure:",squash"`
+	DSCP      int    `mapstructure:"dscp"`
+	Impaired  string `mapstructure:"impaired"`
+}
+
+var captureConfig = CaptureConfig{Sample: 1, Filter: CaptureFilter{DSCP: -1}}
+
+func (c *CaptureConfig) validate() error {
+	if c.Sample < 0 || c.Sample > 1 {
+		return fmt.Errorf("capture: sample %v is not a fraction", c.Sample)
+	}
+	if c.Filter.DSCP < -1 || c.Filter.DSCP > 63 {
+		return fmt.Errorf("capture: dscp %d is not a 6-bit dscp value", c.Filter.DSCP)
+	}
+	switch c.Filter.Impaired {
+	case "", "impaired", "normal":
+	default:
+		return fmt.Errorf("capture: impaired must be impaired or normal, got %q", c.Filter.Impaired)
+	}
+	if err := c.Filter.compile(); err != nil {
+		return fmt.Errorf("capture: %w", err)
+	}
+	return nil
+}
+
+func (f *CaptureFilter) match(packet []byte, impaired bool) bool {
+	flow, ok := parseFlowKey(packet)
+	if !ok || !f.FlowMatch.match(flow) {
+		return false
+	}
+	if f.DSCP >= 0 && (!validIPv4Header(packet) || int(packet[1]>>2) != f.DSCP) {
+		return false
+	}
+	switch f.Impaired {
+	case "impaired":
+		return impaired
+	case "normal":
+		return !impaired
+	}
+	return true
+}
+
+const linkTypeRaw = 101
+
+// pcapWriter writes packets in the classic pcap format.
+type pcapWriter struct {
+	mu     sync.Mutex
+	f      *os.File
+	filter CaptureFilter
+	sample float64
+	rng    *rand.Rand
+}
+
+// capture is the running capture, nil if disabled.
+var capture *pcapWriter
+
+func newPCAPWriter(conf CaptureConfig, seed int64) (*pcapWriter, error) {
+	f, err := os.Create(conf.File)
+	if err != nil {
+		return nil, err
+	}
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	if _, err = f.Write(hdr[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &pcapWriter{f: f, filter: conf.Filter, sample: conf.Sample, rng: rand.New(rand.NewSource(seed))}, nil
+}
+
+// write records packet if it passes the filter and the sampling.
+func (w *pcapWriter) write(packet []byte, impaired bool) error {
+	if !w.filter.match(packet, impaired) {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sample < 1 && w.rng.Float64() >= w.sample {
+		return nil
+	}
+	now := clock.Now()
+	rec := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/int(time.Microsecond)))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(packet)))
+	_, err := w.f.Write(append(rec, packet...))
+	return err
+}
+
+func (w *pcapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// capturePacket hands packet to the running capture.
+func capturePacket(packet []byte, impaired bool) {
+	if capture == nil {
+		return
+	}
+	if err := capture.write(packet, impaired); err != nil {
+		slog.Error("capture packet failed", "err", err)
+	}
+}
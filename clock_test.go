@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// useFakeClock makes a FakeClock the clock until the test ends.
+func useFakeClock(tb testing.TB) *FakeClock {
+	c := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	old := clock
+	tb.Cleanup(func() { clock = old })
+	clock = c
+	return c
+}
+
+// waitPending waits until a timer of c is pending.
+func waitPending(tb testing.TB, c *FakeClock) {
+	tb.Helper()
+	for deadline := time.Now().Add(2 * time.Second); c.Pending() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			tb.Fatal("no timer started")
+		}
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	c := useFakeClock(t)
+	ctx, cancel := withTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Advance(time.Second - 1)
+	select {
+	case <-ctx.Done():
+		t.Fatal("context done before its timeout")
+	default:
+	}
+	c.Advance(1)
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("context not done after its timeout")
+	}
+	if !errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+		t.Fatalf("cause = %v, want the deadline", context.Cause(ctx))
+	}
+}
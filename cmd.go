@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+)
+
+// runDevicesCmd implements the devices subcommand. With -admin it lists the
+// tun devices of a running simulator, otherwise it shows the devices the
+// given -cidr would produce without creating anything.
+func runDevicesCmd(args []string) error {
+	fs := flag.NewFlagSet("devices", flag.ExitOnError)
+	addr := fs.String("admin", "", "admin api address of a running simulator")
+	cidr := fs.String("cidr", "10.0.0.0/24", "subnet the tun interface addresses are allocated from")
+	fs.Parse(args)
+
+	var infos []DeviceInfo
+	if *addr != "" {
+		resp, err := http.Get("http://" + *addr + "/devices")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("query %s: %s", *addr, resp.Status)
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+			return err
+		}
+	} else {
+		addrs, err := allocTunAddrs(*cidr, tunIfaceNum)
+		if err != nil {
+			return err
+		}
+		if tunIfaceNum > len(tunName) {
+			return fmt.Errorf("%d tun interfaces but only %d names", tunIfaceNum, len(tunName))
+		}
+		for i, a := range addrs {
+			infos = append(infos, DeviceInfo{Name: tunName[i], Addr: a.String()})
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDR\tSTATUS\tMTU")
+	for _, info := range infos {
+		status, mtu := "not created", "-"
+		if info.Exists {
+			status, mtu = "down", fmt.Sprint(info.MTU)
+			if info.Up {
+				status = "up"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", info.Name, info.Addr, status, mtu)
+	}
+	return w.Flush()
+}
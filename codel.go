@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// CoDelConfig enables CoDel active queue management (RFC 8289) in front of
+// a peer's bandwidth limit: once packets waited longer than Target for at
+// least Interval, they are dropped on dequeue at a rate growing with the
+// square root of the drops until the queue delay falls below Target again.
+type CoDelConfig struct {
+	Target   time.Duration `mapstructure:"target"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+func (c CoDelConfig) enabled() bool { return c.Target > 0 }
+
+func (c CoDelConfig) validate() error {
+	if c.Target < 0 || c.Interval < 0 || c.enabled() && c.Interval == 0 {
+		return fmt.Errorf("codel: target must not be negative and interval positive")
+	}
+	return nil
+}
+
+var defaultCoDelInterval = 100 * time.Millisecond
+
+// codel is the state of CoDel for one queue, guarded by the shaper's mutex.
+type codel struct {
+	target, interval time.Duration
+
+	firstAbove time.Time // when the delay has been above target for interval
+	dropNext   time.Time
+	count      int
+	lastCount  int
+	dropping   bool
+}
+
+func newCoDel(c CoDelConfig) *codel {
+	return &codel{target: c.Target, interval: c.Interval}
+}
+
+func (c *codel) controlLaw(t time.Time) time.Time {
+	return t.Add(time.Duration(float64(c.interval) / math.Sqrt(float64(c.count))))
+}
+
+// okToDrop reports whether q, just dequeued, was queued for too long.
+func (c *codel) okToDrop(q queuedPacket, now time.Time, s *Shaper) bool {
+	sojourn := now.Sub(q.at)
+	s.Sojourn.Store(int64(sojourn))
+	// the last packet in the queue is never dropped, there is no standing queue
+	if sojourn < c.target || s.sched.len() == 0 {
+		c.firstAbove = time.Time{}
+		return false
+	}
+	if c.firstAbove.IsZero() {
+		c.firstAbove = now.Add(c.interval)
+		return false
+	}
+	return !now.Before(c.firstAbove)
+}
+
+// dequeue pops the next packet of s that CoDel lets through.
+func (c *codel) dequeue(s *Shaper) ([]byte, bool) {
+	now := clock.Now()
+	q, ok := s.sched.pop()
+	if !ok {
+		c.dropping = false
+		return nil, false
+	}
+	drop := c.okToDrop(q, now, s)
+	if c.dropping {
+		if !drop {
+			c.dropping = false
+		}
+		for c.dropping && !now.Before(c.dropNext) {
+			s.AQMDrops.Add(1)
+			releaseMemory(q.pkt)
+			c.count++
+			if q, ok = s.sched.pop(); !ok {
+				c.dropping = false
+				return nil, false
+			}
+			if c.okToDrop(q, now, s) {
+				c.dropNext = c.controlLaw(c.dropNext)
+			} else {
+				c.dropping = false
+			}
+		}
+	} else if drop {
+		s.AQMDrops.Add(1)
+		releaseMemory(q.pkt)
+		if q, ok = s.sched.pop(); !ok {
+			return nil, false
+		}
+		c.okToDrop(q, now, s)
+		c.dropping = true
+		// start close to the last drop rate if dropping stopped only recently
+		if delta := c.count - c.lastCount; delta > 1 && now.Sub(c.dropNext) < 16*c.interval {
+			c.count = delta
+		} else {
+			c.count = 1
+		}
+		c.dropNext = c.controlLaw(now)
+		c.lastCount = c.count
+	}
+	return q.pkt, true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CompressionDeflate compresses the packets sent to a peer with DEFLATE,
+// set with the peer's compression. Packets that do not shrink are sent as
+// they are; the receiver tells them apart by the frame header, so it needs
+// no setting of its own.
+const CompressionDeflate = "deflate"
+
+func validateCompression(c string) error {
+	switch c {
+	case "", CompressionDeflate:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", c)
+}
+
+// frameEncoder appends packets to a peer as frames, compressing them if
+// the peer is configured to. It is used by a single writer.
+type frameEncoder struct {
+	w     *flate.Writer
+	buf   bytes.Buffer
+	stats *PeerStats
+}
+
+func newFrameEncoder(compression string, stats *PeerStats) *frameEncoder {
+	e := &frameEncoder{stats: stats}
+	if compression == CompressionDeflate {
+		e.w, _ = flate.NewWriter(nil, flate.BestSpeed)
+	}
+	return e
+}
+
+func (e *frameEncoder) appendFrame(dst, packet []byte) []byte {
+	if e.w == nil || len(packet) == 0 {
+		return appendFrame(dst, packet)
+	}
+	e.buf.Reset()
+	e.w.Reset(&e.buf)
+	e.w.Write(packet)
+	e.w.Close()
+	e.stats.CompressIn.Add(uint64(len(packet)))
+	if e.buf.Len() >= len(packet) {
+		e.stats.CompressOut.Add(uint64(len(packet)))
+		return appendFrame(dst, packet)
+	}
+	e.stats.CompressOut.Add(uint64(e.buf.Len()))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(e.buf.Len())|frameCompressed)
+	return append(dst, e.buf.Bytes()...)
+}
+
+// inflater decompresses frames, they are pooled as every stream reader
+// only needs one while reading a compressed frame.
+type inflater struct {
+	scratch []byte
+	src     bytes.Reader
+	r       io.ReadCloser
+}
+
+var inflaters = sync.Pool{New: func() any {
+	return &inflater{scratch: make([]byte, BUFSIZE), r: flate.NewReader(nil)}
+}}
+
+var errFrameTooLarge = errors.New("decompressed frame exceeds buffer")
+
+// readCompressed reads a compressed frame of n bytes from r and
+// decompresses it into buf.
+func readCompressed(r io.Reader, n int, buf []byte) (int, error) {
+	d := inflaters.Get().(*inflater)
+	defer inflaters.Put(d)
+	if n > len(d.scratch) {
+		d.scratch = make([]byte, n)
+	}
+	if _, err := io.ReadFull(r, d.scratch[:n]); err != nil {
+		return 0, err
+	}
+	d.src.Reset(d.scratch[:n])
+	if err := d.r.(flate.Resetter).Reset(&d.src, nil); err != nil {
+		return 0, err
+	}
+	m, err := io.ReadFull(d.r, buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return m, nil
+	case err != nil:
+		return 0, fmt.Errorf("decompress frame: %w", err)
+	}
+	// buf is full, the packet must end here
+	var extra [1]byte
+	if k, _ := d.r.Read(extra[:]); k > 0 {
+		return 0, errFrameTooLarge
+	}
+	return m, nil
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gookit/config/v2"
+	"github.com/gookit/config/v2/yamlv3"
+)
+
+// ConfigSource is where the simulator reads its configuration from.
+type ConfigSource interface {
+	// Load returns the raw config and its format, a gookit driver name.
+	Load(ctx context.Context) ([]byte, string, error)
+	String() string
+}
+
+// newConfigSource picks the source by the scheme of uri: a plain path or
+// file:// reads a local file, http(s):// fetches the url, and
+// etcd://host:port/key reads key through the etcd v3 JSON gateway.
+func newConfigSource(uri string) (ConfigSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" {
+		return fileSource(uri), nil
+	}
+	switch u.Scheme {
+	case "file":
+		return fileSource(u.Host + u.Path), nil
+	case "http", "https":
+		return httpSource(uri), nil
+	case "etcd":
+		key := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("config uri %q: want etcd://host:port/key", uri)
+		}
+		return etcdSource{endpoint: "http://" + u.Host, key: key}, nil
+	default:
+		return nil, fmt.Errorf("config uri %q: unsupported scheme %q", uri, u.Scheme)
+	}
+}
+
+// formatOf guesses the config format from a file name, defaulting to yaml.
+func formatOf(name string) string {
+	if path.Ext(name) == ".json" {
+		return config.JSON
+	}
+	return config.Yaml
+}
+
+type fileSource string
+
+func (s fileSource) Load(context.Context) ([]byte, string, error) {
+	data, err := os.ReadFile(string(s))
+	return data, formatOf(string(s)), err
+}
+
+func (s fileSource) String() string { return string(s) }
+
+type httpSource string
+
+func (s httpSource) Load(ctx context.Context) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, string(s), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetch %s: %s", s, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	format := formatOf(req.URL.Path)
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		format = config.JSON
+	}
+	return data, format, nil
+}
+
+func (s httpSource) String() string { return string(s) }
+
+type etcdSource struct {
+	endpoint string
+	key      string
+}
+
+func (s etcdSource) Load(ctx context.Context) ([]byte, string, error) {
+	body, _ := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(s.key))})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("etcd range %s: %s", s.key, resp.Status)
+	}
+	var rangeResp struct {
+		Kvs []struct {
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&rangeResp); err != nil {
+		return nil, "", fmt.Errorf("etcd range %s: %w", s.key, err)
+	}
+	if len(rangeResp.Kvs) == 0 {
+		return nil, "", fmt.Errorf("etcd key %s not found", s.key)
+	}
+	return rangeResp.Kvs[0].Value, formatOf(s.key), nil
+}
+
+func (s etcdSource) String() string {
+	return "etcd://" + strings.TrimPrefix(s.endpoint, "http://") + "/" + s.key
+}
+
+// configList is a repeatable flag of config sources.
+type configList []string
+
+func (l *configList) String() string { return strings.Join(*l, ", ") }
+
+func (l *configList) Set(uri string) error {
+	*l = append(*l, uri)
+	return nil
+}
+
+// layeredSource merges the configs of its sources in order like gookit
+// config does: later ones override the keys of earlier ones, maps are
+// merged key by key and anything else replaced. Every source must load.
+type layeredSource []ConfigSource
+
+func (s layeredSource) Load(ctx context.Context) ([]byte, string, error) {
+	c := newConfig()
+	for _, src := range s {
+		data, format, err := src.Load(ctx)
+		if err != nil {
+			return nil, "", fmt.Errorf("config %s: %w", src, err)
+		}
+		if err = c.LoadSources(format, data); err != nil {
+			return nil, "", fmt.Errorf("config %s: %w", src, err)
+		}
+	}
+	data, err := yamlv3.Encoder(c.Data())
+	return data, config.Yaml, err
+}
+
+func (s layeredSource) String() string {
+	names := make([]string, len(s))
+	for i, src := range s {
+		names[i] = src.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// newConfigSources returns the source of uris, layered if more than one.
+func newConfigSources(uris []string) (ConfigSource, error) {
+	if len(uris) == 1 {
+		return newConfigSource(uris[0])
+	}
+	layers := make(layeredSource, 0, len(uris))
+	for _, uri := range uris {
+		src, err := newConfigSource(uri)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, src)
+	}
+	return layers, nil
+}
+
+func newConfig() *config.Config {
+	c := config.NewWithOptions("simulator", config.ParseEnv, config.ParseTime)
+	c.AddDriver(yamlv3.Driver)
+	return c
+}
+
+func parseConfig(data []byte, format string) (*config.Config, error) {
+	c := newConfig()
+	if err := c.LoadSources(format, data); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadConfig reads and applies the startup config merged from uris, see
+// newConfigSources and loadConfig, and returns the source with the loaded
+// content for watchConfig. The merged config is validated as a whole.
+// Nothing reads the config before it is called: package initialisation has
+// no side effects and can not fail.
+func LoadConfig(ctx context.Context, uris []string, fallback string) (ConfigSource, []byte, error) {
+	src, err := newConfigSources(uris)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrConfigInvalid, err)
+	}
+	data, err := loadConfig(ctx, src, fallback)
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, data, nil
+}
+
+// loadConfig reads the startup config from src. If src can not be reached
+// and a fallback file is given, the fallback is used instead.
+func loadConfig(ctx context.Context, src ConfigSource, fallback string) ([]byte, error) {
+	data, format, err := src.Load(ctx)
+	if err != nil {
+		if fallback == "" {
+			return nil, err
+		}
+		slog.Warn("config source unreachable, use fallback", "source", src.String(), "fallback", fallback, "err", err)
+		data, format, err = fileSource(fallback).Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c, err := parseConfig(data, format)
+	if err == nil {
+		err = applyConfig(c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrConfigInvalid, err)
+	}
+	return data, nil
+}
+
+// applyConfig sets up the simulator from c at startup.
+func applyConfig(c *config.Config) error {
+	role = c.String("role", RoleBoth)
+	if err := validateRole(role); err != nil {
+		return err
+	}
+	routes, err := parseRoutes(c)
+	if err != nil {
+		return err
+	}
+	if err = checkRoutes(routes); err != nil {
+		return err
+	}
+	for vIP, rIP := range routes {
+		iptable.Add(net.ParseIP(vIP), rIP)
+	}
+	proxyProtocol = c.Bool("proxy_protocol")
+	zeroRTT = c.Bool("zero_rtt")
+	ttlDecrement = c.Bool("ttl_decrement")
+	mssClamp = c.Int("mss_clamp")
+	if err = validateMSSClamp(mssClamp); err != nil {
+		return err
+	}
+	if err = loadQUICVersions(c.Strings("quic_versions"), c.String("quic_library")); err != nil {
+		return err
+	}
+	congestionControl = c.String("congestion_control", CCCubic)
+	if err = validateCongestionControl(congestionControl); err != nil {
+		return err
+	}
+	if c.Exists("impairment_seed") {
+		impairmentSeed = c.Int64("impairment_seed")
+	} else {
+		impairmentSeed = time.Now().UnixNano()
+	}
+	slog.Info("impairment seed", "seed", impairmentSeed)
+	if c.Exists("mark_dscp") {
+		markDSCP = c.Int("mark_dscp")
+		if markDSCP < 0 || markDSCP > 63 {
+			return fmt.Errorf("mark_dscp: %d is not a 6-bit dscp value", markDSCP)
+		}
+	}
+
+	impairmentRanges = c.String("impairment_ranges", RangeError)
+	if impairmentRanges != RangeError && impairmentRanges != RangeClamp {
+		return fmt.Errorf("impairment_ranges: must be %s or %s, got %q", RangeError, RangeClamp, impairmentRanges)
+	}
+
+	// peers inherit the global backoff, so it is loaded first
+	if err = c.MapOnExists("backoff", &backoffConfig); err != nil {
+		return err
+	}
+	if err = backoffConfig.validate(); err != nil {
+		return fmt.Errorf("backoff: %w", err)
+	}
+
+	// peers refer to the bottlenecks by name
+	var links map[string]*BottleneckConfig
+	if err = c.MapOnExists("bottlenecks", &links); err != nil {
+		return err
+	}
+	if err = loadBottlenecks(links); err != nil {
+		return err
+	}
+
+	// and to the tls profiles
+	var profiles map[string]*TLSProfile
+	if err = c.MapOnExists("tls_profiles", &profiles); err != nil {
+		return err
+	}
+	if err = loadTLSProfiles(profiles); err != nil {
+		return err
+	}
+
+	var peers map[string]*PeerConfig
+	if err = c.MapOnExists("peers", &peers); err != nil {
+		return err
+	}
+	if err = loadPeerConfigs(peers); err != nil {
+		return err
+	}
+
+	if c.Exists("listeners") {
+		var listeners []ListenerConfig
+		if err = c.MapOnExists("listeners", &listeners); err != nil {
+			return err
+		}
+		if err = validateListeners(listeners); err != nil {
+			return err
+		}
+		listenerConfigs = listeners
+	}
+
+	var rules []*PolicyRule
+	if err = c.MapOnExists("rules", &rules); err != nil {
+		return err
+	}
+	if err = loadPolicyRules(rules); err != nil {
+		return err
+	}
+
+	var allow []string
+	if err = c.MapOnExists("allowlist", &allow); err != nil {
+		return err
+	}
+	if err = loadAllowlist(allow); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("server_cert", &serverCertConfig); err != nil {
+		return err
+	}
+	if err = serverCertConfig.validate(); err != nil {
+		return err
+	}
+
+	var mtls MTLSConfig
+	if err = c.MapOnExists("mtls", &mtls); err != nil {
+		return err
+	}
+	if err = loadMTLSConfig(mtls); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("breaker", &breakerConfig); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("cycle", &cycleConfig); err != nil {
+		return err
+	}
+	if err = cycleConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("drain", &drainConfig); err != nil {
+		return err
+	}
+	if drainConfig.Timeout <= 0 {
+		return fmt.Errorf("drain: timeout must be positive")
+	}
+
+	if err = c.MapOnExists("pause", &pauseConfig); err != nil {
+		return err
+	}
+	if err = pauseConfig.validate(); err != nil {
+		return err
+	}
+
+	var outages []OutageConfig
+	if err = c.MapOnExists("outages", &outages); err != nil {
+		return err
+	}
+	if err = validateOutages(outages); err != nil {
+		return err
+	}
+	outageConfigs = outages
+
+	if err = c.MapOnExists("capture", &captureConfig); err != nil {
+		return err
+	}
+	if err = captureConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("access_log", &accessLogConfig); err != nil {
+		return err
+	}
+	if err = accessLogConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("memory", &memoryConfig); err != nil {
+		return err
+	}
+	if err = memoryConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("pending_routes", &pendingRouteConfig); err != nil {
+		return err
+	}
+	if err = pendingRouteConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("relay", &relayConfig); err != nil {
+		return err
+	}
+	if err = relayConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("passthrough", &passthroughConfig); err != nil {
+		return err
+	}
+	if err = passthroughConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("device_log", &deviceLogConfig); err != nil {
+		return err
+	}
+	if err = deviceLogConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("hexdump", &hexdumpConfig); err != nil {
+		return err
+	}
+	if err = hexdumpConfig.validate(); err != nil {
+		return err
+	}
+	if hexdumpConfig.Enable {
+		setHexdump(hexdumpConfig)
+	}
+
+	if err = c.MapOnExists("dead_peer", &deadPeerConfig); err != nil {
+		return err
+	}
+	if deadPeerConfig.Interval < 0 || deadPeerConfig.enabled() && deadPeerConfig.Threshold < 1 {
+		return fmt.Errorf("dead_peer: interval must not be negative and threshold at least 1")
+	}
+	// the peers were checked before dead_peer was read
+	for vIP, pc := range peerConfigs {
+		if err = checkIdleTimeout(vIP, pc); err != nil {
+			return err
+		}
+	}
+
+	if err = c.MapOnExists("generator", &generatorConfig); err != nil {
+		return err
+	}
+	if err = generatorConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("flows", &flowConfig); err != nil {
+		return err
+	}
+	if flowConfig.IdleTTL <= 0 || flowConfig.SweepInterval <= 0 {
+		return fmt.Errorf("flows: idle_ttl and sweep_interval must be positive")
+	}
+
+	var vlans map[string]VLANConfig
+	if err = c.MapOnExists("vlan", &vlans); err != nil {
+		return err
+	}
+	if err = validateVLANConfigs(vlans); err != nil {
+		return err
+	}
+	vlanConfigs = vlans
+
+	var rpfs map[string]RPFConfig
+	if err = c.MapOnExists("rpf", &rpfs); err != nil {
+		return err
+	}
+	if err = validateRPFConfigs(rpfs); err != nil {
+		return err
+	}
+	rpfConfigs = rpfs
+
+	if err = c.MapOnExists("decap", &decapConfig); err != nil {
+		return err
+	}
+	if err = decapConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("mtu_probe", &mtuProbeConfig); err != nil {
+		return err
+	}
+	if err = mtuProbeConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("tracing", &tracingConfig); err != nil {
+		return err
+	}
+	if err = tracingConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("startup", &startupConfig); err != nil {
+		return err
+	}
+	if err = startupConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("stats_export", &statsExportConfig); err != nil {
+		return err
+	}
+	if err = statsExportConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("fragments", &fragmentConfig); err != nil {
+		return err
+	}
+	if err = fragmentConfig.validate(); err != nil {
+		return err
+	}
+
+	if err = c.MapOnExists("tun_read", &tunReadConfig); err != nil {
+		return err
+	}
+	if tunReadConfig.Workers < 1 || tunReadConfig.Queue < 1 {
+		return fmt.Errorf("tun_read: workers and queue must be at least 1")
+	}
+
+	if err = c.MapOnExists("tun_write", &tunWriteConfig); err != nil {
+		return err
+	}
+	return tunWriteConfig.validate()
+}
+
+// parseRoutes returns the route table of c, virtual IP -> real IP.
+func parseRoutes(c *config.Config) (map[string]net.IP, error) {
+	routes := make(map[string]net.IP)
+	for k, v := range c.StringMap("map1") {
+		vIP, rIP := net.ParseIP(k), net.ParseIP(v)
+		if vIP == nil || rIP == nil {
+			return nil, fmt.Errorf("map1: invalid route %q -> %q", k, v)
+		}
+		routes[vIP.String()] = rIP
+	}
+	return routes, nil
+}
+
+// checkRoutes warns that nothing will be forwarded without routes, or
+// fails with -require-routes.
+func checkRoutes(routes map[string]net.IP) error {
+	// a pure server is not meant to dial anyone
+	if len(routes) > 0 || !runsClient() {
+		return nil
+	}
+	if requireRoutes {
+		return fmt.Errorf("map1: no routes configured")
+	}
+	slog.Warn("map1 has no routes, no peers are connected and nothing is forwarded until routes are added")
+	return nil
+}
+
+// reloadConfig applies a changed config at runtime. Only the routes and
+// per-peer settings of new routes are picked up: routes that disappeared
+// are stopped, new or changed ones are started. Everything else needs a
+// restart.
+func reloadConfig(ctx context.Context, data []byte, format string) error {
+	routes, err := parseReloadable(data, format)
+	if err == nil {
+		err = checkRoutes(routes)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConfigInvalid, err)
+	}
+
+	peerTable.Range(func(p *Peer) bool {
+		if rIP, ok := routes[p.vIP.String()]; !ok || !rIP.Equal(p.rIP) {
+			slog.Info("remove route", "vIP", p.vIP, "rIP", p.rIP)
+			stopPeer(p)
+		}
+		return true
+	})
+	for vIP, rIP := range routes {
+		if _, ok := peerTable.Get(net.ParseIP(vIP)); !ok && runsClient() {
+			slog.Info("add route", "vIP", vIP, "rIP", rIP)
+			startPeer(ctx, net.ParseIP(vIP), rIP)
+		}
+	}
+	return nil
+}
+
+// parseReloadable parses the routes of a config and loads its peer settings.
+func parseReloadable(data []byte, format string) (map[string]net.IP, error) {
+	c, err := parseConfig(data, format)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := parseRoutes(c)
+	if err != nil {
+		return nil, err
+	}
+	// bottlenecks are not reloaded, peers may only join the running ones
+	var profiles map[string]*TLSProfile
+	if err = c.MapOnExists("tls_profiles", &profiles); err != nil {
+		return nil, err
+	}
+	if err = loadTLSProfiles(profiles); err != nil {
+		return nil, err
+	}
+	var peers map[string]*PeerConfig
+	if err = c.MapOnExists("peers", &peers); err != nil {
+		return nil, err
+	}
+	return routes, loadPeerConfigs(peers)
+}
+
+// watchConfig polls src every interval and reloads the config whenever its
+// content changes. A reload is also forced whenever hup fires.
+func watchConfig(ctx context.Context, src ConfigSource, interval time.Duration, last []byte, hup <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-hup:
+			force = true
+		}
+		data, format, err := src.Load(ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				slog.Error("load config failed", "source", src.String(), "err", err)
+			}
+			continue
+		}
+		if !force && bytes.Equal(data, last) {
+			continue
+		}
+		if err = reloadConfig(ctx, data, format); err != nil {
+			slog.Error("reload config failed, keep the current one", "source", src.String(), "err", err)
+			continue
+		}
+		last = data
+		slog.Info("config reloaded", "source", src.String())
+	}
+}
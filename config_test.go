@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestInitWithoutConfig runs the package initialization in an empty
+// directory, without config_example.yaml or any other file next to it, and
+// checks it neither fails nor writes anything.
+func TestInitWithoutConfig(t *testing.T) {
+	if os.Getenv("NETSIM_INIT_ONLY") != "" {
+		return
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInitWithoutConfig$")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "NETSIM_INIT_ONLY=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("init in an empty directory: %v\n%s", err, out)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Fatalf("init wrote %s", entries[0].Name())
+	}
+}
+
+// TestApplyConfigNoRoutes checks a config with an empty or missing map1
+// warns, fails with -require-routes and passes a pure server.
+func TestApplyConfigNoRoutes(t *testing.T) {
+	log := slog.Default()
+	defer slog.SetDefault(log)
+	defer func(old bool) { requireRoutes = old }(requireRoutes)
+	defer func(old string) { role = old }(role)
+	tests := []struct {
+		name    string
+		conf    string
+		require bool
+		warn    bool
+		err     bool
+	}{
+		{"missing", "role: both\n", false, true, false},
+		{"empty", "role: both\nmap1: {}\n", false, true, false},
+		{"client", "role: client\nmap1: {}\n", false, true, false},
+		{"required missing", "role: both\n", true, false, true},
+		{"required empty", "role: client\nmap1: {}\n", true, false, true},
+		{"server", "role: server\n", true, false, false},
+		{"routes", "role: client\nmap1:\n  \"10.0.9.7\": 127.0.0.1\n", true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+			requireRoutes = tt.require
+			c, err := parseConfig([]byte(tt.conf), "yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = applyConfig(c)
+			if tt.err != (err != nil) || err != nil && !strings.Contains(err.Error(), "map1: no routes configured") {
+				t.Fatalf("applyConfig = %v, want error %v", err, tt.err)
+			}
+			if warned := strings.Contains(buf.String(), "map1 has no routes"); warned != tt.warn {
+				t.Fatalf("warned %v, want %v:\n%s", warned, tt.warn, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CycleConfig is read from "cycle". Cycling closes the client connections
+// open when it was requested one at a time, Delay after the request and
+// Interval apart, so the clients reconnect and redo the TLS handshake, e.g.
+// to pick up a new server certificate, without all reconnecting at once.
+type CycleConfig struct {
+	Delay    time.Duration `mapstructure:"delay"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+var cycleConfig = CycleConfig{Interval: time.Second}
+
+func (c CycleConfig) validate() error {
+	if c.Delay < 0 || c.Interval <= 0 {
+		return fmt.Errorf("cycle: delay must not be negative and interval positive")
+	}
+	return nil
+}
+
+// connRegistry tracks the open client connections of all listeners by
+// their close functions.
+type connRegistry struct {
+	mu    sync.Mutex
+	next  uint64
+	conns map[uint64]func(reason string)
+}
+
+var serverConns = connRegistry{conns: make(map[uint64]func(string))}
+
+// add registers a connection and returns the function unregistering it.
+func (r *connRegistry) add(closeConn func(reason string)) (remove func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	id := r.next
+	r.conns[id] = closeConn
+	return func() {
+		r.mu.Lock()
+		delete(r.conns, id)
+		r.mu.Unlock()
+	}
+}
+
+// take unregisters connection id and returns its close function, nil if
+// it closed meanwhile.
+func (r *connRegistry) take(id uint64) func(string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	closeConn := r.conns[id]
+	delete(r.conns, id)
+	return closeConn
+}
+
+func (r *connRegistry) ids() []uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]uint64, 0, len(r.conns))
+	for id := range r.conns {
+		ids = append(ids, id)
+	}
+	// oldest first
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+var (
+	cycling        atomic.Bool
+	cycledConns    atomic.Uint64
+	cycleRemaining atomic.Int64
+)
+
+// CycleConnections starts cycling the open client connections, it returns
+// false if a cycle is still running.
+func CycleConnections() bool {
+	if !cycling.CompareAndSwap(false, true) {
+		return false
+	}
+	ids := serverConns.ids()
+	cycleRemaining.Store(int64(len(ids)))
+	slog.Info("cycle connections", "connections", len(ids), "delay", cycleConfig.Delay, "interval", cycleConfig.Interval)
+	go func() {
+		defer cycling.Store(false)
+		<-clock.After(cycleConfig.Delay)
+		for i, id := range ids {
+			if i > 0 {
+				<-clock.After(cycleConfig.Interval)
+			}
+			cycleRemaining.Add(-1)
+			if closeConn := serverConns.take(id); closeConn != nil {
+				closeConn("cycle")
+				cycledConns.Add(1)
+			}
+		}
+		slog.Info("connections cycled", "total", cycledConns.Load())
+	}()
+	return true
+}
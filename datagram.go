@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// DatagramOversizeFragment splits IPv4 packets larger than a datagram
+	// into IP fragments, packets with DF set and IPv6 are dropped.
+	DatagramOversizeFragment = "fragment"
+	// DatagramOversizeDrop drops packets larger than a datagram.
+	DatagramOversizeDrop = "drop"
+
+	// quic-go accepts DATAGRAM frames of up to 1200 bytes, less the frame
+	// type and the length
+	maxDatagramPayload = 1200 - 3
+
+	ipv4FlagDF = 0x4000
+)
+
+func validateDatagrams(pc *PeerConfig) error {
+	switch pc.DatagramOversize {
+	case "":
+		pc.DatagramOversize = DatagramOversizeFragment
+	case DatagramOversizeFragment, DatagramOversizeDrop:
+	default:
+		return fmt.Errorf("unknown datagram_oversize %q", pc.DatagramOversize)
+	}
+	if pc.Datagrams && pc.Compression != "" {
+		return errors.New("datagrams are not compressed, compression and datagrams are mutually exclusive")
+	}
+	return nil
+}
+
+// sendDatagram sends pkt to the peer as QUIC datagrams, fragmenting it or
+// dropping it if it does not fit into one. Failed datagrams are counted and
+// lost like any other, only an error of the connection is returned.
+func (p *Peer) sendDatagram(conn quic.Connection, pkt []byte) error {
+	parts := [][]byte{pkt}
+	if len(pkt) > maxDatagramPayload {
+		// fragment the packet behind a relay header, every fragment keeps it
+		hops, inner := splitRelayHeader(pkt)
+		if p.conf.DatagramOversize == DatagramOversizeDrop || !canFragment(inner) {
+			p.stats.DatagramOversizeDrops.Add(1)
+			return nil
+		}
+		var err error
+		if parts, err = fragmentIPv4(inner, maxDatagramPayload-(len(pkt)-len(inner))); err != nil {
+			p.stats.DatagramOversizeDrops.Add(1)
+			return nil
+		}
+		if len(inner) < len(pkt) {
+			for i, part := range parts {
+				parts[i] = relayHeader(part, hops)
+			}
+		}
+		p.stats.DatagramsFragmented.Add(1)
+	}
+	for _, part := range parts {
+		if err := conn.SendMessage(part); err != nil {
+			if conn.Context().Err() != nil {
+				return err
+			}
+			p.stats.DatagramSendErrors.Add(1)
+			slog.Warn("send datagram failed", "vIP", p.vIP, "len", len(part), "err", err)
+			continue
+		}
+		p.stats.DatagramsSent.Add(1)
+	}
+	return nil
+}
+
+// canFragment reports whether pkt is an IPv4 packet that may be fragmented.
+func canFragment(pkt []byte) bool {
+	return validIPv4Header(pkt) && binary.BigEndian.Uint16(pkt[6:8])&ipv4FlagDF == 0
+}
+
+var errFragmentSize = errors.New("fragment size leaves no room for data behind the ip header")
+
+// fragmentIPv4 splits pkt into fragments of at most size bytes. Packets that
+// are fragments already are split further, keeping their offset and MF.
+func fragmentIPv4(pkt []byte, size int) ([][]byte, error) {
+	hl := ipv4HeaderLen(pkt)
+	payload := pkt[hl:]
+	chunk := (size - hl) &^ 7
+	if chunk <= 0 {
+		return nil, errFragmentSize
+	}
+	base := fragOffset(pkt)
+	lastMF := binary.BigEndian.Uint16(pkt[6:8]) & ipv4FlagMF
+	var frags [][]byte
+	for off := 0; off < len(payload); off += chunk {
+		end := min(off+chunk, len(payload))
+		frag := make([]byte, hl+end-off)
+		copy(frag, pkt[:hl])
+		copy(frag[hl:], payload[off:end])
+		flags := uint16(ipv4FlagMF)
+		if end == len(payload) {
+			flags = lastMF
+		}
+		binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
+		binary.BigEndian.PutUint16(frag[6:8], flags|uint16((base+off)/8))
+		updateIPv4Checksum(frag)
+		frags = append(frags, frag)
+	}
+	return frags, nil
+}
+
+// serveDatagrams writes the packets a client sends as datagrams to dev, or
+// the tun devices of their destinations if nil, until conn closes.
+func serveDatagrams(ctx context.Context, conn quic.Connection, dev *TunDevice) {
+	rIP := conn.RemoteAddr().String()
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return
+		}
+		globalStats.DatagramsReceived.Add(1)
+		receivePacket(msg, rIP, dev)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+// datagramConn records the datagrams sent on it.
+type datagramConn struct {
+	quic.Connection
+	sent [][]byte
+}
+
+func (c *datagramConn) SendMessage(b []byte) error {
+	c.sent = append(c.sent, append([]byte(nil), b...))
+	return nil
+}
+
+func (c *datagramConn) Context() context.Context { return context.Background() }
+
+// TestSendDatagramFragmentsRelayed checks that an oversized packet behind a
+// relay header is fragmented with the header on every fragment.
+func TestSendDatagramFragmentsRelayed(t *testing.T) {
+	p := newPeer(net.ParseIP("10.0.9.4"), net.ParseIP("127.0.0.1"))
+	p.conf.DatagramOversize = DatagramOversizeFragment
+	pkt := loopbackPacket(3000)
+	var conn datagramConn
+	if err := p.sendDatagram(&conn, relayHeader(pkt, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.sent) < 2 {
+		t.Fatalf("sent %d datagrams, want fragments", len(conn.sent))
+	}
+	r := reassembler{datagrams: make(map[fragKey]*fragDatagram)}
+	var whole [][]byte
+	for _, d := range conn.sent {
+		if len(d) > maxDatagramPayload {
+			t.Fatalf("datagram of %d bytes exceeds %d", len(d), maxDatagramPayload)
+		}
+		hops, frag := splitRelayHeader(d)
+		if hops != 2 || !isIPv4Fragment(frag) {
+			t.Fatalf("datagram is no fragment behind a relay header of 2 hops")
+		}
+		whole = r.add(frag)
+	}
+	if len(whole) != 1 || string(whole[0]) != string(pkt) {
+		t.Fatal("fragments do not reassemble to the sent packet")
+	}
+}
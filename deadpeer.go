@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DeadPeerConfig detects dead peers faster and more predictably than the
+// QUIC idle timeout, read from "dead_peer". Every Interval the client sends
+// a keepalive, an empty frame the server echoes; a side that heard nothing
+// for Threshold intervals declares the other dead and closes the
+// connection, the client then reconnects.
+type DeadPeerConfig struct {
+	// Interval 0 disables the detection.
+	Interval  time.Duration `mapstructure:"interval"`
+	Threshold int           `mapstructure:"threshold"`
+}
+
+var deadPeerConfig = DeadPeerConfig{Threshold: 3}
+
+func (c DeadPeerConfig) enabled() bool { return c.Interval > 0 }
+
+// deadline is how long a peer may stay silent.
+func (c DeadPeerConfig) deadline() time.Duration {
+	return c.Interval * time.Duration(c.Threshold)
+}
+
+// keepaliveFrame is an empty frame, it carries no packet.
+var keepaliveFrame = appendFrame(nil, nil)
+
+// seen records that the peer was heard from.
+func (p *Peer) seen() {
+	p.lastSeen.Store(clock.Now().UnixNano())
+}
+
+// dead reports whether the peer stayed silent for longer than the deadline.
+func (p *Peer) dead() bool {
+	return clock.Now().Sub(time.Unix(0, p.lastSeen.Load())) > deadPeerConfig.deadline()
+}
+
+// readEchoes reads the keepalives the server echoes on stream until it fails.
+func (p *Peer) readEchoes(stream quic.Stream) {
+	buf := make([]byte, BUFSIZE)
+	for {
+		if _, err := readFrame(stream, buf); err != nil {
+			return
+		}
+		p.seen()
+	}
+}
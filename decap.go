@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	protoGRE = 47
+
+	greFlagChecksum = 0x8000
+	greFlagKey      = 0x2000
+	greFlagSeq      = 0x1000
+	greVersionMask  = 0x0007
+	etherTypeIPv4   = 0x0800
+)
+
+// DecapConfig is read from "decap". Packets from a tun device matching an
+// enabled encapsulation are routed by their inner IP header, the packet is
+// still forwarded whole.
+type DecapConfig struct {
+	GRE bool `mapstructure:"gre"`
+	// UDPPort takes UDP datagrams to this port as carrying an IP packet
+	// after UDPHeaderLen bytes of encapsulation header, 0 disables it.
+	UDPPort      uint16 `mapstructure:"udp_port"`
+	UDPHeaderLen int    `mapstructure:"udp_header_len"`
+}
+
+var decapConfig DecapConfig
+
+func (c DecapConfig) enabled() bool { return c.GRE || c.UDPPort != 0 }
+
+func (c DecapConfig) validate() error {
+	if c.UDPHeaderLen < 0 {
+		return fmt.Errorf("decap: udp_header_len must not be negative")
+	}
+	return nil
+}
+
+// routingHeader returns the part of packet routing looks at: the inner
+// packet if packet is encapsulated in an enabled way, else packet itself.
+// Encapsulated packets whose inner packet can not be found are counted and
+// routed by their outer header.
+func routingHeader(packet []byte) []byte {
+	if !decapConfig.enabled() || !validIPv4Header(packet) {
+		return packet
+	}
+	l4 := packet[ipv4HeaderLen(packet):]
+	var inner []byte
+	switch {
+	case packet[9] == protoGRE && decapConfig.GRE:
+		inner = greInner(l4)
+	case packet[9] == protoUDP && decapConfig.UDPPort != 0 &&
+		len(l4) >= 4 && binary.BigEndian.Uint16(l4[2:4]) == decapConfig.UDPPort:
+		if off := udpHeaderLen + decapConfig.UDPHeaderLen; len(l4) > off {
+			inner = l4[off:]
+		}
+	default:
+		return packet
+	}
+	if !validIPv4Header(inner) {
+		globalStats.DecapFailures.Add(1)
+		return packet
+	}
+	return inner
+}
+
+// greInner returns the IPv4 packet carried by the GRE header at the start
+// of b (RFC 2784 with the RFC 2890 key and sequence extensions), nil if
+// there is none.
+func greInner(b []byte) []byte {
+	if len(b) < 4 {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(b[0:2])
+	if flags&greVersionMask != 0 || binary.BigEndian.Uint16(b[2:4]) != etherTypeIPv4 {
+		return nil
+	}
+	off := 4
+	for _, f := range []uint16{greFlagChecksum, greFlagKey, greFlagSeq} {
+		if flags&f != 0 {
+			off += 4
+		}
+	}
+	if len(b) <= off {
+		return nil
+	}
+	return b[off:]
+}
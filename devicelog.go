@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// DeviceLogConfig logs which tun device the packets from the peers are
+// written to, e.g. to check the interface affinity, read from "device_log".
+type DeviceLogConfig struct {
+	// Sample is the fraction of the written packets logged, 0 logs none.
+	Sample float64 `mapstructure:"sample"`
+}
+
+var deviceLogConfig DeviceLogConfig
+
+func (c DeviceLogConfig) validate() error {
+	if c.Sample < 0 || c.Sample > 1 {
+		return fmt.Errorf("device_log: sample %v is not a fraction", c.Sample)
+	}
+	return nil
+}
+
+// deviceCounts counts packets by the name of the tun device they were
+// written to.
+type deviceCounts struct {
+	m sync.Map // name -> *atomic.Uint64
+}
+
+func (d *deviceCounts) add(name string) {
+	n, _ := d.m.LoadOrStore(name, new(atomic.Uint64))
+	n.(*atomic.Uint64).Add(1)
+}
+
+func (d *deviceCounts) snapshot() map[string]uint64 {
+	var counts map[string]uint64
+	d.m.Range(func(name, n any) bool {
+		if counts == nil {
+			counts = make(map[string]uint64)
+		}
+		counts[name.(string)] = n.(*atomic.Uint64).Load()
+		return true
+	})
+	return counts
+}
+
+// recordDeviceWrite counts a packet of flow written to dev against the
+// peer it came from and logs it if it is sampled.
+func recordDeviceWrite(dev *TunDevice, flow FlowKey) {
+	vIP := net.IP(flow.Src.AsSlice())
+	p, known := peerTable.Get(vIP)
+	if known {
+		p.stats.Devices.add(dev.name)
+	}
+	if deviceLogConfig.Sample == 0 || rand.Float64() >= deviceLogConfig.Sample {
+		return
+	}
+	attrs := []any{"device", dev.name, "flow", flow.String()}
+	if known {
+		attrs = append(attrs, "peer", p.vIP, "rIP", p.rIP)
+	}
+	slog.Info("packet written to device", attrs...)
+}
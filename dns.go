@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const dnsPort = 53
+
+// DNSConfig is the "dns" impairment profile of a peer: a chain applied to
+// DNS packets only, those from or to Port over UDP or TCP, e.g. to delay or
+// corrupt name resolution while the other traffic passes unimpaired.
+type DNSConfig struct {
+	// Port is the DNS port, default 53.
+	Port uint16 `mapstructure:"port"`
+	// Impairments takes the entries of the peer's impairments; a transform
+	// with direction ingress corrupts the responses.
+	Impairments []map[string]any `mapstructure:"impairments"`
+}
+
+func (c *DNSConfig) validate(vIP string) error {
+	if c.Port == 0 {
+		c.Port = dnsPort
+	}
+	if err := checkChainParams("peers."+vIP+".dns", c.Impairments); err != nil {
+		return err
+	}
+	if _, err := buildImpairmentChain(c.Impairments, 0); err != nil {
+		return fmt.Errorf("peers.%s.dns.%w", vIP, err)
+	}
+	return nil
+}
+
+func (c DNSConfig) matches(flow FlowKey) bool {
+	return (flow.Proto == protoUDP || flow.Proto == protoTCP) && (flow.SrcPort == c.Port || flow.DstPort == c.Port)
+}
+
+// dnsImpairment applies chain to the DNS packets and counts them.
+type dnsImpairment struct {
+	conf    DNSConfig
+	chain   ImpairmentChain
+	packets *atomic.Uint64
+}
+
+func newDNSImpairment(conf DNSConfig, seed int64, packets *atomic.Uint64) *dnsImpairment {
+	// validated by loadPeerConfigs
+	chain, _ := buildImpairmentChain(conf.Impairments, seed)
+	return &dnsImpairment{conf: conf, chain: chain, packets: packets}
+}
+
+func (d *dnsImpairment) Apply(pkt []byte, dir Direction) (bool, time.Duration, []byte) {
+	flow, ok := parseFlowKey(pkt)
+	if !ok || !d.conf.matches(flow) {
+		return true, 0, pkt
+	}
+	d.packets.Add(1)
+	return d.chain.Apply(pkt, dir)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DrainConfig is read from "drain".
+type DrainConfig struct {
+	// Timeout is how long a draining server waits for its connections to
+	// close before it shuts down anyway.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+var drainConfig = DrainConfig{Timeout: 30 * time.Second}
+
+var draining atomic.Bool
+
+// drained is closed once a drain finished.
+var drained = make(chan struct{})
+
+var drainOnce sync.Once
+
+// Drain stops taking new connections, while the existing ones are served
+// until they closed or the drain timeout passed. Health checks report the node
+// not ready from now on, and once drained the simulator shuts down.
+func Drain() {
+	drainOnce.Do(func() {
+		draining.Store(true)
+		slog.Info("draining", "active", activeConnections(), "timeout", drainConfig.Timeout)
+		go waitDrained()
+	})
+}
+
+func waitDrained() {
+	defer close(drained)
+	deadline := clock.Now().Add(drainConfig.Timeout)
+	lastLog := clock.Now()
+	for {
+		active := activeConnections()
+		if active == 0 {
+			slog.Info("drained")
+			return
+		}
+		if !clock.Now().Before(deadline) {
+			slog.Warn("drain timed out", "active", active)
+			return
+		}
+		if clock.Now().Sub(lastLog) >= 5*time.Second {
+			slog.Info("draining", "active", active)
+			lastLog = clock.Now()
+		}
+		<-clock.After(100 * time.Millisecond)
+	}
+}
+
+// activeConnections sums the open connections of all listeners.
+func activeConnections() int64 {
+	var n int64
+	listenerStats.Range(func(_, value any) bool {
+		n += value.(*ListenerStats).Active.Load()
+		return true
+	})
+	return n
+}
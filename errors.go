@@ -0,0 +1,21 @@
+package main
+
+import "errors"
+
+// Errors returned by the simulator, usually wrapped with more detail; test
+// for them with errors.Is.
+var (
+	// ErrRouteNotFound means no peer is routed for a virtual IP.
+	ErrRouteNotFound = errors.New("route not found")
+	// ErrPeerUnreachable means a connection to a peer could not be set up.
+	ErrPeerUnreachable = errors.New("peer unreachable")
+	// ErrConfigInvalid means the config could not be parsed or applied.
+	ErrConfigInvalid = errors.New("invalid config")
+	// ErrStreamOpen means a connection to a peer is up but no stream could
+	// be opened on it.
+	ErrStreamOpen = errors.New("stream open failed")
+	// ErrDeviceSetup means a tun device could not be created or configured.
+	ErrDeviceSetup = errors.New("tun device setup failed")
+	// ErrDeviceNotFound means no in-memory device has the given name.
+	ErrDeviceNotFound = errors.New("device not found")
+)
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// RouteDecision is what would happen to a packet read from a tun device,
+// see ExplainRoute.
+type RouteDecision struct {
+	Flow string `json:"flow"`
+	// RouteFunc is set if the RouteFunc picked the peer or dropped the packet.
+	RouteFunc bool `json:"route_func,omitempty"`
+	// Rule is the priority of the policy rule that matched, nil if the
+	// packet follows the destination's route.
+	Rule *int   `json:"rule,omitempty"`
+	Peer string `json:"peer,omitempty"`
+	// Remote is the real IP of the peer, Connected whether a connection to
+	// it is up.
+	Remote    string `json:"remote,omitempty"`
+	Connected bool   `json:"connected"`
+	// Impairments are the egress impairments that would apply. Their
+	// decisions are random, so the packet may be dropped or delayed by them
+	// even if Drop is empty.
+	Impairments []string `json:"impairments,omitempty"`
+	Bandwidth   int64    `json:"bandwidth,omitempty"`
+	// Held is set while forwarding is paused, the packet would wait.
+	Held bool `json:"held,omitempty"`
+	// Drop is why the packet would be dropped, empty if it is forwarded.
+	Drop string `json:"drop,omitempty"`
+}
+
+// ExplainRoute reports what the simulator would do with a packet of flow
+// read from a tun device in its current state, without sending anything or
+// changing any state such as the round robin of multipath rules.
+func ExplainRoute(flow FlowKey) (RouteDecision, error) {
+	if !flow.Src.IsValid() || !flow.Dst.IsValid() || flow.Src.Is4() != flow.Dst.Is4() {
+		return RouteDecision{}, fmt.Errorf("flow needs a source and destination of the same family")
+	}
+	d := RouteDecision{Flow: flow.String()}
+	var vIP net.IP
+	if f := routeFunc.Load(); f != nil {
+		var forward bool
+		vIP, forward = (*f)(flow, flowPacket(flow))
+		if !forward {
+			d.RouteFunc, d.Drop = true, "route func"
+			return d, nil
+		}
+		d.RouteFunc = vIP != nil
+	}
+	if vIP == nil {
+		vIP = net.IP(flow.Dst.AsSlice())
+		if r := matchRule(flow); r != nil {
+			d.Rule = &r.Priority
+			vIP = r.peek(flow)
+		}
+	}
+	d.Peer = vIP.String()
+	p, err := lookupPeer(vIP)
+	if err != nil {
+		d.Drop = "no route"
+		return d, nil
+	}
+	d.Remote, d.Connected = p.rIP.String(), p.connected.Load()
+	if p.impaired() {
+		d.Impairments = p.explainImpairments(flow)
+	}
+	d.Bandwidth = p.conf.Bandwidth
+	d.Held = Paused()
+	switch {
+	case p.breaker.Open():
+		d.Drop = "breaker open"
+	case p.link.isDown():
+		d.Drop = "link down"
+	}
+	return d, nil
+}
+
+// explainImpairments describes the egress impairments of p applying to flow.
+func (p *Peer) explainImpairments(flow FlowKey) []string {
+	var names []string
+	if im := p.conf.Impairment; im.Loss > 0 {
+		names = append(names, fmt.Sprintf("loss %g", im.Loss))
+	}
+	if im := p.conf.Impairment; im.Latency > 0 || im.Jitter > 0 {
+		names = append(names, fmt.Sprintf("latency %s jitter %s", im.Latency, im.Jitter))
+	}
+	if dns := p.conf.DNS; dns.matches(flow) {
+		for _, spec := range dns.Impairments {
+			dir, _ := spec["direction"].(string)
+			if d, err := parseDirection(dir); err == nil && d&DirEgress != 0 {
+				name, _ := spec["name"].(string)
+				names = append(names, "dns "+name)
+			}
+		}
+	}
+	// the chain ends with one impairment per entry of Impairments
+	offset := len(p.impairments) - len(p.conf.Impairments)
+	for i, spec := range p.conf.Impairments {
+		dir, _ := spec["direction"].(string)
+		if d, err := parseDirection(dir); err != nil || d&DirEgress == 0 {
+			continue
+		}
+		if m, ok := p.impairments[offset+i].(*matchImpairment); ok && !m.match.match(flow) {
+			continue
+		}
+		name, _ := spec["name"].(string)
+		names = append(names, name)
+	}
+	return names
+}
+
+// flowPacket builds a minimal packet of flow for the RouteFunc.
+func flowPacket(flow FlowKey) []byte {
+	var pkt []byte
+	if flow.Src.Is4() {
+		pkt = make([]byte, ipv4MinHeaderLen+8)
+		pkt[0] = 4<<4 | ipv4MinHeaderLen/4
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[8] = 64
+		pkt[9] = flow.Proto
+		s, d := flow.Src.As4(), flow.Dst.As4()
+		copy(pkt[12:16], s[:])
+		copy(pkt[16:20], d[:])
+		updateIPv4Checksum(pkt)
+	} else {
+		pkt = make([]byte, ipv6HeaderLen+8)
+		pkt[0] = 6 << 4
+		binary.BigEndian.PutUint16(pkt[4:], 8)
+		pkt[6] = flow.Proto
+		pkt[7] = 64
+		s, d := flow.Src.As16(), flow.Dst.As16()
+		copy(pkt[8:24], s[:])
+		copy(pkt[24:40], d[:])
+	}
+	l4 := pkt[len(pkt)-8:]
+	if flow.isICMP() {
+		l4[0], l4[1] = flow.ICMPType, flow.ICMPCode
+	} else {
+		binary.BigEndian.PutUint16(l4[0:], flow.SrcPort)
+		binary.BigEndian.PutUint16(l4[2:], flow.DstPort)
+	}
+	return pkt
+}
+
+// flowFromQuery reads the flow of GET /route/explain?src=&dst=&proto=
+// &src_port=&dst_port=&icmp_type=&icmp_code=, proto defaulting to udp.
+func flowFromQuery(q url.Values) (FlowKey, error) {
+	var flow FlowKey
+	var err error
+	if flow.Src, err = netip.ParseAddr(q.Get("src")); err != nil {
+		return flow, fmt.Errorf("src: %w", err)
+	}
+	if flow.Dst, err = netip.ParseAddr(q.Get("dst")); err != nil {
+		return flow, fmt.Errorf("dst: %w", err)
+	}
+	proto := strings.ToLower(q.Get("proto"))
+	if proto == "" {
+		proto = "udp"
+	}
+	var ok bool
+	if flow.Proto, ok = protoNames[proto]; !ok {
+		return flow, fmt.Errorf("unknown proto %q", proto)
+	}
+	for key, v := range map[string]*uint16{"src_port": &flow.SrcPort, "dst_port": &flow.DstPort} {
+		if s := q.Get(key); s != "" {
+			n, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				return flow, fmt.Errorf("%s: %w", key, err)
+			}
+			*v = uint16(n)
+		}
+	}
+	for key, v := range map[string]*uint8{"icmp_type": &flow.ICMPType, "icmp_code": &flow.ICMPCode} {
+		if s := q.Get(key); s != "" {
+			n, err := strconv.ParseUint(s, 10, 8)
+			if err != nil {
+				return flow, fmt.Errorf("%s: %w", key, err)
+			}
+			*v = uint8(n)
+		}
+	}
+	return flow, nil
+}
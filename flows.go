@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// tcpFlags returns the flags of a TCP segment in an IPv4 packet. Fragments
+// are no segments, not even the first one.
+func tcpFlags(packet []byte) (uint8, bool) {
+	if !validIPv4Header(packet) || packet[9] != protoTCP || isIPv4Fragment(packet) {
+		return 0, false
+	}
+	l4 := packet[ipv4HeaderLen(packet):]
+	if len(l4) < 14 {
+		return 0, false
+	}
+	return l4[13], true
+}
+
+// FlowConfig bounds the flow table, read from "flows".
+type FlowConfig struct {
+	// IdleTTL evicts flows that saw no packet for this long.
+	IdleTTL       time.Duration `mapstructure:"idle_ttl"`
+	SweepInterval time.Duration `mapstructure:"sweep_interval"`
+}
+
+var flowConfig = FlowConfig{IdleTTL: 2 * time.Minute, SweepInterval: 5 * time.Second}
+
+type flowEntry struct {
+	packets, bytes uint64
+	lastSeen       time.Time
+	// closed is set once a FIN or RST was seen, the next sweep removes it.
+	closed bool
+}
+
+// FlowTable keeps per-flow stats of the packets read from the tun devices.
+type FlowTable struct {
+	mu    sync.Mutex
+	flows map[FlowKey]*flowEntry
+
+	Evictions atomic.Uint64
+}
+
+var flowTable = &FlowTable{flows: make(map[FlowKey]*flowEntry)}
+
+// Record counts packet against its flow.
+func (t *FlowTable) Record(flow FlowKey, packet []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.flows[flow]
+	if !ok {
+		e = &flowEntry{}
+		t.flows[flow] = e
+	}
+	e.packets++
+	e.bytes += uint64(len(packet))
+	e.lastSeen = clock.Now()
+	if flags, ok := tcpFlags(packet); ok && flags&(tcpFlagFIN|tcpFlagRST) != 0 {
+		e.closed = true
+	}
+}
+
+// Len returns the number of tracked flows.
+func (t *FlowTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.flows)
+}
+
+// sweep removes closed flows and those idle for longer than ttl.
+func (t *FlowTable) sweep(ttl time.Duration) {
+	now := clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, e := range t.flows {
+		if e.closed || now.Sub(e.lastSeen) > ttl {
+			delete(t.flows, k)
+			t.Evictions.Add(1)
+		}
+	}
+}
+
+// runSweeper sweeps the table every interval until ctx is done.
+func (t *FlowTable) runSweeper(ctx context.Context, conf FlowConfig) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(conf.SweepInterval):
+			t.sweep(conf.IdleTTL)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ipv4FlagMF         = 0x2000
+	ipv4FragOffsetMask = 0x1fff
+)
+
+// FragmentConfig is read from "fragments". IPv4 fragments read from a tun
+// device are routed without ports so all fragments of a datagram take the
+// same path. With Reassemble they are joined first and the datagram is
+// forwarded whole, unless it would not fit into BUFSIZE.
+type FragmentConfig struct {
+	Reassemble bool `mapstructure:"reassemble"`
+	// Timeout drops the fragments of a datagram not completed in time.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// MaxDatagrams bounds the datagrams being reassembled at once.
+	MaxDatagrams int `mapstructure:"max_datagrams"`
+}
+
+var fragmentConfig = FragmentConfig{Timeout: 30 * time.Second, MaxDatagrams: 256}
+
+func (c FragmentConfig) validate() error {
+	if c.Timeout <= 0 || c.MaxDatagrams < 1 {
+		return fmt.Errorf("fragments: timeout must be positive and max_datagrams at least 1")
+	}
+	return nil
+}
+
+// isIPv4Fragment reports whether packet is a fragment of a larger datagram.
+func isIPv4Fragment(packet []byte) bool {
+	return validIPv4Header(packet) && binary.BigEndian.Uint16(packet[6:8])&(ipv4FlagMF|ipv4FragOffsetMask) != 0
+}
+
+// fragOffset is the offset of a fragment's data in bytes.
+func fragOffset(packet []byte) int {
+	return int(binary.BigEndian.Uint16(packet[6:8])&ipv4FragOffsetMask) * 8
+}
+
+type fragKey struct {
+	src, dst [4]byte
+	id       uint16
+	proto    uint8
+}
+
+type fragPiece struct {
+	off  int
+	data []byte
+}
+
+// fragDatagram collects the fragments of one datagram.
+type fragDatagram struct {
+	first  time.Time
+	header []byte // of the fragment at offset 0
+	total  int    // data length, -1 until the last fragment arrived
+	pieces []fragPiece
+	raw    [][]byte // the fragments as read
+}
+
+// reassembler joins IPv4 fragments into datagrams.
+type reassembler struct {
+	mu        sync.Mutex
+	datagrams map[fragKey]*fragDatagram
+}
+
+var fragments = reassembler{datagrams: make(map[fragKey]*fragDatagram)}
+
+// add takes a fragment and returns the packets to forward now: none while
+// the datagram is incomplete, then the reassembled datagram, or all of its
+// fragments as read if it would not fit into BUFSIZE.
+func (r *reassembler) add(packet []byte) [][]byte {
+	pkt := append([]byte(nil), packet...)
+	key := fragKey{src: [4]byte(pkt[12:16]), dst: [4]byte(pkt[16:20]), id: binary.BigEndian.Uint16(pkt[4:6]), proto: pkt[9]}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire()
+	d, ok := r.datagrams[key]
+	if !ok {
+		if len(r.datagrams) >= fragmentConfig.MaxDatagrams {
+			globalStats.FragmentDrops.Add(1)
+			return nil
+		}
+		d = &fragDatagram{first: clock.Now(), total: -1}
+		r.datagrams[key] = d
+	}
+	hl := ipv4HeaderLen(pkt)
+	off := fragOffset(pkt)
+	end := off + len(pkt) - hl
+	last := binary.BigEndian.Uint16(pkt[6:8])&ipv4FlagMF == 0
+	if !d.fits(end, last) {
+		// overlapping fragments that disagree on the length of the datagram
+		delete(r.datagrams, key)
+		d.release()
+		globalStats.FragmentDrops.Add(1)
+		slog.Info("drop inconsistent fragmented datagram", "id", key.id, "fragments", len(d.raw)+1)
+		return nil
+	}
+	if !chargeMemory(pkt) {
+		if !ok {
+			delete(r.datagrams, key)
+		}
+		return nil
+	}
+	d.raw = append(d.raw, pkt)
+	d.pieces = append(d.pieces, fragPiece{off: off, data: pkt[hl:]})
+	if off == 0 {
+		d.header = pkt[:hl]
+	}
+	if last {
+		d.total = end
+	}
+	if !d.complete() {
+		return nil
+	}
+	delete(r.datagrams, key)
+	d.release()
+	if len(d.header)+d.total > BUFSIZE {
+		globalStats.FragmentsPassed.Add(1)
+		return d.raw
+	}
+	globalStats.Reassembled.Add(1)
+	return [][]byte{d.assemble()}
+}
+
+// fits reports whether a fragment whose data ends at end agrees with the
+// length of the datagram: it must not end past the last fragment, and a
+// last fragment must not end before the data already held or disagree with
+// an earlier last fragment.
+func (d *fragDatagram) fits(end int, last bool) bool {
+	if !last {
+		return d.total < 0 || end <= d.total
+	}
+	if d.total >= 0 {
+		return end == d.total
+	}
+	for _, p := range d.pieces {
+		if p.off+len(p.data) > end {
+			return false
+		}
+	}
+	return true
+}
+
+// complete reports whether the pieces cover the whole datagram.
+func (d *fragDatagram) complete() bool {
+	if d.total < 0 || d.header == nil {
+		return false
+	}
+	sort.Slice(d.pieces, func(i, j int) bool { return d.pieces[i].off < d.pieces[j].off })
+	covered := 0
+	for _, p := range d.pieces {
+		if p.off > covered {
+			return false
+		}
+		covered = max(covered, p.off+len(p.data))
+	}
+	return covered >= d.total
+}
+
+// release returns the fragments held to the memory budget.
+func (d *fragDatagram) release() {
+	for _, pkt := range d.raw {
+		releaseMemory(pkt)
+	}
+}
+
+func (d *fragDatagram) assemble() []byte {
+	hl := len(d.header)
+	pkt := make([]byte, hl+d.total)
+	copy(pkt, d.header)
+	for _, p := range d.pieces {
+		copy(pkt[hl+p.off:], p.data)
+	}
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	// keep DF, clear MF and the offset
+	binary.BigEndian.PutUint16(pkt[6:8], binary.BigEndian.Uint16(pkt[6:8])&^(ipv4FlagMF|ipv4FragOffsetMask))
+	updateIPv4Checksum(pkt)
+	return pkt
+}
+
+// expire drops the datagrams not completed within the timeout, r.mu must
+// be held.
+func (r *reassembler) expire() {
+	now := clock.Now()
+	for key, d := range r.datagrams {
+		if now.Sub(d.first) > fragmentConfig.Timeout {
+			delete(r.datagrams, key)
+			d.release()
+			globalStats.FragmentDrops.Add(1)
+			slog.Info("drop incomplete fragmented datagram", "id", key.id, "fragments", len(d.raw))
+		}
+	}
+}
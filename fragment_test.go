@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// ipv4Fragment returns a fragment at off carrying n bytes of data.
+func ipv4Fragment(off, n int, mf bool) []byte {
+	pkt := udpPacket(netip.MustParseAddr("10.0.1.1"), netip.MustParseAddr("10.0.1.2"), 40000, 9, nil, make([]byte, n-8))
+	field := uint16(off / 8)
+	if mf {
+		field |= ipv4FlagMF
+	}
+	binary.BigEndian.PutUint16(pkt[6:8], field)
+	updateIPv4Checksum(pkt)
+	return pkt
+}
+
+// TestReassembleInconsistent feeds fragments that overlap past the end of
+// the datagram or disagree on its length, which must drop the datagram.
+func TestReassembleInconsistent(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		frags [][]byte
+	}{
+		{"past last", [][]byte{ipv4Fragment(0, 1000, true), ipv4Fragment(504, 8, true), ipv4Fragment(16, 8, false)}},
+		{"after last", [][]byte{ipv4Fragment(16, 8, false), ipv4Fragment(504, 8, true)}},
+		{"two lasts", [][]byte{ipv4Fragment(16, 8, false), ipv4Fragment(32, 8, false)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := reassembler{datagrams: make(map[fragKey]*fragDatagram)}
+			drops := globalStats.FragmentDrops.Load()
+			for _, frag := range tt.frags {
+				if out := r.add(frag); out != nil {
+					t.Fatalf("forwarded %d packets of an inconsistent datagram", len(out))
+				}
+			}
+			if len(r.datagrams) != 0 || globalStats.FragmentDrops.Load() != drops+1 {
+				t.Fatal("inconsistent datagram not dropped")
+			}
+		})
+	}
+}
+
+// TestFragmentSizeTooSmall checks that sizes leaving less than 8 bytes of
+// data behind the header are refused instead of looping.
+func TestFragmentSizeTooSmall(t *testing.T) {
+	pkt := loopbackPacket(100)
+	for _, size := range []int{0, ipv4MinHeaderLen, ipv4MinHeaderLen + 7} {
+		if _, err := fragmentIPv4(pkt, size); !errors.Is(err, errFragmentSize) {
+			t.Fatalf("fragmentIPv4(%d) = %v, want %v", size, err, errFragmentSize)
+		}
+	}
+	frags, err := fragmentIPv4(pkt, ipv4MinHeaderLen+8)
+	if err != nil || len(frags) < 2 {
+		t.Fatalf("fragmentIPv4(%d) = %d fragments, %v", ipv4MinHeaderLen+8, len(frags), err)
+	}
+}
+
+// TestReassembledDelivered sends the fragments of a datagram larger than
+// the MTU and checks it arrives with fragments.reassemble on, refragmented
+// to the MTU of the receiving device.
+func TestReassembledDelivered(t *testing.T) {
+	got := startLoopback(t, "fragments:\n  reassemble: true\n")
+	pkt := loopbackPacket(3000)
+	frags, err := fragmentIPv4(pkt, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frag := range frags {
+		if err := InjectPacket("lo-src", frag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := reassembler{datagrams: make(map[fragKey]*fragDatagram)}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frag := <-got:
+			if len(frag) > 1500 {
+				t.Fatalf("wrote %d bytes to a device with mtu 1500", len(frag))
+			}
+			if !isIPv4Fragment(frag) {
+				t.Fatalf("delivered %d bytes unfragmented", len(frag))
+			}
+			whole := r.add(frag)
+			if whole == nil {
+				continue
+			}
+			if len(whole) != 1 || !bytes.Equal(whole[0], pkt) {
+				t.Fatal("delivered datagram differs from the sent one")
+			}
+			return
+		case <-timeout:
+			t.Fatal("datagram not delivered")
+		}
+	}
+}
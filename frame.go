@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Packets travel over a stream as frames: a 2-byte big-endian length
+// followed by the packet itself, so several packets can share one write.
+// The top bit of the length marks a packet compressed with DEFLATE.
+// Relayed packets carry their relay header inside the frame, see relayMagic.
+const (
+	frameHeaderLen  = 2
+	frameCompressed = 0x8000
+)
+
+// appendFrame appends packet to dst as a single frame.
+func appendFrame(dst, packet []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(packet)))
+	return append(dst, packet...)
+}
+
+// readFrame reads the next frame from r into buf and returns the packet length.
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n&frameCompressed != 0 {
+		return readCompressed(r, n&^frameCompressed, buf)
+	}
+	if n > len(buf) {
+		return 0, fmt.Errorf("frame of %d bytes exceeds buffer of %d bytes", n, len(buf))
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:generate go run . gen-config -o config_example.yaml
+
+// configSection is a top-level key of the config as gen-config writes it.
+// Value is its default, Sample an example written commented out after it,
+// as the whole key if Value is nil. Fields of the structs within either
+// may carry a comment tag, written above them.
+type configSection struct {
+	Key     string
+	Comment string
+	Value   any
+	Sample  any
+}
+
+// configSections returns the sections of the config in the order they are
+// written, with the defaults as they are before any config was applied.
+func configSections() []configSection {
+	samplePeer := defaultPeerConfig
+	samplePeer.Mode = ModeThroughput
+	samplePeer.Bandwidth = 10000000
+	samplePeer.ReceiveBandwidth = 100000000
+	samplePeer.Queue = QueueFair
+	samplePeer.QueueLimit = defaultQueueLimit
+	samplePeer.Impairment = ImpairmentConfig{Loss: 0.01, Latency: 20 * time.Millisecond, Jitter: 5 * time.Millisecond}
+	samplePeer.Impairments = []map[string]any{
+		{"name": "corrupt", "probability": 0.001, "direction": "both"},
+		{"name": "latency", "latency": "50ms", "match": map[string]any{"proto": "icmp", "icmp_type": 8}},
+	}
+	samplePeer.DNS.Impairments = []map[string]any{{"name": "latency", "latency": "200ms"}}
+	samplePeer.DelayLimit = DelayLimitConfig{Depth: 10000, Overflow: DelayOverflowRelease, MaxHold: 5 * time.Second}
+	return []configSection{
+		{
+			Key:     "map1",
+			Comment: `routes, virtual ip -> real ip of the simulator it is forwarded to`,
+			Value:   map[string]string{},
+			Sample:  map[string]string{"10.0.0.1": "192.168.1.191", "10.0.0.2": "192.168.1.191"},
+		},
+		{
+			Key: "listeners",
+			Comment: `endpoints the server accepts peers on: quic, tcp (tls over tcp) or wss
+(websocket over tls, one length-prefixed frame per binary message)
+port 0 lets the os pick one, the stats report it as bound. device writes the
+packets of the connections a listener accepted to that tun device instead of
+the device of their destination, isolating the links of several devices;
+every listener needs a port of its own`,
+			Value: listenerConfigs,
+			Sample: []ListenerConfig{
+				{Transport: TransportTCP, Addr: lAddr},
+				{Transport: TransportWebSocket, Addr: "0.0.0.0:2346", Device: "mptest-2"},
+			},
+		},
+		{
+			Key: "role",
+			Comment: `server only accepts peers on the listeners, client only dials the peers in
+map1, both does both`,
+			Value: role,
+		},
+		{
+			Key: "server_cert",
+			Comment: `certificate of the listeners, loaded from cert and key or, without them,
+self-signed at startup with key_type rsa2048, rsa4096, p256 or p384. The
+self-signed one is valid for localhost, names, the server_name of the peers
+and tls_profiles and the listener ips; export writes it to a pem file for
+verifying clients to use as their ca`,
+			Value: serverCertConfig,
+		},
+		{
+			Key:     "proxy_protocol",
+			Comment: `expect a PROXY protocol v2 header at the start of every incoming stream`,
+			Value:   proxyProtocol,
+		},
+		{
+			Key: "zero_rtt",
+			Comment: `accept 0-RTT data from clients resuming a session, packets are still only
+forwarded once the handshake completed`,
+			Value: zeroRTT,
+		},
+		{
+			Key: "ttl_decrement",
+			Comment: `act as a router hop: decrement the ttl of packets from peers and answer
+expired ones with icmp time exceeded`,
+			Value: ttlDecrement,
+		},
+		{
+			Key: "mss_clamp",
+			Comment: `lower the mss option of ipv4 tcp syns forwarded either way to this, so tcp
+over the tunnel fits its mtu, counted as mss_clamped. 0 disables it`,
+			Value: mssClamp,
+		},
+		{
+			Key: "tls_profiles",
+			Comment: `client tls settings peers refer to with tls_profile, keyed by name: cert/key
+presented for mtls, the peer certificate is verified for server_name against
+the roots in ca (system roots if empty) unless insecure, alpn defaults to
+the simulator's own protocol`,
+			Value:  map[string]TLSProfile{},
+			Sample: map[string]TLSProfile{"lab": {Cert: "client.pem", Key: "client-key.pem", CA: "lab-ca.pem", ServerName: "sim.lab", ALPN: []string{"quic-echo-example"}}},
+		},
+		{
+			Key: "peers",
+			Comment: `per-peer settings, keyed by virtual ip
+mode: low-latency (write every packet at once) or throughput (coalesce queued packets)
+client_cert/client_key: certificate presented to the peer when it requires mtls
+bandwidth: send rate limit in bits per second, 0 is unlimited
+receive_bandwidth: limit in bits per second on writing packets from the peer to the tun
+  devices, independent of bandwidth to model asymmetric links; queue and queue_limit apply too
+queue: fifo or fair (deficit round robin over 5-tuple flows) in front of the bandwidth limit
+queue_limit: packets waiting for the bandwidth limit before dropping, default 1000
+queue_full: when the writer queue of an unlimited peer is full block (default) waits for it,
+  drop_newest drops the packet and drop_oldest the packet at the head of the queue
+writer_queue: packets queued in front of the writer, default 10 or 64 in throughput mode;
+  1 keeps at most one packet waiting, for the lowest latency
+bottleneck/weight: share the named link in bottlenecks with other peers, weight (default 1)
+  is the peer's share relative to the others while the link is congested
+codel: target and interval (default 100ms) of codel aqm dropping packets that waited longer
+  than target for the bandwidth limit instead of only dropping at queue_limit
+ecn_threshold: mark ecn capable packets congestion experienced once this many wait for the
+  bandwidth limit, 0 disables it
+local_addr: local ip:port to dial the peer from, move it at runtime with POST /peers/migrate on the admin api
+impairment: loss probability, latency and jitter applied to packets sent to the peer, wire_corrupt
+  corrupts udp datagrams below quic which then drops and retransmits them
+impairments: chain of named impairments applied after impairment, each with its params and a
+  direction (egress, ingress or both, default egress): loss (probability), latency (latency,
+  jitter), bandwidth (rate in bits per second, queue as the longest wait), corrupt (probability)
+  ecn (probability of marking ecn capable packets congestion experienced) and setup (latency,
+  jitter and loss of tcp syn and, unless synack is false, syn-ack segments only). The payload
+  transforms truncate (keep bytes), pad (bytes of value), byteflip (xor the byte at offset,
+  random if negative, with mask at probability) and size (drop packets with an ip length outside
+  min and max, 0 is open, with pad shorter ones are padded up to min with value instead, which
+  also lands in tcp payloads; min = max with pad makes all packets one size) recompute the ip and
+  udp lengths and checksums unless checksums is false, the size drops and paddings are counted as
+  size_drops and size_padded. Custom ones are added with RegisterTransform. Every entry takes a match limiting it to the
+  packets matching src/dst/proto/ports/icmp_type/icmp_code like the policy rules
+dns: impairments chain like the above applied to dns packets only (udp or tcp from or to port,
+  default 53) before impairments, e.g. to delay name resolution only or corrupt the responses
+  with a transform in direction ingress; the matched packets are counted as dns_packets
+delay_limit: bounds the packets the impairments delay per direction: beyond depth (0 is
+  unbounded) overflow release (default) sends the packet due first right away, drop drops the
+  new one, counted as delay_released and delay_drops; max_hold caps the delay of a packet.
+  delay_len and ingress_delay_len report the packets held
+backoff: initial, max and multiplier overriding the global reconnection backoff
+ttl_decrement: overrides the global ttl_decrement for packets from the peer
+server_name: sni sent to the peer, independent of the dial address
+verify/ca: verify the peer certificate for server_name against the roots in ca (system roots if empty)
+zero_rtt: resume the tls session and send 0-RTT data when re-dialing the peer
+idle_timeout: close the connection once no packet went to or came from the peer for this long,
+  it is redialed with the next packet to the peer; reported as idle_closes and idle. Mutually
+  exclusive with dead_peer, whose keepalives would redial it right away
+compression: deflate compresses the packets sent to the peer, those not shrinking are sent as
+  they are; the compressed share is reported as compression_ratio
+datagrams: forward the packets to the peer as unreliable quic datagrams instead of over the
+  stream, uncompressed and without head-of-line blocking; falls back to the stream if the peer
+  does not support them
+datagram_oversize: fragment (default) splits ipv4 packets larger than a datagram (1197 bytes)
+  into ip fragments, drop drops them; packets with df set and ipv6 are always dropped
+tls_profile: name of a tls_profiles entry replacing client_cert/client_key, server_name, verify and ca
+bypass_impairments: start with the impairments switched off, POST /peers/impairments switches
+  them on and off at runtime
+relay: forward the packets other peers send for this peer's virtual ip on to it, see relay`,
+			Value:  map[string]PeerConfig{},
+			Sample: map[string]PeerConfig{"10.0.0.2": samplePeer},
+		},
+		{
+			Key: "bottlenecks",
+			Comment: `links shared by several peers, capacity in bits per second. A peer joins one with
+its bottleneck setting, on top of its own bandwidth limit`,
+			Value:  map[string]BottleneckConfig{},
+			Sample: map[string]BottleneckConfig{"uplink": {Bandwidth: 20000000}},
+		},
+		{
+			Key: "allowlist",
+			Comment: `real addresses or cidr prefixes the server accepts connections from, others
+are closed at accept time and counted as rejected per listener. empty
+accepts every client`,
+			Value:  []string{},
+			Sample: []string{"192.168.1.0/24", "203.0.113.7"},
+		},
+		{
+			Key:     "mtls",
+			Comment: `mutual tls: require clients to present a certificate signed by ca`,
+			Value:   MTLSConfig{Peers: map[string]string{}},
+		},
+		{
+			Key:     "mark_dscp",
+			Comment: `stamp this dscp value (0-63) on every forwarded packet, leave unset to keep packets untouched`,
+			Sample:  8,
+		},
+		{
+			Key: "backoff",
+			Comment: `wait between failed connection attempts: initial, growing by multiplier up to max.
+min_interval spaces all attempts to a peer, also after connections that succeeded and
+dropped right away, max_per_minute opens the peer's circuit breaker once that many
+attempts were made within a minute; 0 disables either`,
+			Value: backoffConfig,
+		},
+		{
+			Key:     "breaker",
+			Comment: `stop reconnecting to a peer for cooldown after threshold consecutive failures`,
+			Value:   breakerConfig,
+		},
+		{
+			Key: "fragments",
+			Comment: `ipv4 fragments read from a tun device are routed without ports so every
+fragment of a datagram takes the same path. reassemble joins them first and
+forwards the whole datagram (as fragments if larger than the 4096 byte
+buffer), incomplete datagrams are dropped after timeout`,
+			Value: fragmentConfig,
+		},
+		{
+			Key: "tun_read",
+			Comment: `forward packets read from a tun device on a pool of workers, packets of one
+flow are always handled by the same worker and stay in order`,
+			Value: tunReadConfig,
+		},
+		{
+			Key: "vlan",
+			Comment: `802.1Q tagged packets on a tun interface, keyed by interface name: strip
+removes the tag before routing, preserve also tags the packets written to
+the interface again with id, or the tag last read when id is 0. packets of
+interfaces not listed are forwarded as read`,
+			Value:  map[string]VLANConfig{},
+			Sample: map[string]VLANConfig{"mptest-1": {Mode: VLANPreserve, ID: 100}},
+		},
+		{
+			Key: "rpf",
+			Comment: `reverse path filtering of the packets read from a tun interface, keyed by
+interface name: strict drops ipv4 packets whose source is outside the
+interface's subnet, loose those outside the subnet of every tun interface.
+allow lists further accepted sources. drops are counted as rpf_drops, per
+device in /devices. interfaces not listed accept any source`,
+			Value:  map[string]RPFConfig{},
+			Sample: map[string]RPFConfig{"mptest-1": {Mode: RPFStrict, Allow: []string{"192.168.10.0/24"}}},
+		},
+		{
+			Key: "decap",
+			Comment: `route encapsulated packets from the tun devices by their inner ip header:
+gre, and udp datagrams to udp_port with udp_header_len bytes of header
+before the inner packet. the whole packet is forwarded`,
+			Value: decapConfig,
+		},
+		{
+			Key: "tun_write",
+			Comment: `batch packets written to the tun devices, a partial batch is flushed flush_interval after its first packet.
+queue bounds the packets waiting for a device that stops taking them instead of holding up the
+streams from the peers, 0 writes from the stream readers unless batching. full is what happens at a
+full queue: block waits up to timeout (0 forever) before dropping, drop_newest and drop_oldest drop
+at once. drops and timeouts are counted per device in /devices`,
+			Value: tunWriteConfig,
+		},
+		{
+			Key: "impairment_seed",
+			Comment: `base seed of the impairment random generators. Each peer draws from its own
+generator seeded with impairment_seed + FNV-1a(virtual ip), so a run is
+reproducible and adding or removing a peer does not change the sequence of
+the others. A time based seed is used and logged when unset.`,
+			Sample: 1,
+		},
+		{
+			Key: "impairment_ranges",
+			Comment: `impairment parameters out of range (probabilities outside [0, 1], negative
+durations) fail the config with error or are clamped into range with a
+warning with clamp. bandwidth rates that are not positive always fail`,
+			Value: impairmentRanges,
+		},
+		{
+			Key: "generator",
+			Comment: `built-in traffic generator sending udp packets of size bytes to target at pps
+(or bps) through the simulator, the receiving simulator counts them in /stats.
+pattern times the packets: cbr (constant rate), poisson (exponential gaps
+averaging pps), onoff (pps for on, then silent for off) or ramp (rate rising
+from ramp_from to pps over ramp). the achieved rate and gaps are logged
+against the target every second`,
+			Value: generatorConfig,
+		},
+		{
+			Key: "congestion_control",
+			Comment: `quic congestion controller for client and server connections, quic-go
+only provides cubic`,
+			Value: congestionControl,
+		},
+		{
+			Key: "quic_versions",
+			Comment: `pin the quic versions offered and accepted, in order of preference (v1, v2),
+empty lets quic-go choose. quic_library fails startup unless the simulator is
+built with this quic-go version. Both are reported in the stats, and the
+negotiated parameters per connection`,
+			Value: []string{},
+		},
+		{
+			Key:   "quic_library",
+			Value: "",
+		},
+		{
+			Key: "rules",
+			Comment: `policy routing rules, tried by ascending priority before the destination
+route: the first rule matching src/dst (address or cidr), proto (tcp, udp,
+icmp, icmpv6) and ports, or icmp_type and icmp_code for icmp, sends the
+packet to the peer of via. Instead of via, paths
+spread the packets over several peers by balance: round_robin (default)
+per packet, or hash to keep each 5-tuple flow on one path like ecmp. Both
+honour the path weights (1 to 100, default 1)`,
+			Value: []PolicyRule{},
+			Sample: []PolicyRule{
+				{Priority: 10, FlowMatch: FlowMatch{Src: "10.0.0.1", Dst: "10.0.1.0/24"}, Via: "10.0.0.2"},
+				{Priority: 20, FlowMatch: FlowMatch{Dst: "10.0.2.0/24"}, Balance: BalanceHash, Paths: []PathConfig{{Via: "10.0.0.1", Weight: 1}, {Via: "10.0.0.2", Weight: 2}}},
+			},
+		},
+		{
+			Key: "outages",
+			Comment: `simulated link outages: the link to peer goes down at (after startup) and
+every packet to and from it is dropped until it comes back up after duration,
+0 keeps it down. teardown also closes the connection and holds off
+reconnecting. POST /peers/link?vip=&state=down|up&teardown=true on the admin
+api does the same at runtime`,
+			Value:  []OutageConfig{},
+			Sample: []OutageConfig{{Peer: "10.0.0.2", At: time.Minute, Duration: 10 * time.Second, Teardown: true}},
+		},
+		{
+			Key: "hexdump",
+			Comment: `log hex dumps of the packets of the flows matching src/dst/proto/ports like
+the policy rules, at most rate packets per second, on egress and ingress
+before and after the impairments. GET, POST and DELETE /hexdump on the admin
+api show, replace (the filter in the query) and disable it at runtime`,
+			Value: hexdumpConfig,
+		},
+		{
+			Key: "flows",
+			Comment: `per-flow stats: flows idle for idle_ttl are evicted, tcp flows closed by
+fin or rst at the next sweep`,
+			Value: flowConfig,
+		},
+		{
+			Key: "dead_peer",
+			Comment: `dead peer detection: the client sends a keepalive every interval which the
+server echoes, a side hearing nothing for threshold intervals closes the
+connection and the client reconnects. interval 0 disables it`,
+			Value: deadPeerConfig,
+		},
+		{
+			Key: "capture",
+			Comment: `write forwarded packets to a pcap file, sample keeps a fraction of the
+packets matching filter: src/dst/proto/ports like the policy rules, dscp
+(-1 is any) and impaired (impaired or normal, empty is both)`,
+			Value: captureConfig,
+		},
+		{
+			Key: "access_log",
+			Comment: `write a line per sampled packet forwarded to or from a peer or dropped on
+the way, with its time, direction, 5-tuple, size, peer, action (forwarded or
+dropped) and the reason of a drop, as json lines or csv. The file is rotated
+once it holds max_size bytes or was opened max_age ago, moved aside with the
+time it was opened appended; 0 disables either. empty file disables the log`,
+			Value: accessLogConfig,
+		},
+		{
+			Key: "pending_routes",
+			Comment: `hold up to depth packets per virtual ip without a route, for at most
+max_destinations destinations, and forward them once the route is started
+(by a reload, a scenario or the staged startup) instead of dropping them.
+Those still held after timeout are dropped. Counted as pending_route_held,
+_flushed, _expired and _drops; depth 0 drops them right away`,
+			Value: pendingRouteConfig,
+		},
+		{
+			Key: "memory",
+			Comment: `cap on the bytes of all packets buffered at once: in the peer queues and
+bandwidth limits, the impairment delays, ip reassembly, the pause gate and
+pending_routes. Above it packets are dropped instead of buffered (counted as
+memory_drops, the bytes in use as buffered_bytes in GET /stats). The last
+tenth is kept for icmp, tcp segments without payload and dscp cs5 and above,
+so bulk traffic is shed first. 0 only tracks the buffered bytes`,
+			Value: memoryConfig,
+		},
+		{
+			Key: "relay",
+			Comment: `packets other peers send to a peer with relay: true are forwarded on to it
+instead of written to a tun device, chaining simulators into a multi-hop
+path. A hop count travels with relayed packets, those relayed max_hops
+times are dropped as looping`,
+			Value: relayConfig,
+		},
+		{
+			Key: "passthrough",
+			Comment: `forward frames that are not ip packets, e.g. ethernet frames in tap mode, to
+the peer with this virtual ip instead of dropping them, and write those from
+the peers to device (default the first tun device). They bypass the routing
+and all impairments but the peer's impairment.loss, counted as
+passthrough_tx/rx. empty peer disables it`,
+			Value: passthroughConfig,
+		},
+		{
+			Key: "device_log",
+			Comment: `log the tun device the packets from the peers are written to, for a sample
+fraction of them, 0 logs none. the stats count them per peer and device
+either way`,
+			Value: deviceLogConfig,
+		},
+		{
+			Key: "drain",
+			Comment: `SIGUSR1 or POST /drain on the admin api drains the server: new connections
+are refused and /healthz reports 503, the simulator exits once the existing
+connections closed or after timeout`,
+			Value: drainConfig,
+		},
+		{
+			Key: "cycle",
+			Comment: `POST /connections/cycle on the admin api closes the open client connections
+one at a time, delay after the request and interval apart, so the clients
+reconnect and redo the tls handshake without all reconnecting at once`,
+			Value: cycleConfig,
+		},
+		{
+			Key: "pause",
+			Comment: `POST /pause on the admin api stops forwarding until POST /resume: mode
+buffer holds up to limit packets and forwards them on resume, drop discards`,
+			Value: pauseConfig,
+		},
+		{
+			Key: "startup",
+			Comment: `delay holds off forwarding and dialing the peers after startup, ramp spreads
+the initial peer dials evenly over its duration instead of dialing all at
+once; the progress is logged and reported under startup in the stats.
+Packets are forwarded as usual during the warmup after the delay, but the
+stats and the traffic generator's summary only count from its end on,
+reported as startup.warmup_ended`,
+			Value: startupConfig,
+		},
+		{
+			Key: "stats_export",
+			Comment: `append a timestamped stats snapshot as a json line to file ("-" is stdout)
+every interval and once more at shutdown. A file larger than max_size bytes
+is renamed to <file>.1 and a new one started, 0 never rotates. empty file
+disables it`,
+			Value: statsExportConfig,
+		},
+		{
+			Key: "tracing",
+			Comment: `export an opentelemetry span per sampled packet and simulator as otlp/http
+json to endpoint, e.g. http://localhost:4318/v1/traces, every interval. The
+trace id is derived from the packet, so the spans of the sending and the
+receiving simulator end up in the same trace. empty endpoint disables it`,
+			Value: tracingConfig,
+		},
+		{
+			Key: "mtu_probe",
+			Comment: `probe the path mtu to every peer after connecting with dont-fragment udp
+probes of min to max bytes to its quic port, reported as path_mtu in
+/stats. the peer acks the probes, so it needs mtu_probe enabled too`,
+			Value: mtuProbeConfig,
+		},
+	}
+}
+
+// runGenConfigCmd implements the gen-config subcommand, writing the config
+// with every key at its default to stdout or -o.
+func runGenConfigCmd(args []string) error {
+	fs := flag.NewFlagSet("gen-config", flag.ExitOnError)
+	out := fs.String("o", "", "write the config to this file instead of stdout")
+	fs.Parse(args)
+
+	if *out == "" {
+		return writeConfig(os.Stdout)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err = writeConfig(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeConfig writes the sections of configSections as commented yaml.
+func writeConfig(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("# generated by gen-config from the defaults of the simulator, do not edit;\n")
+	b.WriteString("# commented out keys are examples\n")
+	for _, s := range configSections() {
+		// a section without a comment goes with the one before
+		if s.Comment != "" {
+			b.WriteByte('\n')
+		}
+		writeComment(&b, "", s.Comment)
+		if s.Value == nil {
+			var sample strings.Builder
+			writeYAML(&sample, "", s.Key, reflect.ValueOf(s.Sample), false)
+			writeCommentedOut(&b, "", sample.String())
+			continue
+		}
+		writeYAML(&b, "", s.Key, reflect.ValueOf(s.Value), true)
+		if s.Sample != nil {
+			var sample strings.Builder
+			writeYAMLValue(&sample, "", reflect.ValueOf(s.Sample), false)
+			writeCommentedOut(&b, "  ", sample.String())
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeComment(b *strings.Builder, indent, comment string) {
+	if comment == "" {
+		return
+	}
+	for _, line := range strings.Split(comment, "\n") {
+		b.WriteString(strings.TrimRight(indent+"# "+line, " ") + "\n")
+	}
+}
+
+// writeCommentedOut writes the lines of yaml commented out at indent.
+func writeCommentedOut(b *strings.Builder, indent, yaml string) {
+	for _, line := range strings.Split(strings.TrimSuffix(yaml, "\n"), "\n") {
+		b.WriteString(indent + "# " + line + "\n")
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// writeYAML writes key: v at indent, with the comment tags of the fields
+// of v and the unset optional fields commented out if comments is set.
+func writeYAML(b *strings.Builder, indent, key string, v reflect.Value, comments bool) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			if v.Kind() == reflect.Pointer && comments {
+				// unset, e.g. a per-peer override
+				fmt.Fprintf(b, "%s# %s: %s\n", indent, key, yamlScalar(reflect.Zero(v.Type().Elem())))
+			} else if v.Kind() == reflect.Interface {
+				fmt.Fprintf(b, "%s%s: null\n", indent, key)
+			}
+			return
+		}
+		v = v.Elem()
+	}
+	if s, ok := yamlInline(v); ok {
+		fmt.Fprintf(b, "%s%s: %s\n", indent, yamlKey(key), s)
+		return
+	}
+	fmt.Fprintf(b, "%s%s:\n", indent, yamlKey(key))
+	writeYAMLValue(b, indent+"  ", v, comments)
+}
+
+// writeYAMLValue writes the entries of the struct, map or list v at indent.
+func writeYAMLValue(b *strings.Builder, indent string, v reflect.Value, comments bool) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("mapstructure"), ",")
+			if opts == "squash" {
+				writeYAMLValue(b, indent, v.Field(i), comments)
+				continue
+			}
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			if comments {
+				writeComment(b, indent, f.Tag.Get("comment"))
+			}
+			writeYAML(b, indent, name, v.Field(i), comments)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, k := range keys {
+			writeYAML(b, indent, fmt.Sprint(k), v.MapIndex(k), comments)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			e := v.Index(i)
+			if s, ok := yamlInline(e); ok {
+				fmt.Fprintf(b, "%s- %s\n", indent, s)
+				continue
+			}
+			var item strings.Builder
+			writeYAMLValue(&item, indent+"  ", e, comments)
+			b.WriteString(indent + "- " + strings.TrimPrefix(item.String(), indent+"  "))
+		}
+	}
+}
+
+// yamlInline returns v written on the line of its key: scalars, empty maps
+// and lists, and lists of scalars.
+func yamlInline(v reflect.Value) (string, bool) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "null", true
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		return "", false
+	case reflect.Map:
+		if v.Len() == 0 {
+			return "{}", true
+		}
+		return "", false
+	case reflect.Slice, reflect.Array:
+		items := make([]string, v.Len())
+		for i := range items {
+			s, ok := yamlInline(v.Index(i))
+			e := v.Index(i)
+			for e.Kind() == reflect.Pointer || e.Kind() == reflect.Interface {
+				e = e.Elem()
+			}
+			if !ok || e.Kind() == reflect.Map || e.Kind() == reflect.Slice {
+				return "", false
+			}
+			items[i] = s
+		}
+		return "[" + strings.Join(items, ", ") + "]", true
+	}
+	return yamlScalar(v), true
+}
+
+func yamlScalar(v reflect.Value) string {
+	if v.Type() == durationType {
+		return yamlDuration(time.Duration(v.Int()))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return yamlString(v.String())
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	}
+	return yamlString(fmt.Sprint(v.Interface()))
+}
+
+// yamlDuration writes d the way the config is usually written, 8760h rather
+// than 8760h0m0s.
+func yamlDuration(d time.Duration) string {
+	if d == 0 {
+		return "0"
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// yamlString quotes s where yaml would not read it back as that string.
+func yamlString(s string) string {
+	if s == "" || strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@` ") || strings.HasSuffix(s, " ") ||
+		strings.Contains(s, ": ") || strings.Contains(s, " #") {
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null", "~":
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// yamlKey writes map keys such as virtual ips quoted, like the hand-written
+// configs do.
+func yamlKey(key string) string {
+	if strings.ContainsAny(key, ".:/") {
+		return strconv.Quote(key)
+	}
+	return yamlString(key)
+}
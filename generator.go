@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// GeneratorConfig drives the built-in traffic generator, read from
+// "generator". It sends IPv4 UDP packets to Target through the same path as
+// packets read from the tun devices.
+type GeneratorConfig struct {
+	Enable bool `mapstructure:"enable"`
+	// Target is the virtual IP the packets are sent to, Source their source
+	// address, by default that of the first tun device.
+	Target  string `mapstructure:"target"`
+	Source  string `mapstructure:"source"`
+	SrcPort uint16 `mapstructure:"src_port"`
+	DstPort uint16 `mapstructure:"dst_port"`
+	// Size is the IP packet size in bytes.
+	Size int `mapstructure:"size"`
+	// PPS is the target rate in packets per second. BPS, in bits per
+	// second, is used instead when set.
+	PPS float64 `mapstructure:"pps"`
+	BPS float64 `mapstructure:"bps"`
+	// Pattern is the timing of the packets: PatternCBR, PatternPoisson,
+	// PatternOnOff with On and Off, or PatternRamp with Ramp and RampFrom
+	// in packets per second.
+	Pattern  string        `mapstructure:"pattern"`
+	On       time.Duration `mapstructure:"on"`
+	Off      time.Duration `mapstructure:"off"`
+	Ramp     time.Duration `mapstructure:"ramp"`
+	RampFrom float64       `mapstructure:"ramp_from"`
+	// Duration stops the generator after a while, 0 runs until shutdown.
+	Duration time.Duration `mapstructure:"duration"`
+
+	target, source netip.Addr
+}
+
+var generatorConfig = GeneratorConfig{SrcPort: 40000, DstPort: 9, Size: 512, PPS: 100, Pattern: PatternCBR}
+
+// genMagic marks generated packets so the receiving simulator can count
+// them. It is followed by a sequence number and the send time.
+var genMagic = []byte("nsimgen\x00")
+
+const genHeaderLen = ipv4MinHeaderLen + udpHeaderLen
+const genPayloadLen = 8 + 8 + 8
+
+func (c *GeneratorConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+	var err error
+	if c.target, err = netip.ParseAddr(c.Target); err != nil || !c.target.Is4() {
+		return fmt.Errorf("generator: target %q is not an ipv4 address", c.Target)
+	}
+	if c.Source != "" {
+		if c.source, err = netip.ParseAddr(c.Source); err != nil || !c.source.Is4() {
+			return fmt.Errorf("generator: source %q is not an ipv4 address", c.Source)
+		}
+	}
+	if c.Size < genHeaderLen+genPayloadLen || c.Size > BUFSIZE {
+		return fmt.Errorf("generator: size must be within [%d, %d]", genHeaderLen+genPayloadLen, BUFSIZE)
+	}
+	if c.BPS > 0 {
+		c.PPS = c.BPS / 8 / float64(c.Size)
+	}
+	if c.PPS <= 0 {
+		return fmt.Errorf("generator: pps or bps must be positive")
+	}
+	return c.validatePattern()
+}
+
+// isGeneratedPacket reports whether packet was built by a traffic generator.
+func isGeneratedPacket(packet []byte) bool {
+	if !validIPv4Header(packet) || packet[9] != protoUDP {
+		return false
+	}
+	payload := packet[ipv4HeaderLen(packet):]
+	return len(payload) >= udpHeaderLen+len(genMagic) && bytes.Equal(payload[udpHeaderLen:udpHeaderLen+len(genMagic)], genMagic)
+}
+
+// runGenerator sends packets timed by the configured pattern until ctx is
+// done or the duration is over, logging the achieved rate and gaps against
+// the target every second.
+func runGenerator(ctx context.Context, conf GeneratorConfig) {
+	if conf.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.Duration)
+		defer cancel()
+	}
+	vIP := net.IP(conf.target.AsSlice())
+	payload := make([]byte, conf.Size-genHeaderLen)
+	copy(payload, genMagic)
+	pattern := newGenPattern(conf, impairmentSeed)
+
+	slog.Info("traffic generator started", "target", conf.Target, "pattern", conf.Pattern, "pps", conf.PPS, "bps", conf.PPS*float64(conf.Size)*8)
+	start := clock.Now()
+	lastReport, lastSent := start, uint64(0)
+	var sent uint64
+	var gaps, total gapStats
+	// the summary leaves out what was sent during the warmup
+	warm := !warmingUp()
+	var warmSent uint64
+	warmStart := start
+	for {
+		if wait := pattern.next() - clock.Now().Sub(start); wait > 0 {
+			select {
+			case <-ctx.Done():
+			case <-clock.After(wait):
+			}
+		}
+		now := clock.Now()
+		if !warm && !warmingUp() {
+			warm, warmSent, warmStart = true, sent, now
+			total = gapStats{}
+		}
+		if ctx.Err() != nil {
+			expected := pattern.expected(now.Sub(start)) - pattern.expected(warmStart.Sub(start))
+			reportGeneratorRate(conf, pattern, sent-warmSent, expected, now.Sub(warmStart), &total)
+			return
+		}
+		binary.BigEndian.PutUint64(payload[8:], sent)
+		binary.BigEndian.PutUint64(payload[16:], uint64(now.UnixNano()))
+		sendToPeer(vIP, buildUDPPacket(conf.source, conf.target, conf.SrcPort, conf.DstPort, payload))
+		globalStats.GenTxPackets.Add(1)
+		globalStats.GenTxBytes.Add(uint64(conf.Size))
+		sent++
+		gaps.add(now)
+		total.add(now)
+		if now.Sub(lastReport) >= time.Second {
+			expected := pattern.expected(now.Sub(start)) - pattern.expected(lastReport.Sub(start))
+			reportGeneratorRate(conf, pattern, sent-lastSent, expected, now.Sub(lastReport), &gaps)
+			lastReport, lastSent = now, sent
+			gaps = gapStats{last: now}
+		}
+	}
+}
+
+// reportGeneratorRate logs the packets sent over elapsed against the
+// expected ones and the gaps between them against the pattern's.
+func reportGeneratorRate(conf GeneratorConfig, pattern genPattern, sent uint64, expected float64, elapsed time.Duration, gaps *gapStats) {
+	if elapsed <= 0 {
+		return
+	}
+	pps := float64(sent) / elapsed.Seconds()
+	targetPps := expected / elapsed.Seconds()
+	attrs := []any{"pattern", conf.Pattern,
+		"pps", pps, "targetPps", targetPps,
+		"bps", pps * float64(conf.Size) * 8, "targetBps", targetPps * float64(conf.Size) * 8}
+	if mean, cv := gaps.meanCV(); !math.IsNaN(cv) {
+		attrs = append(attrs, "gapMean", mean, "gapCv", cv)
+	}
+	if cv := pattern.targetCV(); !math.IsNaN(cv) {
+		attrs = append(attrs, "targetGapCv", cv)
+	}
+	slog.Info("traffic generator rate", attrs...)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Timing patterns of the traffic generator, selected by its pattern.
+const (
+	// PatternCBR sends at a constant PPS.
+	PatternCBR = "cbr"
+	// PatternPoisson sends at PPS on average with exponentially distributed
+	// gaps.
+	PatternPoisson = "poisson"
+	// PatternOnOff sends at PPS for On, then pauses for Off.
+	PatternOnOff = "onoff"
+	// PatternRamp raises the rate linearly from RampFrom to PPS over Ramp,
+	// then keeps sending at PPS.
+	PatternRamp = "ramp"
+)
+
+func (c *GeneratorConfig) validatePattern() error {
+	switch c.Pattern {
+	case "":
+		c.Pattern = PatternCBR
+	case PatternCBR, PatternPoisson:
+	case PatternOnOff:
+		if c.On <= 0 || c.Off < 0 {
+			return fmt.Errorf("generator: onoff needs a positive on and an off not negative")
+		}
+	case PatternRamp:
+		if c.Ramp <= 0 || c.RampFrom < 0 || c.RampFrom > c.PPS {
+			return fmt.Errorf("generator: ramp needs a positive ramp and ramp_from within [0, pps]")
+		}
+	default:
+		return fmt.Errorf("generator: unknown pattern %q", c.Pattern)
+	}
+	return nil
+}
+
+// genPattern schedules the generated packets.
+type genPattern interface {
+	// next returns when the next packet is due, relative to the start.
+	next() time.Duration
+	// expected is the mean number of packets due by t.
+	expected(t time.Duration) float64
+	// targetCV is the coefficient of variation of the gaps between the
+	// packets the pattern aims for, NaN if it has none.
+	targetCV() float64
+}
+
+func newGenPattern(conf GeneratorConfig, seed int64) genPattern {
+	switch conf.Pattern {
+	case PatternPoisson:
+		return &poissonPattern{pps: conf.PPS, rng: rand.New(rand.NewSource(seed))}
+	case PatternOnOff:
+		return &onOffPattern{pps: conf.PPS, on: conf.On, off: conf.Off}
+	case PatternRamp:
+		return &rampPattern{from: conf.RampFrom, to: conf.PPS, ramp: conf.Ramp}
+	default:
+		return &cbrPattern{pps: conf.PPS}
+	}
+}
+
+func seconds(s float64) time.Duration { return time.Duration(s * float64(time.Second)) }
+
+type cbrPattern struct {
+	pps float64
+	n   float64
+}
+
+func (p *cbrPattern) next() time.Duration {
+	at := seconds(p.n / p.pps)
+	p.n++
+	return at
+}
+
+func (p *cbrPattern) expected(t time.Duration) float64 { return t.Seconds() * p.pps }
+
+func (p *cbrPattern) targetCV() float64 { return 0 }
+
+type poissonPattern struct {
+	pps float64
+	rng *rand.Rand
+	at  float64
+}
+
+func (p *poissonPattern) next() time.Duration {
+	at := seconds(p.at)
+	p.at += p.rng.ExpFloat64() / p.pps
+	return at
+}
+
+func (p *poissonPattern) expected(t time.Duration) float64 { return t.Seconds() * p.pps }
+
+func (p *poissonPattern) targetCV() float64 { return 1 }
+
+type onOffPattern struct {
+	pps     float64
+	on, off time.Duration
+	n       float64
+}
+
+func (p *onOffPattern) next() time.Duration {
+	perCycle := math.Max(1, math.Floor(p.on.Seconds()*p.pps))
+	cycle := math.Floor(p.n / perCycle)
+	at := time.Duration(cycle)*(p.on+p.off) + seconds((p.n-cycle*perCycle)/p.pps)
+	p.n++
+	return at
+}
+
+func (p *onOffPattern) expected(t time.Duration) float64 {
+	period := p.on + p.off
+	cycles := t / period
+	return (float64(cycles)*p.on.Seconds() + min(t-cycles*period, p.on).Seconds()) * p.pps
+}
+
+func (p *onOffPattern) targetCV() float64 { return math.NaN() }
+
+type rampPattern struct {
+	from, to float64
+	ramp     time.Duration
+	n        float64
+}
+
+// next inverts expected: during the ramp n = from*t + (to-from)*t²/2T.
+func (p *rampPattern) next() time.Duration {
+	n := p.n
+	p.n++
+	T := p.ramp.Seconds()
+	if full := p.expected(p.ramp); n >= full {
+		return p.ramp + seconds((n-full)/p.to)
+	}
+	a := (p.to - p.from) / (2 * T)
+	if a == 0 {
+		return seconds(n / p.from)
+	}
+	return seconds((-p.from + math.Sqrt(p.from*p.from+4*a*n)) / (2 * a))
+}
+
+func (p *rampPattern) expected(t time.Duration) float64 {
+	T := p.ramp.Seconds()
+	if t >= p.ramp {
+		return p.from*T + (p.to-p.from)*T/2 + (t-p.ramp).Seconds()*p.to
+	}
+	s := t.Seconds()
+	return p.from*s + (p.to-p.from)*s*s/(2*T)
+}
+
+func (p *rampPattern) targetCV() float64 { return math.NaN() }
+
+// gapStats accumulates the gaps between the packets actually sent.
+type gapStats struct {
+	n          int
+	last       time.Time
+	sum, sumSq float64 // seconds
+}
+
+func (g *gapStats) add(at time.Time) {
+	if !g.last.IsZero() {
+		gap := at.Sub(g.last).Seconds()
+		g.n++
+		g.sum += gap
+		g.sumSq += gap * gap
+	}
+	g.last = at
+}
+
+// meanCV returns the mean gap and its coefficient of variation.
+func (g *gapStats) meanCV() (time.Duration, float64) {
+	if g.n == 0 {
+		return 0, math.NaN()
+	}
+	mean := g.sum / float64(g.n)
+	variance := math.Max(0, g.sumSq/float64(g.n)-mean*mean)
+	return seconds(mean), math.Sqrt(variance) / mean
+}
@@ -7,7 +7,9 @@ toolchain go1.21.3
 require (
 	gitee.com/czy_hit/softbus-go v0.0.0-20230906080439-9b0bea146b9e
 	github.com/gookit/config/v2 v2.2.4
+	github.com/mitchellh/mapstructure v1.5.0
 	github.com/quic-go/quic-go v0.39.3
+	golang.org/x/net v0.17.0
 )
 
 require (
@@ -21,7 +23,6 @@ require (
 	github.com/imdario/mergo v0.3.16 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/onsi/ginkgo/v2 v2.13.0 // indirect
 	github.com/quic-go/qtls-go1-20 v0.4.1 // indirect
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8 // indirect
@@ -31,7 +32,6 @@ require (
 	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d // indirect
 	golang.org/x/mod v0.13.0 // indirect
-	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sync v0.4.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/term v0.13.0 // indirect
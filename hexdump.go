@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HexdumpConfig logs full hex dumps of the packets of the flows matching
+// it, read from "hexdump" and changed at runtime by the admin api.
+type HexdumpConfig struct {
+	Enable    bool `mapstructure:"enable"`
+	FlowMatch `mapstructure:",squash"`
+	// Rate is the most packets dumped per second, the others are counted.
+	Rate int `mapstructure:"rate"`
+}
+
+var hexdumpConfig = HexdumpConfig{Rate: 10}
+
+func (c *HexdumpConfig) validate() error {
+	if c.Rate <= 0 {
+		return fmt.Errorf("hexdump: rate must be positive")
+	}
+	if err := c.FlowMatch.compile(); err != nil {
+		return fmt.Errorf("hexdump: %w", err)
+	}
+	return nil
+}
+
+// hexdumper is the enabled dump filter with its rate limit.
+type hexdumper struct {
+	conf HexdumpConfig
+
+	mu         sync.Mutex
+	window     time.Time
+	dumped     int
+	suppressed int
+}
+
+// hexdumps is the running filter, nil if disabled.
+var hexdumps atomic.Pointer[hexdumper]
+
+// setHexdump replaces the running filter with conf.
+func setHexdump(conf HexdumpConfig) {
+	if !conf.Enable {
+		hexdumps.Store(nil)
+		slog.Info("hexdump disabled")
+		return
+	}
+	hexdumps.Store(&hexdumper{conf: conf})
+	slog.Info("hexdump enabled", "src", conf.Src, "dst", conf.Dst, "proto", conf.Proto,
+		"srcPort", conf.SrcPort, "dstPort", conf.DstPort, "rate", conf.Rate)
+}
+
+// dumpPacket logs packet at stage if it belongs to a dumped flow.
+func dumpPacket(stage string, packet []byte) {
+	d := hexdumps.Load()
+	if d == nil {
+		return
+	}
+	flow, ok := parseFlowKey(packet)
+	if !ok || !d.conf.match(flow) {
+		return
+	}
+	d.mu.Lock()
+	now := clock.Now()
+	if now.Sub(d.window) >= time.Second {
+		if d.suppressed > 0 {
+			slog.Info("hexdump suppressed packets", "count", d.suppressed)
+		}
+		d.window, d.dumped, d.suppressed = now, 0, 0
+	}
+	if d.dumped >= d.conf.Rate {
+		d.suppressed++
+		d.mu.Unlock()
+		return
+	}
+	d.dumped++
+	d.mu.Unlock()
+	slog.Info("packet hexdump", "stage", stage, "flow", flow.String(), "len", len(packet), "dump", "\n"+hex.Dump(packet))
+}
+
+// hexdumpFromQuery reads a filter from the query of a POST /hexdump, the
+// fields are named like the config.
+func hexdumpFromQuery(q url.Values) (HexdumpConfig, error) {
+	conf := HexdumpConfig{Enable: true, Rate: hexdumpConfig.Rate}
+	conf.Src, conf.Dst, conf.Proto = q.Get("src"), q.Get("dst"), q.Get("proto")
+	for key, port := range map[string]*uint16{"src_port": &conf.SrcPort, "dst_port": &conf.DstPort} {
+		if s := q.Get(key); s != "" {
+			n, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				return conf, fmt.Errorf("%s: %w", key, err)
+			}
+			*port = uint16(n)
+		}
+	}
+	if s := q.Get("rate"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return conf, fmt.Errorf("rate: %w", err)
+		}
+		conf.Rate = n
+	}
+	return conf, conf.validate()
+}
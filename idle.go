@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// idleSweepInterval is how often the connections are checked for idleness.
+const idleSweepInterval = time.Second
+
+// idleState closes the connection to a peer that forwarded no packets for
+// its idle_timeout and holds off reconnecting until there is traffic again.
+type idleState struct {
+	// lastActive is when a packet to or from the peer was last seen, or the
+	// connection came up, in unix nanoseconds.
+	lastActive atomic.Int64
+	// closed is set while the connection is closed for idleness.
+	closed atomic.Bool
+	// close asks connectPeer to close the connection, wake to redial.
+	close chan struct{}
+	wake  chan struct{}
+}
+
+func (s *idleState) init() {
+	s.close = make(chan struct{}, 1)
+	s.wake = make(chan struct{}, 1)
+}
+
+// active records traffic, waking connectPeer if the connection is closed
+// for idleness.
+func (s *idleState) active() {
+	s.lastActive.Store(clock.Now().UnixNano())
+	if s.closed.Load() {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// checkIdleTimeout rejects idle_timeout together with the dead_peer
+// keepalives, which would keep reconnecting the idle links.
+func checkIdleTimeout(vIP string, pc *PeerConfig) error {
+	if pc.IdleTimeout < 0 {
+		return fmt.Errorf("peers.%s: idle_timeout must not be negative", vIP)
+	}
+	if pc.IdleTimeout > 0 && deadPeerConfig.enabled() {
+		return fmt.Errorf("peers.%s: idle_timeout and the dead_peer keepalives are mutually exclusive", vIP)
+	}
+	return nil
+}
+
+// runIdleSweeper asks connectPeer to close the connections of the peers
+// idle for longer than their idle_timeout until ctx is done.
+func runIdleSweeper(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(idleSweepInterval):
+		}
+		now := clock.Now()
+		peerTable.Range(func(p *Peer) bool {
+			timeout := p.conf.IdleTimeout
+			if timeout == 0 || !p.connected.Load() || now.Sub(time.Unix(0, p.idle.lastActive.Load())) <= timeout {
+				return true
+			}
+			select {
+			case p.idle.close <- struct{}{}:
+			default:
+			}
+			return true
+		})
+	}
+}
+
+// waitForTraffic blocks after an idle close until a packet is queued for
+// the peer, it returns false if ctx is done first.
+func (p *Peer) waitForTraffic(ctx context.Context) bool {
+	select {
+	case <-p.idle.wake:
+	default:
+	}
+	p.idle.closed.Store(true)
+	defer p.idle.closed.Store(false)
+	// a packet queued before closed was set did not wake us
+	if len(p.queue) > 0 || p.shaper != nil && p.shaper.QueueLen() > 0 {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-p.idle.wake:
+		return true
+	}
+}
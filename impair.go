@@ -0,0 +1,315 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ImpairmentConfig describes the link conditions simulated towards a peer.
+type ImpairmentConfig struct {
+	// Loss is the probability in [0, 1] that a packet is dropped.
+	Loss float64 `mapstructure:"loss"`
+	// Latency delays every packet, Jitter adds a uniform random delay in
+	// [-Jitter, Jitter] on top. Jitter may reorder packets.
+	Latency time.Duration `mapstructure:"latency"`
+	Jitter  time.Duration `mapstructure:"jitter"`
+	// WireCorrupt is the probability in [0, 1] that a UDP datagram to the
+	// peer gets a byte corrupted after QUIC encrypted it, see wireCorrupter.
+	WireCorrupt float64 `mapstructure:"wire_corrupt"`
+}
+
+func (c ImpairmentConfig) enabled() bool {
+	return c.Loss > 0 || c.Latency > 0 || c.Jitter > 0
+}
+
+// chain returns the built-in impairments the shorthand settings stand for.
+func (c ImpairmentConfig) chain(seed int64) ImpairmentChain {
+	var chain ImpairmentChain
+	if c.Loss > 0 {
+		chain = append(chain, newLossImpairment(c.Loss, DirEgress, seed))
+	}
+	if c.Latency > 0 || c.Jitter > 0 {
+		chain = append(chain, newLatencyImpairment(c.Latency, c.Jitter, DirEgress, seed+1))
+	}
+	return chain
+}
+
+// check validates the ranges of c, clamping out of range values instead
+// with impairment_ranges: clamp. path names c in errors and warnings.
+func (c *ImpairmentConfig) check(path string) error {
+	r := rangeCheck{path}
+	return errors.Join(
+		r.probability("loss", &c.Loss),
+		r.probability("wire_corrupt", &c.WireCorrupt),
+		r.nonNegative("latency", &c.Latency),
+		r.nonNegative("jitter", &c.Jitter),
+	)
+}
+
+const (
+	// RangeError rejects a config with impairment parameters out of range,
+	// RangeClamp clamps them into range with a warning.
+	RangeError = "error"
+	RangeClamp = "clamp"
+)
+
+// impairmentRanges is read from "impairment_ranges".
+var impairmentRanges = RangeError
+
+// rangeCheck checks impairment parameters below path.
+type rangeCheck struct {
+	path string
+}
+
+func (r rangeCheck) outOfRange(name string, v, clamped any, want string) error {
+	if impairmentRanges == RangeClamp {
+		slog.Warn("impairment parameter out of range, clamped", "param", r.path+"."+name, "value", v, "clamped", clamped, "want", want)
+		return nil
+	}
+	return fmt.Errorf("%s.%s: %v is out of range, want %s", r.path, name, v, want)
+}
+
+func (r rangeCheck) probability(name string, p *float64) error {
+	if *p >= 0 && *p <= 1 {
+		return nil
+	}
+	v := *p
+	*p = min(max(v, 0), 1)
+	return r.outOfRange(name, v, *p, "a probability in [0, 1]")
+}
+
+func (r rangeCheck) nonNegative(name string, d *time.Duration) error {
+	if *d >= 0 {
+		return nil
+	}
+	v := *d
+	*d = 0
+	return r.outOfRange(name, v, *d, "a duration >= 0")
+}
+
+// checkChainParams validates the params of the built-in impairments of a
+// chain in place. Rates have no sensible value to clamp to and are always
+// rejected when not positive, registered impairments check their own params.
+func checkChainParams(path string, specs []map[string]any) error {
+	var errs []error
+	for i, spec := range specs {
+		r := rangeCheck{fmt.Sprintf("%s.impairments[%d]", path, i)}
+		for key, raw := range spec {
+			var err error
+			switch key {
+			case "probability", "loss":
+				if p, ok := paramFloat(raw); ok {
+					err = r.probability(key, &p)
+					spec[key] = p
+				}
+			case "latency", "jitter", "queue":
+				if d, ok := paramDuration(raw); ok {
+					err = r.nonNegative(key, &d)
+					spec[key] = d.String()
+				}
+			case "rate":
+				if v, ok := paramFloat(raw); ok && v <= 0 {
+					err = fmt.Errorf("%s.rate: %v must be positive", r.path, raw)
+				}
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func paramFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func paramDuration(v any) (time.Duration, bool) {
+	switch v := v.(type) {
+	case string:
+		d, err := time.ParseDuration(v)
+		return d, err == nil
+	case time.Duration:
+		return v, true
+	}
+	if f, ok := paramFloat(v); ok {
+		return time.Duration(f), true
+	}
+	return 0, false
+}
+
+// impairmentSeed is the base seed of the impairment PRNGs, see peerSeed.
+var impairmentSeed int64
+
+// peerSeed derives the PRNG seed of a peer from the base seed. The peer
+// index added to the base is the FNV-1a hash of its virtual IP rather than
+// its position in the route table, so every peer draws the same random
+// sequence for a given base seed no matter which other peers exist.
+func peerSeed(base int64, vIP net.IP) int64 {
+	h := fnv.New64a()
+	h.Write(vIP.To16())
+	return base + int64(h.Sum64())
+}
+
+type delayedPacket struct {
+	at  time.Time
+	seq uint64
+	pkt []byte
+}
+
+type delayHeap []delayedPacket
+
+func (h delayHeap) Len() int { return len(h) }
+func (h delayHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h delayHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *delayHeap) Push(x any)   { *h = append(*h, x.(delayedPacket)) }
+func (h *delayHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+const (
+	// DelayOverflowRelease sends the packet due first right away to make
+	// room, DelayOverflowDrop drops the packet that does not fit.
+	DelayOverflowRelease = "release"
+	DelayOverflowDrop    = "drop"
+)
+
+// DelayLimitConfig bounds the packets the impairments of a peer delay, per
+// direction, read from "delay_limit" of a peer.
+type DelayLimitConfig struct {
+	// Depth is the most packets held, 0 is unbounded. Overflow is what
+	// happens to a packet beyond it: DelayOverflowRelease or
+	// DelayOverflowDrop.
+	Depth    int    `mapstructure:"depth"`
+	Overflow string `mapstructure:"overflow"`
+	// MaxHold caps the delay of a packet, 0 leaves it uncapped.
+	MaxHold time.Duration `mapstructure:"max_hold"`
+}
+
+func (c *DelayLimitConfig) validate() error {
+	switch c.Overflow {
+	case "":
+		c.Overflow = DelayOverflowRelease
+	case DelayOverflowRelease, DelayOverflowDrop:
+	default:
+		return fmt.Errorf("delay_limit: unknown overflow %q", c.Overflow)
+	}
+	if c.Depth < 0 || c.MaxHold < 0 {
+		return fmt.Errorf("delay_limit: depth and max_hold must not be negative")
+	}
+	return nil
+}
+
+// delayLine holds packets until their release time, then passes them to
+// out.
+type delayLine struct {
+	mu    sync.Mutex
+	pkts  delayHeap
+	seq   uint64
+	wake  chan struct{}
+	limit DelayLimitConfig
+	out   func(pkt []byte)
+	// Drops are packets dropped for exceeding limit.Depth, Released those
+	// sent before they were due to make room.
+	Drops    atomic.Uint64
+	Released atomic.Uint64
+}
+
+func newDelayLine(limit DelayLimitConfig, out func(pkt []byte)) *delayLine {
+	return &delayLine{wake: make(chan struct{}, 1), limit: limit, out: out}
+}
+
+// push holds pkt for delay, unless it does not fit into the memory budget
+// or limit.
+func (d *delayLine) push(pkt []byte, delay time.Duration) {
+	if d.limit.MaxHold > 0 {
+		delay = min(delay, d.limit.MaxHold)
+	}
+	if !chargeMemory(pkt) {
+		return
+	}
+	var early []byte
+	d.mu.Lock()
+	if d.limit.Depth > 0 && len(d.pkts) >= d.limit.Depth {
+		if d.limit.Overflow == DelayOverflowDrop {
+			d.mu.Unlock()
+			d.Drops.Add(1)
+			releaseMemory(pkt)
+			return
+		}
+		early = heap.Pop(&d.pkts).(delayedPacket).pkt
+	}
+	d.seq++
+	heap.Push(&d.pkts, delayedPacket{at: clock.Now().Add(delay), seq: d.seq, pkt: pkt})
+	d.mu.Unlock()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	if early != nil {
+		d.Released.Add(1)
+		releaseMemory(early)
+		d.out(early)
+	}
+}
+
+// Len returns the number of packets held.
+func (d *delayLine) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pkts)
+}
+
+// run passes every packet to out once it is due, until ctx is done.
+func (d *delayLine) run(ctx context.Context) {
+	for {
+		d.mu.Lock()
+		var wait <-chan time.Time
+		if len(d.pkts) > 0 {
+			if until := d.pkts[0].at.Sub(clock.Now()); until > 0 {
+				wait = clock.After(until)
+			} else {
+				pkt := heap.Pop(&d.pkts).(delayedPacket).pkt
+				d.mu.Unlock()
+				releaseMemory(pkt)
+				d.out(pkt)
+				continue
+			}
+		}
+		d.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-wait:
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// impairmentRun returns the decisions the impairments of a new peer for
+// vIP take on n packets under seed.
+func impairmentRun(t *testing.T, seed int64, vIP string, n int) []string {
+	t.Helper()
+	c, err := parseConfig([]byte(fmt.Sprintf(`
+impairment_seed: %d
+peers:
+  %q:
+    impairment:
+      loss: 0.3
+      latency: 20ms
+      jitter: 10ms
+`, seed, vIP)), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = applyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	p := newPeer(net.ParseIP(vIP), net.ParseIP("127.0.0.1"))
+	pkt := udpPacket(netip.MustParseAddr("10.0.1.1"), netip.MustParseAddr(vIP), 40000, 53, nil, make([]byte, 10))
+	run := make([]string, n)
+	for i := range run {
+		forward, delay, _ := p.impairments.Apply(pkt, DirEgress)
+		run[i] = fmt.Sprint(forward, delay)
+	}
+	return run
+}
+
+func TestImpairmentSeedReproducible(t *testing.T) {
+	first := impairmentRun(t, 7, "10.0.9.5", 100)
+	if again := impairmentRun(t, 7, "10.0.9.5", 100); fmt.Sprint(again) != fmt.Sprint(first) {
+		t.Fatal("same seed gave a different loss and jitter sequence")
+	}
+	if other := impairmentRun(t, 8, "10.0.9.5", 100); fmt.Sprint(other) == fmt.Sprint(first) {
+		t.Fatal("another seed gave the same sequence")
+	}
+	if other := impairmentRun(t, 7, "10.0.9.6", 100); fmt.Sprint(other) == fmt.Sprint(first) {
+		t.Fatal("another peer gave the same sequence")
+	}
+}
+
+func TestDelayLineLimit(t *testing.T) {
+	for _, overflow := range []string{DelayOverflowRelease, DelayOverflowDrop} {
+		t.Run(overflow, func(t *testing.T) {
+			var out [][]byte
+			d := newDelayLine(DelayLimitConfig{Depth: 2, Overflow: overflow}, func(pkt []byte) { out = append(out, pkt) })
+			for i := byte(0); i < 3; i++ {
+				d.push([]byte{i}, time.Hour+time.Duration(i))
+			}
+			if d.Len() != 2 {
+				t.Fatalf("holds %d packets, want the depth of 2", d.Len())
+			}
+			switch overflow {
+			case DelayOverflowRelease:
+				if len(out) != 1 || out[0][0] != 0 || d.Released.Load() != 1 {
+					t.Fatalf("released %v early, want the packet due first", out)
+				}
+			case DelayOverflowDrop:
+				if len(out) != 0 || d.Drops.Load() != 1 {
+					t.Fatalf("released %v and dropped %d, want the new packet dropped", out, d.Drops.Load())
+				}
+			}
+			d.release()
+		})
+	}
+}
+
+func TestDelayLineMaxHold(t *testing.T) {
+	c := useFakeClock(t)
+	out := make(chan []byte, 1)
+	d := newDelayLine(DelayLimitConfig{MaxHold: 10 * time.Millisecond}, func(pkt []byte) { out <- pkt })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.push([]byte{1}, time.Hour)
+	go d.run(ctx)
+	waitPending(t, c)
+	c.Advance(10*time.Millisecond - 1)
+	select {
+	case <-out:
+		t.Fatal("packet released before max_hold")
+	default:
+	}
+	c.Advance(1)
+	select {
+	case <-out:
+	case <-time.After(2 * time.Second):
+		t.Fatal("packet held beyond max_hold")
+	}
+}
+
+func TestDelayLimitValidate(t *testing.T) {
+	for _, conf := range []string{"overflow: wait", "depth: -1", "max_hold: -1s"} {
+		c, err := parseConfig([]byte("peers:\n  \"10.0.9.10\":\n    delay_limit:\n      "+conf+"\n"), "yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = applyConfig(c); err == nil {
+			t.Fatalf("delay_limit %q accepted", conf)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// Direction is the way a packet travels through the simulator.
+type Direction int
+
+const (
+	// DirEgress packets were read from a tun device and go to a peer.
+	DirEgress Direction = 1 << iota
+	// DirIngress packets came from a peer and go to a tun device.
+	DirIngress
+	DirBoth = DirEgress | DirIngress
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirEgress:
+		return "egress"
+	case DirIngress:
+		return "ingress"
+	case DirBoth:
+		return "both"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+func parseDirection(s string) (Direction, error) {
+	switch s {
+	case "", "egress":
+		return DirEgress, nil
+	case "ingress":
+		return DirIngress, nil
+	case "both":
+		return DirBoth, nil
+	}
+	return 0, fmt.Errorf("unknown direction %q", s)
+}
+
+// Impairment is one step of a peer's impairment chain. Apply is called for
+// every packet of the peer in either direction and reports whether the
+// packet is forwarded, how long it is delayed and the packet to forward,
+// which may be pkt itself or a modified copy. pkt must not be kept.
+// Implementations are called concurrently.
+type Impairment interface {
+	Apply(pkt []byte, dir Direction) (forward bool, delay time.Duration, out []byte)
+}
+
+// ImpairmentFactory builds an impairment from its config params. seed
+// seeds its random decisions so runs are reproducible.
+type ImpairmentFactory func(params map[string]any, seed int64) (Impairment, error)
+
+// impairmentFactories holds the built-in impairments and those registered.
+var impairmentFactories = map[string]ImpairmentFactory{
+	"loss":      newLossFromParams,
+	"latency":   newLatencyFromParams,
+	"bandwidth": newBandwidthFromParams,
+	"corrupt":   newCorruptFromParams,
+	"ecn":       newECNFromParams,
+	"setup":     newSetupFromParams,
+	"truncate":  newTruncateFromParams,
+	"pad":       newPadFromParams,
+	"byteflip":  newByteFlipFromParams,
+	"size":      newSizeFromParams,
+}
+
+// RegisterImpairment makes an impairment available as name in the peers'
+// impairments chains. Register before the config is loaded.
+func RegisterImpairment(name string, f ImpairmentFactory) {
+	if _, dup := impairmentFactories[name]; dup {
+		panic("impairment " + name + " registered twice")
+	}
+	impairmentFactories[name] = f
+}
+
+// impairmentNames lists the registered impairments.
+func impairmentNames() []string {
+	names := make([]string, 0, len(impairmentFactories))
+	for name := range impairmentFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ImpairmentChain applies impairments in order: the delays add up and the
+// first one dropping the packet ends the chain.
+type ImpairmentChain []Impairment
+
+func (c ImpairmentChain) Apply(pkt []byte, dir Direction) (bool, time.Duration, []byte) {
+	var total time.Duration
+	for _, im := range c {
+		forward, delay, out := im.Apply(pkt, dir)
+		if !forward {
+			return false, 0, nil
+		}
+		total += delay
+		pkt = out
+	}
+	return true, total, pkt
+}
+
+// buildImpairmentChain builds a chain from config entries, each naming a
+// registered impairment and carrying its params.
+func buildImpairmentChain(specs []map[string]any, seed int64) (ImpairmentChain, error) {
+	var chain ImpairmentChain
+	for i, spec := range specs {
+		name, _ := spec["name"].(string)
+		f, ok := impairmentFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("impairments[%d]: unknown impairment %q, available: %v", i, name, impairmentNames())
+		}
+		params := make(map[string]any, len(spec))
+		for k, v := range spec {
+			if k != "name" && k != "match" {
+				params[k] = v
+			}
+		}
+		im, err := f(params, seed+int64(i))
+		if err != nil {
+			return nil, fmt.Errorf("impairments[%d] %s: %w", i, name, err)
+		}
+		if match, ok := spec["match"]; ok {
+			m := &matchImpairment{im: im}
+			if err := decodeParams(match, &m.match); err != nil {
+				return nil, fmt.Errorf("impairments[%d] %s: match: %w", i, name, err)
+			}
+			if err := m.match.compile(); err != nil {
+				return nil, fmt.Errorf("impairments[%d] %s: match: %w", i, name, err)
+			}
+			im = m
+		}
+		chain = append(chain, im)
+	}
+	return chain, nil
+}
+
+// matchImpairment only applies im to the packets of the flows matching
+// match, set by the match param every chain entry takes.
+type matchImpairment struct {
+	match FlowMatch
+	im    Impairment
+}
+
+func (m *matchImpairment) Apply(pkt []byte, dir Direction) (bool, time.Duration, []byte) {
+	flow, ok := parseFlowKey(pkt)
+	if !ok || !m.match.match(flow) {
+		return true, 0, pkt
+	}
+	return m.im.Apply(pkt, dir)
+}
+
+// decodeParams decodes params into the struct pointed to by v, accepting
+// durations as strings such as "20ms".
+func decodeParams(params any, v any) error {
+	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		Result:           v,
+	})
+	if err != nil {
+		return err
+	}
+	return dec.Decode(params)
+}
+
+// randImpairment is the base of the built-in impairments making random
+// decisions on the packets of dir.
+type randImpairment struct {
+	dir Direction
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (r *randImpairment) applies(dir Direction) bool { return r.dir&dir != 0 }
+
+type lossImpairment struct {
+	randImpairment
+	prob float64
+}
+
+func newLossImpairment(prob float64, dir Direction, seed int64) *lossImpairment {
+	return &lossImpairment{randImpairment{dir: dir, rng: rand.New(rand.NewSource(seed))}, prob}
+}
+
+func (l *lossImpairment) Apply(pkt []byte, dir Direction) (bool, time.Duration, []byte) {
+	if !l.applies(dir) {
+		return true, 0, pkt
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rng.Float64() >= l.prob, 0, pkt
+}
+
+// latencyImpairment delays every packet by latency plus a uniform random
+// jitter in [-jitter, jitter]; jitter may reorder packets.
+type latencyImpairment struct {
+	randImpairment
+	latency, jitter time.Duration
+}
+
+func newLatencyImpairment(latency, jitter time.Duration, dir Direction, seed int64) *latencyImpairment {
+	return &latencyImpairment{randImpairment{dir: dir, rng: rand.New(rand.NewSource(seed))}, latency, jitter}
+}
+
+func (l *latencyImpairment) Apply(pkt []byte, dir Direction) (bool, time.Duration, []byte) {
+	if !l.applies(dir) {
+		return true, 0, pkt
+	}
+	delay := l.latency
+	if l.jitter > 0 {
+		l.mu.Lock()
+		delay += time.Duration(l.rng.Int63n(int64(2*l.jitter)+1)) - l.jitter
+		l.mu.Unlock()
+	}
+	return true, max(delay, 0), pkt
+}
+
+// bandwidthImpairment models a link of rate bits per second: packets are
+// delayed until the link finished sending those before them, and dropped
+// when that would take longer than queue.
+type bandwidthImpairment struct {
+	dir   Direction
+	rate  float64 // bytes per second
+	queue time.Duration
+	mu    sync.Mutex
+	free  time.Time // when the link is idle again
+}
+
+func (b *bandwidthImpairment) Apply(pkt []byte, dir Direction) (bool, time.Duration, []byte) {
+	if b.dir&dir == 0 {
+		return true, 0, pkt
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := clock.Now()
+	start := now
+	if b.free.After(now) {
+		start = b.free
+	}
+	if wait := start.Sub(now); wait > b.queue {
+		return false, 0, nil
+	}
+	b.free = start.Add(time.Duration(float64(len(pkt)) / b.rate * float64(time.Second)))
+	return true, b.free.Sub(now), pkt
+}
+
+// corruptImpairment flips a random byte of the packet with probability prob.
+type corruptImpairment struct {
+	randImpairment
+	prob float64
+}
+
+func (c *corruptImpairment) Apply(pkt []byte, dir Direction) (bool, time.Duration, []byte) {
+	if !c.applies(dir) || len(pkt) == 0 {
+		return true, 0, pkt
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rng.Float64() >= c.prob {
+		return true, 0, pkt
+	}
+	out := append([]byte(nil), pkt...)
+	out[c.rng.Intn(len(out))] ^= byte(c.rng.Intn(255) + 1)
+	return true, 0, out
+}
+
+// ecnImpairment marks ECN capable packets Congestion Experienced with
+// probability prob.
+type ecnImpairment struct {
+	randImpairment
+	prob float64
+}
+
+func (e *ecnImpairment) Apply(pkt []byte, dir Direction) (bool, time.Duration, []byte) {
+	if !e.applies(dir) {
+		return true, 0, pkt
+	}
+	e.mu.Lock()
+	mark := e.rng.Float64() < e.prob
+	e.mu.Unlock()
+	if !mark {
+		return true, 0, pkt
+	}
+	out := append([]byte(nil), pkt...)
+	if !setIPv4CE(out) {
+		return true, 0, pkt
+	}
+	globalStats.ECNMarked.Add(1)
+	return true, 0, out
+}
+
+// setupImpairment delays and drops only TCP connection setup segments,
+// SYN and optionally SYN-ACK, leaving established flows alone.
+type setupImpairment struct {
+	randImpairment
+	latency, jitter time.Duration
+	loss            float64
+	synAck          bool
+}
+
+func (s *setupImpairment) isSetup(pkt []byte) bool {
+	flags, ok := tcpFlags(pkt)
+	if !ok || flags&tcpFlagSYN == 0 {
+		return false
+	}
+	return flags&tcpFlagACK == 0 || s.synAck
+}
+
+func (s *setupImpairment) Apply(pkt []byte, dir Direction) (bool, time.Duration, []byte) {
+	if !s.applies(dir) || !s.isSetup(pkt) {
+		return true, 0, pkt
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loss > 0 && s.rng.Float64() < s.loss {
+		return false, 0, nil
+	}
+	delay := s.latency
+	if s.jitter > 0 {
+		delay += time.Duration(s.rng.Int63n(int64(2*s.jitter)+1)) - s.jitter
+	}
+	return true, max(delay, 0), pkt
+}
+
+func probability(name string, p float64) error {
+	if p < 0 || p > 1 {
+		return fmt.Errorf("%s %v is not a probability", name, p)
+	}
+	return nil
+}
+
+func newLossFromParams(params map[string]any, seed int64) (Impairment, error) {
+	var conf struct {
+		Probability float64 `mapstructure:"probability"`
+		Direction   string  `mapstructure:"direction"`
+	}
+	if err := decodeParams(params, &conf); err != nil {
+		return nil, err
+	}
+	dir, err := parseDirection(conf.Direction)
+	if err != nil {
+		return nil, err
+	}
+	if err = probability("probability", conf.Probability); err != nil {
+		return nil, err
+	}
+	return newLossImpairment(conf.Probability, dir, seed), nil
+}
+
+func newLatencyFromParams(params map[string]any, seed int64) (Impairment, error) {
+	var conf struct {
+		Latency   time.Duration `mapstructure:"latency"`
+		Jitter    time.Duration `mapstructure:"jitter"`
+		Direction string        `mapstructure:"direction"`
+	}
+	if err := decodeParams(params, &conf); err != nil {
+		return nil, err
+	}
+	dir, err := parseDirection(conf.Direction)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Latency < 0 || conf.Jitter < 0 {
+		return nil, fmt.Errorf("latency and jitter must not be negative")
+	}
+	return newLatencyImpairment(conf.Latency, conf.Jitter, dir, seed), nil
+}
+
+func newBandwidthFromParams(params map[string]any, _ int64) (Impairment, error) {
+	conf := struct {
+		Rate      int64         `mapstructure:"rate"`
+		Queue     time.Duration `mapstructure:"queue"`
+		Direction string        `mapstructure:"direction"`
+	}{Queue: 100 * time.Millisecond}
+	if err := decodeParams(params, &conf); err != nil {
+		return nil, err
+	}
+	dir, err := parseDirection(conf.Direction)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Rate <= 0 || conf.Queue < 0 {
+		return nil, fmt.Errorf("rate must be positive and queue not negative")
+	}
+	return &bandwidthImpairment{dir: dir, rate: float64(conf.Rate) / 8, queue: conf.Queue}, nil
+}
+
+func newCorruptFromParams(params map[string]any, seed int64) (Impairment, error) {
+	var conf struct {
+		Probability float64 `mapstructure:"probability"`
+		Direction   string  `mapstructure:"direction"`
+	}
+	if err := decodeParams(params, &conf); err != nil {
+		return nil, err
+	}
+	dir, err := parseDirection(conf.Direction)
+	if err != nil {
+		return nil, err
+	}
+	if err = probability("probability", conf.Probability); err != nil {
+		return nil, err
+	}
+	return &corruptImpairment{randImpairment{dir: dir, rng: rand.New(rand.NewSource(seed))}, conf.Probability}, nil
+}
+
+func newECNFromParams(params map[string]any, seed int64) (Impairment, error) {
+	var conf struct {
+		Probability float64 `mapstructure:"probability"`
+		Direction   string  `mapstructure:"direction"`
+	}
+	if err := decodeParams(params, &conf); err != nil {
+		return nil, err
+	}
+	dir, err := parseDirection(conf.Direction)
+	if err != nil {
+		return nil, err
+	}
+	if err = probability("probability", conf.Probability); err != nil {
+		return nil, err
+	}
+	return &ecnImpairment{randImpairment{dir: dir, rng: rand.New(rand.NewSource(seed))}, conf.Probability}, nil
+}
+
+func newSetupFromParams(params map[string]any, seed int64) (Impairment, error) {
+	conf := struct {
+		Latency   time.Duration `mapstructure:"latency"`
+		Jitter    time.Duration `mapstructure:"jitter"`
+		Loss      float64       `mapstructure:"loss"`
+		SynAck    bool          `mapstructure:"synack"`
+		Direction string        `mapstructure:"direction"`
+	}{SynAck: true}
+	if err := decodeParams(params, &conf); err != nil {
+		return nil, err
+	}
+	dir, err := parseDirection(conf.Direction)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Latency < 0 || conf.Jitter < 0 {
+		return nil, fmt.Errorf("latency and jitter must not be negative")
+	}
+	if err = probability("loss", conf.Loss); err != nil {
+		return nil, err
+	}
+	return &setupImpairment{
+		randImpairment: randImpairment{dir: dir, rng: rand.New(rand.NewSource(seed))},
+		latency:        conf.Latency,
+		jitter:         conf.Jitter,
+		loss:           conf.Loss,
+		synAck:         conf.SynAck,
+	}, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import "log/slog"
+
+// The impairments of a peer can be switched off at runtime to compare a
+// test against the unimpaired baseline: the impairment chain and wire
+// corruption are bypassed while they stay configured, so switching them
+// back on restores them. Bandwidth limits and outages still apply.
+
+// impaired reports whether the packets to and from p go through its
+// impairment chain.
+func (p *Peer) impaired() bool {
+	return p.impairments != nil && !p.bypass.Load()
+}
+
+// SetImpairments switches the impairments of p on or off.
+func (p *Peer) SetImpairments(on bool) {
+	p.bypass.Store(!on)
+	slog.Info("impairments switched", "vIP", p.vIP, "on", on)
+}
@@ -0,0 +1,81 @@
+package main
+
+import "net/netip"
+
+const (
+	ipv6HeaderLen = 40
+
+	// IPv6 extension headers, RFC 8200
+	ipv6HopByHop   = 0
+	ipv6Routing    = 43
+	ipv6Fragment   = 44
+	ipv6DestOpts   = 60
+	ipv6FragExtLen = 8
+
+	protoICMPv6       = 58
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+	// maxIPv6ExtHeaders bounds the chain walked, longer chains are not
+	// parsed for ports.
+	maxIPv6ExtHeaders = 8
+)
+
+// ipv6Upper walks the extension header chain of an IPv6 packet to the
+// upper-layer header. It returns the upper-layer protocol and header, the
+// number of extension headers skipped and whether one of them was a
+// Fragment header. ok is false if the fixed header is incomplete; a chain
+// that is cut short or too long returns no upper-layer header.
+func ipv6Upper(packet []byte) (proto uint8, l4 []byte, exts int, fragment bool, ok bool) {
+	if len(packet) < ipv6HeaderLen || packet[0]>>4 != 6 {
+		return 0, nil, 0, false, false
+	}
+	next := packet[6]
+	b := packet[ipv6HeaderLen:]
+	for ; exts < maxIPv6ExtHeaders; exts++ {
+		var n int
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOpts:
+			if len(b) < 2 {
+				return next, nil, exts, fragment, true
+			}
+			n = (int(b[1]) + 1) * 8
+		case ipv6Fragment:
+			fragment = true
+			n = ipv6FragExtLen
+		default:
+			return next, b, exts, fragment, true
+		}
+		if len(b) < n {
+			return next, nil, exts, fragment, true
+		}
+		next, b = b[0], b[n:]
+	}
+	return next, nil, exts, fragment, true
+}
+
+// parseIPv6FlowKey extracts the 5-tuple of an IPv6 packet from the real
+// upper-layer header. Fragments are keyed without ports: only the first
+// fragment carries them, and all of them have to take one path.
+func parseIPv6FlowKey(packet []byte) (FlowKey, bool) {
+	proto, l4, _, fragment, ok := ipv6Upper(packet)
+	if !ok {
+		return FlowKey{}, false
+	}
+	k := FlowKey{
+		Src:   netip.AddrFrom16([16]byte(packet[8:24])),
+		Dst:   netip.AddrFrom16([16]byte(packet[24:40])),
+		Proto: proto,
+	}
+	if !fragment {
+		k.parseL4(l4)
+	}
+	return k, true
+}
+
+// countIPv6ExtHeaders counts packet in the stats if it is an IPv6 packet
+// with extension headers.
+func countIPv6ExtHeaders(packet []byte) {
+	if _, _, exts, _, ok := ipv6Upper(packet); ok && exts > 0 {
+		globalStats.IPv6ExtHeaders.Add(1)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutageConfig takes the link to a peer down at At after startup, read
+// from "outages". Unlike draining the outage is abrupt: every packet to
+// and from the peer is dropped until the link comes back up after
+// Duration, 0 keeps it down. Teardown closes the connection too and holds
+// off reconnecting, without it the connection stays up but silent.
+type OutageConfig struct {
+	Peer     string        `mapstructure:"peer"`
+	At       time.Duration `mapstructure:"at"`
+	Duration time.Duration `mapstructure:"duration"`
+	Teardown bool          `mapstructure:"teardown"`
+}
+
+var outageConfigs []OutageConfig
+
+func validateOutages(outages []OutageConfig) error {
+	for i, oc := range outages {
+		if net.ParseIP(oc.Peer) == nil {
+			return fmt.Errorf("outages[%d]: invalid peer %q", i, oc.Peer)
+		}
+		if oc.At < 0 || oc.Duration < 0 {
+			return fmt.Errorf("outages[%d]: at and duration must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// linkState is the simulated state of the link to a peer, up by default.
+type linkState struct {
+	down atomic.Bool
+	// teardown asks connectPeer to close the connection
+	teardown chan struct{}
+
+	mu sync.Mutex
+	// torn is set while a down link also keeps the peer disconnected, up
+	// is closed when the link comes back up
+	torn bool
+	up   chan struct{}
+}
+
+func (l *linkState) isDown() bool { return l.down.Load() }
+
+func (l *linkState) String() string {
+	if l.isDown() {
+		return "down"
+	}
+	return "up"
+}
+
+// setDown takes the link down, with teardown also closing the connection.
+func (l *linkState) setDown(teardown bool) {
+	l.mu.Lock()
+	if !l.down.Load() {
+		l.up = make(chan struct{})
+		l.down.Store(true)
+	}
+	l.torn = l.torn || teardown
+	l.mu.Unlock()
+	if teardown {
+		select {
+		case l.teardown <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// setUp restores the link and lets a torn down peer reconnect.
+func (l *linkState) setUp() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.down.Load() {
+		l.down.Store(false)
+		l.torn = false
+		close(l.up)
+	}
+	// a teardown connectPeer did not get to is void now
+	select {
+	case <-l.teardown:
+	default:
+	}
+}
+
+// tornDown returns whether the peer must stay disconnected and the channel
+// closed once it may reconnect.
+func (l *linkState) tornDown() (<-chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.up, l.torn
+}
+
+// SetLink takes the link to the peer down or brings it back up.
+func (p *Peer) SetLink(up, teardown bool) {
+	if up {
+		p.link.setUp()
+	} else {
+		p.link.setDown(teardown)
+	}
+	slog.Info("link state changed", "vIP", p.vIP, "link", p.link.String(), "teardown", teardown && !up)
+}
+
+// runOutages plays the configured outages until ctx is done. The peer is
+// looked up when the outage starts, so it may be added by a reload.
+func runOutages(ctx context.Context) {
+	for _, oc := range outageConfigs {
+		go func(oc OutageConfig) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-clock.After(oc.At):
+			}
+			vIP := net.ParseIP(oc.Peer)
+			p, ok := peerTable.Get(vIP)
+			if !ok {
+				slog.Warn("outage of unknown peer", "vIP", vIP)
+				return
+			}
+			p.SetLink(false, oc.Teardown)
+			if oc.Duration == 0 {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-clock.After(oc.Duration):
+			}
+			p.SetLink(true, false)
+		}(oc)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	TransportQUIC = "quic"
+	// TransportTCP is TLS over TCP, one connection carries one stream of frames.
+	TransportTCP = "tcp"
+)
+
+// ListenerConfig is one endpoint the server accepts peers on, read from the
+// "listeners" list.
+type ListenerConfig struct {
+	Transport string `mapstructure:"transport"`
+	Addr      string `mapstructure:"addr"`
+	// Device writes the packets of the connections the listener accepted
+	// to this tun device instead of the one their destination belongs to,
+	// so every device can have a link of its own.
+	Device string `mapstructure:"device"`
+}
+
+func (lc ListenerConfig) String() string { return lc.Transport + "://" + lc.Addr }
+
+var listenerConfigs = []ListenerConfig{{Transport: TransportQUIC, Addr: lAddr}}
+
+func validateListeners(listeners []ListenerConfig) error {
+	if len(listeners) == 0 {
+		return fmt.Errorf("listeners: at least one listener is needed")
+	}
+	// QUIC listens on UDP, the others on TCP
+	ports := make(map[string]int)
+	for i, lc := range listeners {
+		if lc.Transport != TransportQUIC && lc.Transport != TransportTCP && lc.Transport != TransportWebSocket {
+			return fmt.Errorf("listeners[%d]: unknown transport %q", i, lc.Transport)
+		}
+		_, port, err := net.SplitHostPort(lc.Addr)
+		if err != nil {
+			return fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+		if port == "0" {
+			continue
+		}
+		key := "tcp/" + port
+		if lc.Transport == TransportQUIC {
+			key = "udp/" + port
+		}
+		if j, ok := ports[key]; ok {
+			return fmt.Errorf("listeners[%d]: port %s is taken by listeners[%d]", i, port, j)
+		}
+		ports[key] = i
+	}
+	return nil
+}
+
+// ListenerStats counts the connections of one listener.
+type ListenerStats struct {
+	Transport string
+	Addr      string
+	Device    string
+	// Connections counts every accepted connection, Active the open ones
+	// and Rejected those from clients not in the allowlist.
+	Connections atomic.Uint64
+	Active      atomic.Int64
+	Rejected    atomic.Uint64
+
+	// index is the position of the listener in "listeners".
+	index int
+	// bound is closed once the listener is bound to boundAddr, which
+	// differs from Addr for port 0, or binding failed with bindErr.
+	bound     chan struct{}
+	boundOnce sync.Once
+	boundAddr net.Addr
+	bindErr   error
+	// done is closed once the listener stopped
+	done chan struct{}
+}
+
+func newListenerStats(i int, lc ListenerConfig) *ListenerStats {
+	return &ListenerStats{Transport: lc.Transport, Addr: lc.Addr, Device: lc.Device, index: i, bound: make(chan struct{}), done: make(chan struct{})}
+}
+
+// device returns the tun device the connections of the listener write to,
+// nil to write every packet to the device of its destination.
+func (s *ListenerStats) device() *TunDevice {
+	if s.Device == "" {
+		return nil
+	}
+	dev := deviceByName(s.Device)
+	if dev == nil {
+		slog.Warn("device of listener is not up, write to the device of the destination", "listener", s.Transport+"://"+s.Addr, "device", s.Device)
+	}
+	return dev
+}
+
+// setBound records the address the listener is bound to, once.
+func (s *ListenerStats) setBound(addr net.Addr) {
+	s.boundOnce.Do(func() {
+		s.boundAddr = addr
+		close(s.bound)
+	})
+	slog.Info("listening", "transport", s.Transport, "addr", addr.String())
+}
+
+// stopped records that the listener returned with err, which failed
+// binding it unless it was bound before.
+func (s *ListenerStats) stopped(err error) {
+	s.boundOnce.Do(func() {
+		s.bindErr = err
+		if err == nil {
+			s.bindErr = errors.New("listener stopped")
+		}
+		close(s.bound)
+	})
+	close(s.done)
+}
+
+// BoundAddr returns the address the listener is bound to, nil until it is.
+func (s *ListenerStats) BoundAddr() net.Addr {
+	select {
+	case <-s.bound:
+		return s.boundAddr
+	default:
+		return nil
+	}
+}
+
+func (s *ListenerStats) accepted() {
+	s.Connections.Add(1)
+	s.Active.Add(1)
+}
+
+func (s *ListenerStats) closed() { s.Active.Add(-1) }
+
+// listenerStats holds the *ListenerStats of every listener by its index in
+// "listeners", as listeners on port 0 may share one String.
+var listenerStats sync.Map
+
+// ListenAddrs waits until every configured listener of the running server
+// is bound and returns their addresses in the order of "listeners", e.g.
+// to find the ports the OS picked for listeners on port 0.
+func ListenAddrs(ctx context.Context) ([]net.Addr, error) {
+	addrs := make([]net.Addr, 0, len(listenerConfigs))
+	for i, lc := range listenerConfigs {
+		v, ok := listenerStats.Load(i)
+		if !ok {
+			return nil, fmt.Errorf("listener %s is not running", lc.String())
+		}
+		s := v.(*ListenerStats)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("listener %s: %w", lc.String(), ctx.Err())
+		case <-s.bound:
+		}
+		if s.boundAddr == nil {
+			return nil, fmt.Errorf("listener %s: %w", lc.String(), s.bindErr)
+		}
+		addrs = append(addrs, s.boundAddr)
+	}
+	return addrs, nil
+}
+
+// logClientIdentity logs the certificate identity of an mTLS client.
+func logClientIdentity(remote net.Addr, state tls.ConnectionState) {
+	if !mtlsConfig.Enable || len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	peer, _ := clientPeer(cert)
+	slog.Info("accept authenticated client", "remote", remote.String(), "identity", certIdentity(cert), "peer", peer)
+}
+
+// serveTCP accepts TLS over TCP connections on addr.
+func serveTCP(ctx context.Context, addr string, stats *ListenerStats) error {
+	tlsConf, err := generateTLSConfig()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	OnShutdown(PhaseAccept, "tcp "+addr, func() error {
+		ln.Close()
+		return nil
+	})
+	stats.setBound(ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		if draining.Load() || !allowed(conn.RemoteAddr(), stats) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			stats.accepted()
+			defer stats.closed()
+			defer serverConns.add(func(string) { conn.Close() })()
+			handleTCPConn(ctx, conn, tlsConf, stats.device())
+		}()
+	}
+}
+
+func handleTCPConn(ctx context.Context, conn net.Conn, tlsConf *tls.Config, dev *TunDevice) {
+	defer conn.Close()
+	rIP := conn.RemoteAddr().String()
+	// a proxy in front of a TCP listener sends its header before TLS
+	if proxyProtocol {
+		addr, err := readProxyHeader(conn)
+		if err != nil {
+			slog.Error("reject connection", "remote", rIP, "err", err)
+			return
+		}
+		if addr != nil {
+			slog.Info("proxied connection", "proxy", rIP, "client", addr.String())
+			rIP = addr.String()
+		}
+	}
+	tlsConn := tls.Server(conn, tlsConf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		slog.Error("tls handshake failed", "remote", rIP, "err", err)
+		return
+	}
+	logClientIdentity(conn.RemoteAddr(), tlsConn.ConnectionState())
+	serveStream(ctx, tcpStream{tlsConn}, rIP, dev)
+}
+
+// serverStream is a stream of frames from a client, whatever its transport.
+type serverStream interface {
+	io.ReadWriter
+	SetReadDeadline(t time.Time) error
+	// closeConn closes the connection the stream belongs to.
+	closeConn(reason string)
+}
+
+type quicStream struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (s quicStream) closeConn(reason string) { s.conn.CloseWithError(0, reason) }
+
+type tcpStream struct {
+	*tls.Conn
+}
+
+func (s tcpStream) closeConn(string) { s.Close() }
+
+// serveStream writes the packets of the frames read from s to dev, or the
+// tun devices of their destinations if nil, until s fails. Packets are written in stream order as they arrive:
+// frames carry no sequence number, so there is no resequencing and nothing
+// is held back waiting for a missing packet.
+func serveStream(ctx context.Context, s serverStream, rIP string, dev *TunDevice) {
+	buf := make([]byte, BUFSIZE)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		if deadPeerConfig.enabled() {
+			s.SetReadDeadline(time.Now().Add(deadPeerConfig.deadline()))
+		}
+		n, err := readFrame(s, buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			slog.Warn("peer dead, close connection", "rIP", rIP, "silence", deadPeerConfig.deadline())
+			s.closeConn("dead peer")
+			return
+		}
+		var streamErr *quic.StreamError
+		if errors.As(err, &streamErr) {
+			// the other streams of the connection carry on
+			globalStats.StreamResets.Add(1)
+			slog.Info("stream reset by client", "rIP", rIP, "err", err)
+			return
+		}
+		if err != nil {
+			slog.Error(err.Error())
+			return
+		}
+		if n == 0 {
+			// keepalive, echo it so the client knows we are alive
+			if _, err = s.Write(keepaliveFrame); err != nil {
+				slog.Error(err.Error())
+				return
+			}
+			continue
+		}
+		if !receivePacket(buf[:n], rIP, dev) {
+			return
+		}
+	}
+}
+
+// receivePacket writes a packet received from a client at rIP to its tun
+// device, it reports false if the client's stream should be given up.
+// packet may be reused once it returns. dev is the device of the listener
+// the client connected to, nil if it has none.
+func receivePacket(packet []byte, rIP string, dev *TunDevice) bool {
+	hops, packet := splitRelayHeader(packet)
+	if isGeneratedPacket(packet) {
+		globalStats.GenRxPackets.Add(1)
+		globalStats.GenRxBytes.Add(uint64(len(packet)))
+		return true
+	}
+	flow, ok := parseFlowKey(packet)
+	if !ok {
+		return receivePassthrough(packet, rIP)
+	}
+	src, dst := net.IP(flow.Src.AsSlice()), net.IP(flow.Dst.AsSlice())
+	slog.Info("receive message", "rIP", rIP, "vIP", src)
+	p, known := peerTable.Get(src)
+	if known {
+		if p.link.isDown() {
+			p.stats.OutageDrops.Add(1)
+			logAccess(DirIngress, packet, p.vIP, "link down")
+			return true
+		}
+		p.rxRate.add(len(packet))
+		p.idle.active()
+		if dev != nil {
+			// the delayed and rate limited packets follow
+			p.rxDevice.Store(dev)
+		}
+		p.stats.RxPackets.Add(1)
+		p.stats.RxBytes.Add(uint64(len(packet)))
+	}
+	// relayed packets take the impairments of the next hop instead
+	if relayPacket(packet, hops, flow) {
+		return true
+	}
+	span := startPacketSpan("ingress", packet)
+	span.event("received")
+	span.attr("remote", rIP)
+	dumpPacket("ingress received", packet)
+	if known && p.impaired() {
+		forward, delay, out := p.impairments.Apply(packet, DirIngress)
+		span.event("impaired")
+		if forward {
+			dumpPacket("ingress impaired", out)
+		}
+		if !forward {
+			p.stats.ImpairDrops.Add(1)
+			span.attr("drop", "impairment")
+			span.end()
+			logAccess(DirIngress, packet, p.vIP, "impairment")
+			return true
+		}
+		if delay > 0 {
+			logAccess(DirIngress, out, p.vIP, "")
+			// packet is reused by the next read
+			p.ingressDelay.push(append([]byte(nil), out...), delay)
+			span.attr("delay", delay.String())
+			span.end()
+			return true
+		}
+		packet = out
+	}
+	var peer net.IP
+	if known {
+		peer = p.vIP
+	}
+	if known && p.rxShaper != nil {
+		logAccess(DirIngress, packet, peer, "")
+		// packet is reused by the next read
+		p.receive(append([]byte(nil), packet...))
+		span.event("queued")
+		span.end()
+		return true
+	}
+	if dev == nil {
+		dev, _ = devTable.Get(dst)
+	}
+	if dev == nil {
+		slog.Error("can not find channel", "vIP", dst)
+		span.attr("drop", "no device")
+		logAccess(DirIngress, packet, peer, "no device")
+		span.end()
+		return false
+	}
+	logAccess(DirIngress, packet, peer, "")
+	err := writeMessage(dev, packet)
+	span.event("written")
+	span.end()
+	if err != nil {
+		slog.Error(err.Error())
+		return false
+	}
+	return true
+}
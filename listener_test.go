@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// stopServer cancels the context of the server and peers a test started,
+// removes the peers and waits until the listeners and the peers, stopped
+// ones in peers too, returned, so they do not read the config the next test
+// applies.
+func stopServer(cancel context.CancelFunc, peers ...*Peer) {
+	cancel()
+	listenerStats.Range(func(_, value any) bool {
+		<-value.(*ListenerStats).done
+		return true
+	})
+	peerTable.Range(func(p *Peer) bool {
+		peers = append(peers, p)
+		return true
+	})
+	for _, p := range peers {
+		stopPeer(p)
+		<-p.dialed
+	}
+}
+
+// runListeners runs the server on listeners until the test ends.
+func runListeners(t *testing.T, listeners []ListenerConfig) context.Context {
+	t.Helper()
+	old := listenerConfigs
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(func() {
+		stopServer(cancel)
+		listenerConfigs = old
+	})
+	listenerConfigs = listeners
+	runServer(ctx, make(chan struct{}, len(listeners)))
+	return ctx
+}
+
+func TestListenAddrsPortZero(t *testing.T) {
+	ctx := runListeners(t, []ListenerConfig{
+		{Transport: TransportQUIC, Addr: "127.0.0.1:0"},
+		{Transport: TransportQUIC, Addr: "127.0.0.1:0"},
+		{Transport: TransportTCP, Addr: "127.0.0.1:0"},
+	})
+	addrs, err := ListenAddrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 3 || addrs[0].String() == addrs[1].String() {
+		t.Fatalf("ListenAddrs = %v, want three listeners on distinct ports", addrs)
+	}
+	if got := len(statsSnapshot().Listeners); got != 3 {
+		t.Fatalf("stats report %d listeners, want 3", got)
+	}
+}
+
+func TestListenAddrsBindFailure(t *testing.T) {
+	// not an address of this host
+	ctx := runListeners(t, []ListenerConfig{{Transport: TransportTCP, Addr: "192.0.2.1:0"}})
+	if _, err := ListenAddrs(ctx); err == nil || ctx.Err() != nil {
+		t.Fatalf("ListenAddrs = %v, want the bind error before the timeout", err)
+	}
+}
+
+// TestIPv6RoundTrip sends an IPv6 packet over the loopback peer and checks
+// the server writes it to the device of its destination.
+func TestIPv6RoundTrip(t *testing.T) {
+	got := startLoopback(t, "")
+	pkt := make([]byte, 40+8+10)
+	pkt[0] = 6 << 4
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(pkt)-40))
+	pkt[6] = protoUDP
+	pkt[7] = 64
+	copy(pkt[8:24], net.ParseIP("fd00:1::1"))
+	copy(pkt[24:40], net.ParseIP("fd00:1::2"))
+	binary.BigEndian.PutUint16(pkt[40:42], 40000)
+	binary.BigEndian.PutUint16(pkt[42:44], 9)
+	binary.BigEndian.PutUint16(pkt[44:46], uint16(len(pkt)-40))
+	if err := InjectPacket("lo6-src", pkt); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case out := <-got:
+		if !bytes.Equal(out, pkt) {
+			t.Fatalf("delivered %x, want %x", out, pkt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("IPv6 packet not delivered")
+	}
+}
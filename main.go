@@ -2,335 +2,1094 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
+	"errors"
 	"flag"
+	"fmt"
 	"gitee.com/czy_hit/softbus-go/net/tun"
-	"gitee.com/czy_hit/softbus-go/util/iptool"
-	"github.com/gookit/config/v2"
-	"github.com/gookit/config/v2/yamlv3"
 	"github.com/quic-go/quic-go"
 	"log/slog"
-	"math/big"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
-	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
-	lAddr   = "0.0.0.0:2345"
-	BUFSIZE = 4096
+	lPort     = "2345"
+	lAddr     = "0.0.0.0:" + lPort
+	BUFSIZE   = 4096
+	alpnProto = "quic-echo-example"
 )
 
 type TunDevice struct {
 	name   string
 	device tun.Device
 	ip     string
+	mask   net.IPMask
+	// writer batches writes to device, nil writes every packet directly
+	writer *batchWriter
+	// vlan strips and restores 802.1Q tags, nil if not configured
+	vlan *vlanState
+	// read and written count the packets read from and written to device
+	read, written atomic.Uint64
+	// rpf filters the sources of the packets read, nil if not configured
+	rpf *rpfFilter
 }
 
+// The tables are keyed by the string form of the virtual IP, net.IP itself
+// is a slice and can not be used as a map key.
 type IPTable sync.Map
 
 func (t *IPTable) Add(vIP, rIP net.IP) {
-	(*sync.Map)(t).Store(vIP, rIP)
+	(*sync.Map)(t).Store(vIP.String(), rIP)
 }
 
 func (t *IPTable) Get(vIP net.IP) (net.IP, bool) {
-	rIP, ok := (*sync.Map)(t).Load(vIP)
-	return rIP.(net.IP), ok
+	rIP, ok := (*sync.Map)(t).Load(vIP.String())
+	if !ok {
+		return nil, false
+	}
+	return rIP.(net.IP), true
+}
+
+func (t *IPTable) Delete(vIP net.IP) {
+	(*sync.Map)(t).Delete(vIP.String())
 }
 
 type ChanTable sync.Map
 
 func (t *ChanTable) Add(vIP net.IP, ch chan []byte) {
-	(*sync.Map)(t).Store(vIP, ch)
+	(*sync.Map)(t).Store(vIP.String(), ch)
 }
 func (t *ChanTable) Get(vIP net.IP) (chan []byte, bool) {
-	ch, ok := (*sync.Map)(t).Load(vIP)
-	return ch.(chan []byte), ok
+	ch, ok := (*sync.Map)(t).Load(vIP.String())
+	if !ok {
+		return nil, false
+	}
+	return ch.(chan []byte), true
+}
+
+func (t *ChanTable) Delete(vIP net.IP) {
+	(*sync.Map)(t).Delete(vIP.String())
 }
 
 type DevTable sync.Map
 
 func (t *DevTable) Add(vIP net.IP, dev *TunDevice) {
-	(*sync.Map)(t).Store(vIP, dev)
+	(*sync.Map)(t).Store(vIP.String(), dev)
 }
 
 func (t *DevTable) Get(vIP net.IP) (*TunDevice, bool) {
-	dev, ok := (*sync.Map)(t).Load(vIP)
-	return dev.(*TunDevice), ok
+	dev, ok := (*sync.Map)(t).Load(vIP.String())
+	if !ok {
+		return nil, false
+	}
+	return dev.(*TunDevice), true
 }
 
-var iptable *IPTable     // virtual ip -> real ip
-var chanTable *ChanTable // virtual IP -> channel(quic client)
-var devTable *DevTable   // virtual IP -> tun device
+var iptable = new(IPTable)     // virtual ip -> real ip
+var chanTable = new(ChanTable) // virtual IP -> channel(quic client)
+var devTable = new(DevTable)   // virtual IP -> tun device
 
 var tunName = []string{"mptest-1", "mptest-2"}
-var tunIPPrefix string
+var tunCIDR string
+
+// configURIs are the --config sources, merged in order
+var configURIs configList
+var configFallback string
+var configWatch time.Duration
+var requireRoutes bool
 var tunIfaceNum = 2
-var tunInterface []*TunDevice
 
-func init() {
-	config.WithOptions(config.ParseEnv)
-	config.AddDriver(yamlv3.Driver)
-	err := config.LoadFiles("config_example.yaml")
-	if err != nil {
-		panic(err)
+// tunInterface are the tun devices up in the order they were started,
+// replaced rather than changed in place under tunInterfaceMu.
+var (
+	tunInterfaceMu sync.RWMutex
+	tunInterface   []*TunDevice
+)
+
+// proxyProtocol makes the server expect a PROXY protocol v2 header at the
+// start of every stream, e.g. when running behind a load balancer.
+var proxyProtocol bool
+
+// markDSCP is stamped on every packet written to a tun device so downstream
+// analyzers can tell simulator traffic apart, -1 leaves packets untouched.
+var markDSCP = -1
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "devices" {
+		if err := runDevicesCmd(os.Args[2:]); err != nil {
+			slog.Error("devices failed", "err", err)
+			os.Exit(1)
+		}
+		return
 	}
-	ipt := config.StringMap("map1")
-	for k, v := range ipt {
-		iptable.Add(net.ParseIP(k), net.ParseIP(v))
+	if len(os.Args) > 1 && os.Args[1] == "gen-config" {
+		if err := runGenConfigCmd(os.Args[2:]); err != nil {
+			slog.Error("gen-config failed", "err", err)
+			os.Exit(1)
+		}
+		return
 	}
-}
 
-func main() {
-	flag.StringVar(&tunIPPrefix, "prefix", "10.0.0.", "tun ip prefix")
+	flag.StringVar(&tunCIDR, "cidr", "10.0.0.0/24", "subnet the tun interface addresses are allocated from")
+	flag.Var(&configURIs, "config", "config file, http(s):// url or etcd://host:port/key, repeat it to merge several with later ones overriding earlier ones (default config_example.yaml)")
+	flag.StringVar(&configFallback, "config-fallback", "", "local config file used when the config source is unreachable at startup")
+	flag.StringVar(&adminAddr, "admin", "", "serve the admin api on this address, empty disables it")
+	flag.DurationVar(&configWatch, "config-watch", 0, "poll the config source for changes at this interval, 0 only reloads on SIGHUP")
+	flag.BoolVar(&gracefulRestart, "graceful-restart", false, "on SIGUSR2 hand the listen socket to a new process and exit")
+	flag.BoolVar(&requireRoutes, "require-routes", false, "fail instead of warning when map1 has no routes")
+	flag.BoolVar(&selfTestEnabled, "self-test", false, "check a loopback connection works before starting")
+	flag.StringVar(&scenarioFile, "scenario", "", "run the timed steps of this yaml or json scenario, then exit, with status 1 if a step or assertion failed")
+	flag.Parse()
+	if len(configURIs) == 0 {
+		configURIs = configList{"config_example.yaml"}
+	}
 
+	tunAddrs, err := allocTunAddrs(tunCIDR, tunIfaceNum)
+	if err != nil {
+		slog.Error("allocate tun addresses failed", "err", err)
+		return
+	}
+
+	// runs after the deferred Close
+	scenarioPassed := true
+	defer func() {
+		if !scenarioPassed {
+			os.Exit(1)
+		}
+	}()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	defer Close()
+
+	src, loaded, err := LoadConfig(ctx, configURIs, configFallback)
+	if err != nil {
+		slog.Error("load config failed", "source", configURIs.String(), "err", err)
+		return
+	}
+
+	var scenario *Scenario
+	if scenarioFile != "" {
+		if scenario, err = loadScenario(scenarioFile); err != nil {
+			slog.Error("load scenario failed", "file", scenarioFile, "err", err)
+			scenarioPassed = false
+			return
+		}
+	}
+
+	if selfTestEnabled {
+		if err = selfTest(ctx); err != nil {
+			slog.Error("self test failed", "err", err)
+			return
+		}
+		slog.Info("self test passed")
+	}
+
+	if accessLogConfig.File != "" {
+		if accessLog, err = newAccessLogWriter(accessLogConfig, impairmentSeed+1); err != nil {
+			slog.Error("open access log failed", "file", accessLogConfig.File, "err", err)
+			return
+		}
+		OnShutdown(PhaseServer, "access log", accessLog.Close)
+	}
+
+	if captureConfig.File != "" {
+		if capture, err = newPCAPWriter(captureConfig, impairmentSeed); err != nil {
+			slog.Error("open capture failed", "file", captureConfig.File, "err", err)
+			return
+		}
+		OnShutdown(PhaseServer, "capture", capture.Close)
+	}
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
+	// runs before the deferred Close
+	defer forceExitOnInterrupt(interrupt, cancel)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go watchConfig(ctx, src, configWatch, loaded, hup)
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	usr2 := make(chan os.Signal, 1)
+	if gracefulRestart {
+		signal.Notify(usr2, syscall.SIGUSR2)
+	}
+
+	OnShutdown(PhaseDrain, "peer queues", func() error { return drainPeers(drainTimeout) })
+	OnShutdown(PhaseTransport, "peers", func() error {
+		cancel()
+		return nil
+	})
 
+	if !waitStartupDelay(ctx, interrupt) {
+		return
+	}
 	errChan := make(chan struct{})
-	go runServer(ctx, errChan)
-	runClinet(ctx)
+	slog.Info("starting", "role", role)
+	logQUICInfo()
+	if runsServer() {
+		go runServer(ctx, errChan)
+	}
+	if runsClient() {
+		runClinet(ctx)
+	}
 
+	waitForParent()
 	for i := 0; i < tunIfaceNum; i++ {
-		dev, name, err := tun.NewWater(tunName[i])
+		dev, err := setupDevice(tunName[i], tunAddrs[i])
 		if err != nil {
-			slog.Error("create new tun device failed", err)
+			slog.Error(err.Error())
+			continue
 		}
-		tunInterface = append(tunInterface, &TunDevice{name: name, device: dev, ip: tunIPPrefix + strconv.Itoa(i)})
-		err = tun.SetupIfce(net.IPNet{
-			IP:   net.ParseIP(tunInterface[i].ip),
-			Mask: net.IPv4Mask(255, 255, 255, 0),
-		}, name)
-		if err != nil {
-			slog.Error("setup tun device failed", err)
-		}
-		devTable.Add(net.ParseIP(tunInterface[i].ip), tunInterface[i])
-		go func(dev tun.Device) {
-			readMessage(ctx, dev, func(vIP net.IP, buf []byte) {
-				if ch, ok := chanTable.Get(vIP); ok {
-					ch <- buf
-				} else {
-					slog.Error("can not find channel for ", vIP)
-				}
+		startDevice(ctx, dev)
+		OnShutdown(PhaseInterface, "tun "+dev.name, func() error {
+			tun.DownIfce(dev.name)
+			return dev.device.Close()
+		})
+	}
 
-			})
-		}(dev)
-		defer func() {
-			tun.DownIfce(name)
-		}()
+	startTracing(ctx)
+	if err := startStatsExport(ctx); err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	go flowTable.runSweeper(ctx, flowConfig)
+	runBottlenecks(ctx)
+	runOutages(ctx)
+	var scenarioDone chan bool
+	if scenario != nil {
+		scenarioDone = make(chan bool, 1)
+		go func() { scenarioDone <- runScenario(ctx, scenario) }()
+	}
+	go runAggregate(ctx)
+	go runWarmup(ctx)
+	go runIdleSweeper(ctx)
+	if adminAddr != "" {
+		go runAdmin(adminAddr)
+	}
+	if generatorConfig.Enable {
+		if !generatorConfig.source.IsValid() {
+			generatorConfig.source, _ = netip.AddrFromSlice(tunAddrs[0].IP.To4())
+		}
+		go runGenerator(ctx, generatorConfig)
 	}
 
-	select {
-	case s := <-interrupt:
-		slog.Info("interrupt by ", s)
-	case <-ctx.Done():
-		slog.Info("ctx done")
-	case <-errChan:
-		slog.Error("error occur")
+	for {
+		select {
+		case s := <-interrupt:
+			slog.Info("interrupt", "signal", s)
+			return
+		case <-ctx.Done():
+			slog.Info("ctx done")
+			return
+		case <-errChan:
+			slog.Error("error occur")
+			return
+		case <-usr1:
+			Drain()
+		case <-drained:
+			return
+		case scenarioPassed = <-scenarioDone:
+			return
+		case <-usr2:
+			if err := restart(); err != nil {
+				slog.Error("graceful restart failed", "err", err)
+				continue
+			}
+			return
+		}
+	}
+}
+
+// setupDevice creates the tun device name and assigns it addr.
+func setupDevice(name string, addr net.IPNet) (*TunDevice, error) {
+	dev, ifname, err := tun.NewWater(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: create %s: %w", ErrDeviceSetup, name, err)
+	}
+	if err = tun.SetupIfce(addr, ifname); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("%w: assign %s to %s: %w", ErrDeviceSetup, addr.String(), ifname, err)
+	}
+	return &TunDevice{name: ifname, device: dev, ip: addr.IP.String(), mask: addr.Mask, vlan: newVLANState(ifname)}, nil
+}
+
+// startDevice routes dev's address to it and forwards what is read from it
+// until ctx is done.
+func startDevice(ctx context.Context, dev *TunDevice) {
+	tunInterfaceMu.Lock()
+	tunInterface = append(tunInterface[:len(tunInterface):len(tunInterface)], dev)
+	tunInterfaceMu.Unlock()
+	dev.rpf = newRPFFilter(dev)
+	if tunWriteConfig.queued() {
+		dev.writer = newBatchWriter(dev.device, tunWriteConfig)
+		go dev.writer.run(ctx)
+	}
+	devTable.Add(net.ParseIP(dev.ip), dev)
+	go readMessage(ctx, dev, sendToPeer)
+}
+
+// stopDevice drops the stopped dev from the devices up.
+func stopDevice(dev *TunDevice) {
+	tunInterfaceMu.Lock()
+	defer tunInterfaceMu.Unlock()
+	devs := make([]*TunDevice, 0, len(tunInterface))
+	for _, d := range tunInterface {
+		if d != dev {
+			devs = append(devs, d)
+		}
 	}
+	tunInterface = devs
+	(*sync.Map)(devTable).CompareAndDelete(dev.ip, dev)
+}
+
+// tunDevices returns the tun devices up.
+func tunDevices() []*TunDevice {
+	tunInterfaceMu.RLock()
+	defer tunInterfaceMu.RUnlock()
+	return tunInterface
 }
 
-func readMessage(ctx context.Context, dev tun.Device, send func(rIP net.IP, buf []byte)) {
+// deviceByName returns the tun device name, nil if it is not up.
+func deviceByName(name string) *TunDevice {
+	for _, dev := range tunDevices() {
+		if dev.name == name {
+			return dev
+		}
+	}
+	return nil
+}
+
+// lookupPeer returns the peer routed for vIP.
+func lookupPeer(vIP net.IP) (*Peer, error) {
+	p, ok := peerTable.Get(vIP)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRouteNotFound, vIP)
+	}
+	if _, ok := chanTable.Get(vIP); !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRouteNotFound, vIP)
+	}
+	return p, nil
+}
+
+// sendToPeer hands a packet read from a tun device to the peer owning vIP.
+func sendToPeer(vIP net.IP, buf []byte) {
+	if Paused() && gate.hold(buf, func(pkt []byte) { forwardToPeer(vIP, pkt) }) {
+		return
+	}
+	forwardToPeer(vIP, buf)
+}
+
+func forwardToPeer(vIP net.IP, buf []byte) {
+	forwardRelayed(vIP, buf, 0)
+}
+
+// forwardRelayed forwards buf to the peer owning vIP like forwardToPeer,
+// behind a relay header of hops if it is relayed.
+func forwardRelayed(vIP net.IP, buf []byte, hops int) {
+	span := startPacketSpan("egress", buf)
+	defer span.end()
+	span.event("read")
+	span.attr("peer", vIP.String())
+	p, err := lookupPeer(vIP)
+	if err != nil {
+		if pendingRoutes.hold(vIP, buf, hops) {
+			span.attr("pending", "no route")
+			return
+		}
+		slog.Error("can not find channel", "vIP", vIP, "err", err)
+		span.attr("drop", "no route")
+		logAccess(DirEgress, buf, vIP, "no route")
+		return
+	}
+	if p.breaker.Open() {
+		p.stats.BreakerDrops.Add(1)
+		span.attr("drop", "breaker open")
+		logAccess(DirEgress, buf, vIP, "breaker open")
+		return
+	}
+	if p.link.isDown() {
+		p.stats.OutageDrops.Add(1)
+		span.attr("drop", "link down")
+		logAccess(DirEgress, buf, vIP, "link down")
+		return
+	}
+	p.idle.active()
+	// buf is reused by the next read, the queue needs its own copy
+	pkt := append([]byte(nil), buf...)
+	clampMSS(pkt)
+	p.stats.TxPackets.Add(1)
+	p.stats.TxBytes.Add(uint64(len(pkt)))
+	p.txRate.add(len(pkt))
+	dumpPacket("egress read", pkt)
+	if p.impaired() {
+		forward, delay, out := p.impairments.Apply(pkt, DirEgress)
+		capturePacket(pkt, !forward || delay > 0)
+		if forward {
+			dumpPacket("egress impaired", out)
+		}
+		span.event("impaired")
+		if !forward {
+			p.stats.ImpairDrops.Add(1)
+			span.attr("drop", "impairment")
+			logAccess(DirEgress, pkt, vIP, "impairment")
+			return
+		}
+		logAccess(DirEgress, out, vIP, "")
+		if delay > 0 {
+			span.attr("delay", delay.String())
+			span.event("sent")
+			p.delay.push(withRelayHeader(out, hops), delay)
+			return
+		}
+		pkt = out
+	} else {
+		capturePacket(pkt, false)
+		logAccess(DirEgress, pkt, vIP, "")
+	}
+	span.event("sent")
+	p.enqueue(withRelayHeader(pkt, hops))
+}
+
+func readMessage(ctx context.Context, tunDev *TunDevice, send func(rIP net.IP, buf []byte)) {
+	dev := tunDev.device
 	bufs := make([][]byte, dev.BatchSize())
 	buf := make([]byte, BUFSIZE)
 	bufs[0] = buf
 	size := make([]int, dev.BatchSize())
+	var pool *readPool
+	if tunReadConfig.Workers > 1 {
+		pool = newReadPool(ctx, tunReadConfig, send)
+	}
 	for {
 		select {
 		case <-ctx.Done():
+			return
 		default:
 			_, err := dev.Read(bufs, size, 0)
 			if err != nil {
-				slog.Error("read message failed", err)
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("read message failed", "err", err)
+				continue
+			}
+			if size[0] == 0 {
+				globalStats.ZeroLengthReads.Add(1)
+				continue
+			}
+			tunDev.read.Add(1)
+			packet := tunDev.vlan.untag(buf[:size[0]])
+			if !tunDev.rpf.accept(tunDev.name, packet) {
+				continue
 			}
-			packet := buf[:size[0]]
-
-			// TODO:Add IPv6 support
-			if iptool.IsIPv4(packet) {
-				slog.Info("get a packet form %v:%d,to %v:%d\n", iptool.IPv4Source(packet), iptool.IPv4SourcePort(packet), iptool.IPv4Destination(packet), iptool.IPv4DestinationPort(packet))
-				vIP := iptool.IPv4Destination(packet)
-				send(vIP, packet)
-				slog.Info("send %d bytes to ", vIP.String())
-			} else {
-				slog.Info("is not a ipv4 packet")
+			if pool != nil {
+				pool.dispatch(ctx, packet)
+				continue
 			}
+			forwardPacket(packet, send)
+		}
+	}
+}
+
+// deliverPacket writes a packet from a peer to the tun device it is
+// addressed to.
+func deliverPacket(packet []byte) {
+	flow, ok := parseFlowKey(packet)
+	if !ok {
+		return
+	}
+	dst := net.IP(flow.Dst.AsSlice())
+	dev, ok := devTable.Get(dst)
+	if !ok {
+		slog.Error("can not find channel", "vIP", dst)
+		return
+	}
+	if err := writeMessage(dev, packet); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+func writeMessage(dev *TunDevice, packet []byte) error {
+	if Paused() && gate.hold(packet, func(pkt []byte) {
+		if err := writeDevice(dev, pkt); err != nil {
+			slog.Error(err.Error())
 		}
+	}) {
+		return nil
 	}
+	return writeDevice(dev, packet)
 }
 
-func writeMessage(dev tun.Device, packet []byte) error {
-	if iptool.IsIPv4(packet) {
-		slog.Info("receive message:%d \n", len(packet))
-		srcIP := iptool.IPv4Source(packet)
-		dstIP := iptool.IPv4Destination(packet)
-		srcPort := iptool.IPv4SourcePort(packet)
-		dstPort := iptool.IPv4DestinationPort(packet)
-		slog.Info("get a packet form %v:%d,to %v:%d\n", srcIP, srcPort, dstIP, dstPort)
-		n, err := dev.Write(append([][]byte{}, packet), 0)
+// writeDevice writes a packet from a peer to dev.
+func writeDevice(dev *TunDevice, packet []byte) error {
+	// the kernel would reject or truncate packets larger than the MTU, the
+	// vlan tag put back below included
+	tagLen := dev.vlan.tagLen(packet)
+	if mtu, err := dev.device.MTU(); err == nil && len(packet)+tagLen > mtu {
+		// e.g. reassembled datagrams, fragmented for this MTU on the way in
+		if canFragment(packet) {
+			if frags, err := fragmentIPv4(packet, mtu-tagLen); err == nil {
+				globalStats.Refragmented.Add(1)
+				for _, frag := range frags {
+					if err := writeDevice(dev, frag); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+		capturePacket(packet, false)
+		globalStats.OversizedDrops.Add(1)
+		slog.Warn("drop packet larger than device mtu", "name", dev.name, "len", len(packet), "mtu", mtu)
+		return nil
+	}
+	capturePacket(packet, false)
+	if flow, ok := parseFlowKey(packet); ok {
+		slog.Info("receive message", "len", len(packet), "device", dev.name)
+		logFlow(flow)
+		countICMPEcho(flow)
+		if markDSCP >= 0 && validIPv4Header(packet) {
+			if err := setIPv4DSCP(packet, uint8(markDSCP)); err != nil {
+				return err
+			}
+		}
+		clampMSS(packet)
+		if ttlDecrementFor(flow.Src) && !decrementTTL(packet) {
+			globalStats.TTLExceeded.Add(1)
+			sendTimeExceeded(dev, packet)
+			return nil
+		}
+		packet = dev.vlan.tag(packet)
+		dev.written.Add(1)
+		recordDeviceWrite(dev, flow)
+		if dev.writer != nil {
+			// packet is reused by the stream reader, the batch needs its own copy
+			dev.writer.enqueue(append([]byte(nil), packet...))
+			return nil
+		}
+		n, err := dev.device.Write(append([][]byte{}, packet), 0)
 		if err != nil {
 			return err
 		}
-		slog.Info("write %d success\n", n)
+		slog.Info("write success", "n", n)
 	} else {
-		slog.Info("is not a ipv4 packet")
+		slog.Info("is not an ip packet")
 	}
 	return nil
 }
 
-func initServer() (*quic.Listener, error) {
-	listener, err := quic.ListenAddr(lAddr, generateTLSConfig(), nil)
-	return listener, err
+// initServer listens for QUIC on addr. With inherit it uses the socket
+// handed over by a graceful restart, if any.
+func initServer(addr string, inherit bool) (*quic.EarlyListener, *quic.Transport, error) {
+	// The receive windows start large so peers in throughput mode are not
+	// held back by flow control while the windows would otherwise grow.
+	conf := quicConfig()
+	conf.InitialStreamReceiveWindow = 4 << 20
+	conf.MaxStreamReceiveWindow = 16 << 20
+	conf.InitialConnectionReceiveWindow = 8 << 20
+	conf.MaxConnectionReceiveWindow = 32 << 20
+	conf.Allow0RTT = zeroRTT
+	// used by the peers forwarding as datagrams only
+	conf.EnableDatagrams = true
+	conn, err := listenUDP(addr, inherit)
+	if err != nil {
+		return nil, nil, err
+	}
+	if inherit {
+		serverConn = conn
+	}
+	tlsConf, err := generateTLSConfig()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	tr := &quic.Transport{Conn: conn}
+	listener, err := tr.ListenEarly(tlsConf, conf)
+	return listener, tr, err
 }
 
-func initClient(ctx context.Context, rAddr string) (chan []byte, error) {
-	session, err := quic.DialAddr(ctx, rAddr, &tls.Config{InsecureSkipVerify: true}, nil)
+// initClient connects to rAddr and starts a writer forwarding the packets
+// queued for p. The returned channel is closed once the writer gave up on
+// the connection.
+func initClient(ctx context.Context, rAddr, localAddr string, p *Peer) (quic.EarlyConnection, <-chan struct{}, error) {
+	pc := p.conf
+	conf := quicConfig()
+	conf.Tracer = p.tracer
+	conf.EnableDatagrams = pc.Datagrams
+	session, err := dialQUIC(ctx, rAddr, localAddr, pc.tlsConfig(), conf, p.wrapConn())
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("%w: %s: %w", ErrPeerUnreachable, rAddr, err)
 	}
-	stream, err := session.OpenStreamSync(ctx)
+	datagrams := pc.Datagrams
+	if datagrams && !session.ConnectionState().SupportsDatagrams {
+		slog.Warn("peer does not support datagrams, forward over the stream", "vIP", p.vIP)
+		datagrams = false
+	}
+	stream, err := p.openStream(ctx, session)
 	if err != nil {
-		return nil, err
+		session.CloseWithError(0, "")
+		return nil, nil, fmt.Errorf("%s: %w", rAddr, err)
 	}
-	pChan := make(chan []byte, 10)
+	done := make(chan struct{})
 	go func(ctx context.Context, stream quic.Stream, pChan chan []byte) {
-
+		defer close(done)
+		frames := make([]byte, 0, maxCoalesceBytes)
+		enc := newFrameEncoder(pc.Compression, &p.stats)
+		var keepalive Timer
+		var keepaliveC <-chan time.Time
+		if deadPeerConfig.enabled() {
+			keepalive = clock.NewTimer(deadPeerConfig.Interval)
+			defer keepalive.Stop()
+			keepaliveC = keepalive.C()
+			p.seen()
+			go p.readEchoes(stream)
+		}
+		// the stream context ends when the peer stops reading the stream,
+		// before a write would notice
+		reset := stream.Context().Done()
+		// reopen replaces a stream the peer reset and keeps the connection
+		reopen := func(err error) bool {
+			var streamErr *quic.StreamError
+			if err != nil && !errors.As(err, &streamErr) || session.Context().Err() != nil {
+				return false
+			}
+			p.stats.StreamResets.Add(1)
+			slog.Warn("stream reset by peer, reopen", "vIP", p.vIP, "err", err)
+			s, err := p.openStream(ctx, session)
+			if err != nil {
+				slog.Error(err.Error(), "vIP", p.vIP)
+				return false
+			}
+			stream = s
+			reset = s.Context().Done()
+			if deadPeerConfig.enabled() {
+				go p.readEchoes(s)
+			}
+			return true
+		}
+		write := func(b []byte) error {
+			_, err := stream.Write(b)
+			if err != nil && reopen(err) {
+				_, err = stream.Write(b)
+			}
+			return err
+		}
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case buf := <-pChan:
-				_, err := stream.Write(buf)
-				if err != nil {
+			case <-session.Context().Done():
+				return
+			case <-reset:
+				if !reopen(nil) {
+					session.CloseWithError(0, "")
+					return
+				}
+			case buf, ok := <-pChan:
+				if !ok {
+					// the route was torn down
+					session.CloseWithError(0, "route removed")
+					return
+				}
+				releaseMemory(buf)
+				if datagrams {
+					if err := p.sendDatagram(session, buf); err != nil {
+						slog.Error(err.Error())
+						return
+					}
+					continue
+				}
+				frames = enc.appendFrame(frames[:0], buf)
+				if pc.Mode == ModeThroughput {
+					frames = coalesce(frames, pChan, enc)
+				}
+				if err := write(frames); err != nil {
 					slog.Error(err.Error())
+					session.CloseWithError(0, "")
+					return
 				}
+			case <-keepaliveC:
+				if p.dead() {
+					p.stats.DeadPeers.Add(1)
+					slog.Warn("peer dead, reconnect", "vIP", p.vIP, "silence", deadPeerConfig.deadline())
+					p.breaker.Failure()
+					session.CloseWithError(0, "dead peer")
+					return
+				}
+				if err := write(keepaliveFrame); err != nil {
+					slog.Error(err.Error())
+					session.CloseWithError(0, "")
+					return
+				}
+				keepalive.Reset(deadPeerConfig.Interval)
 			}
 
 		}
-	}(ctx, stream, pChan)
-	return pChan, nil
+	}(ctx, stream, p.queue)
+	return session, done, nil
 }
 
-// Setup a bare-bones TLS config for the server
-func generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
-	if err != nil {
-		panic(err)
-	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		panic(err)
+// coalesce appends the packets already waiting in pChan to frames, stopping
+// when the queue is empty or closed or the write would exceed
+// maxCoalesceBytes.
+func coalesce(frames []byte, pChan chan []byte, enc *frameEncoder) []byte {
+	for {
+		select {
+		case buf, ok := <-pChan:
+			if !ok {
+				// the writer sees the closed queue next
+				return frames
+			}
+			releaseMemory(buf)
+			frames = enc.appendFrame(frames, buf)
+			if len(frames) >= maxCoalesceBytes-frameHeaderLen-BUFSIZE {
+				return frames
+			}
+		default:
+			return frames
+		}
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+}
 
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+// Setup a bare-bones TLS config for the server
+func generateTLSConfig() (*tls.Config, error) {
+	tlsCert, err := serverCertificate()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &tls.Config{
+	conf := &tls.Config{
 		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"quic-echo-example"},
+		NextProtos:   []string{alpnProto},
 	}
+	if mtlsConfig.Enable {
+		requireClientCert(conf)
+	}
+	return conf, nil
 }
 
+// runServer accepts connections on every configured listener until ctx is
+// done. A listener that fails signals errChan.
 func runServer(ctx context.Context, errChan chan struct{}) {
-	var err error
+	for i, lc := range listenerConfigs {
+		stats := newListenerStats(i, lc)
+		listenerStats.Store(i, stats)
+		go func(i int, lc ListenerConfig) {
+			var err error
+			switch lc.Transport {
+			case TransportQUIC:
+				// only the first QUIC listener takes over the socket of a graceful restart
+				err = serveQUIC(ctx, lc.Addr, i == 0, stats)
+			case TransportTCP:
+				err = serveTCP(ctx, lc.Addr, stats)
+			case TransportWebSocket:
+				err = serveWebSocket(ctx, lc.Addr, stats)
+			}
+			stats.stopped(err)
+			if err != nil && ctx.Err() == nil && !shuttingDown() {
+				slog.Error("listener failed", "listener", lc.String(), "err", err)
+				select {
+				case errChan <- struct{}{}:
+				case <-ctx.Done():
+				}
+			}
+		}(i, lc)
+	}
+}
+
+// serveQUIC accepts QUIC connections on addr.
+func serveQUIC(ctx context.Context, addr string, inherit bool, stats *ListenerStats) error {
+	listener, tr, err := initServer(addr, inherit)
+	if err != nil {
+		return err
+	}
+	// neither the listener nor the transport close the socket they were given
 	defer func() {
-		if err != nil {
-			slog.Error(err.Error())
-			errChan <- struct{}{}
-		}
+		tr.Close()
+		tr.Conn.Close()
 	}()
-	listener, err := initServer()
-	if err != nil {
-		return
+	if mtuProbeConfig.Enable {
+		go echoMTUProbes(ctx, tr)
 	}
 	defer listener.Close()
-
+	OnShutdown(PhaseAccept, "quic "+addr, listener.Close)
+	stats.setBound(listener.Addr())
 	for {
-		select {
-		case <-ctx.Done():
-		default:
-			var conn quic.Connection
-			conn, err = listener.Accept(ctx)
-			if err != nil {
-				return
-			}
-			go handleConn(ctx, conn)
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			return err
+		}
+		if draining.Load() {
+			conn.CloseWithError(0, "draining")
+			continue
+		}
+		if !allowed(conn.RemoteAddr(), stats) {
+			conn.CloseWithError(0, "not allowed")
+			continue
 		}
+		go func() {
+			stats.accepted()
+			defer stats.closed()
+			defer serverConns.add(func(reason string) { conn.CloseWithError(0, reason) })()
+			handleConn(ctx, conn, stats.device())
+		}()
 	}
-
 }
 
-func handleConn(ctx context.Context, conn quic.Connection) {
-	rIP := conn.RemoteAddr().String()
+func handleConn(ctx context.Context, conn quic.EarlyConnection, dev *TunDevice) {
+	// the listener hands out connections before the client finished the
+	// handshake, nothing it sent is trusted until then
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		return
+	}
+	logClientIdentity(conn.RemoteAddr(), conn.ConnectionState().TLS)
+	params := quicParams(conn.ConnectionState())
+	globalStats.ServerQUIC.add(params.String())
+	slog.Info("client handshake complete", "remote", conn.RemoteAddr().String(),
+		"quic", params.Version, "alpn", params.ALPN, "cipher", params.CipherSuite, "tls", params.TLSVersion)
+	if conn.ConnectionState().SupportsDatagrams {
+		go serveDatagrams(ctx, conn, dev)
+	}
 	for {
-		select {
-		case <-ctx.Done():
-		default:
-			stream, err := conn.AcceptStream(ctx)
-			if err != nil {
-				slog.Error(err.Error())
-				return
-			}
-			go func(s quic.Stream) {
-				buf := make([]byte, BUFSIZE)
-				for {
-					select {
-					case <-ctx.Done():
-						return
-					default:
-					}
-					n, err := stream.Read(buf)
-					if err != nil {
-						slog.Error(err.Error())
-						return
-					}
-					slog.Info("receive message from rIP", rIP, "vIp", iptool.IPv4Source(buf[:n]))
-					if dev, ok := devTable.Get(iptool.IPv4Destination(buf[:n])); ok {
-						err = writeMessage(dev.device, buf[:n])
-						if err != nil {
-							slog.Error(err.Error())
-							return
-						}
-					} else {
-						slog.Error("can not find channel for ", iptool.IPv4Source(buf[:n]))
-						return
-					}
-				}
-			}(stream)
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			slog.Error(err.Error())
+			return
 		}
+		go func(s quic.Stream) {
+			rIP := conn.RemoteAddr().String()
+			if proxyProtocol {
+				addr, err := readProxyHeader(s)
+				if err != nil {
+					slog.Error("reject stream", "remote", rIP, "err", err)
+					s.CancelRead(0)
+					s.CancelWrite(0)
+					return
+				}
+				if addr != nil {
+					slog.Info("proxied stream", "proxy", rIP, "client", addr.String())
+					rIP = addr.String()
+				}
+			}
+			serveStream(ctx, quicStream{s, conn}, rIP, dev)
+		}(stream)
 	}
 }
 
 func runClinet(ctx context.Context) {
+	if startupConfig.Ramp > 0 {
+		var routes []route
+		(*sync.Map)(iptable).Range(func(key, value interface{}) bool {
+			routes = append(routes, route{net.ParseIP(key.(string)), value.(net.IP)})
+			return true
+		})
+		if len(routes) > 0 {
+			go rampPeers(ctx, routes)
+		}
+		return
+	}
 	(*sync.Map)(iptable).Range(func(key, value interface{}) bool {
-		vIP := key.(net.IP)
-		rIP := value.(net.IP)
-	InitClientLabel:
-		pChan, err := initClient(ctx, rIP.String())
+		startPeer(ctx, net.ParseIP(key.(string)), value.(net.IP))
+		return true
+	})
+}
+
+// peerLocks serializes starting and stopping the peer of a virtual IP.
+var peerLocks sync.Map // virtual IP -> *sync.Mutex
+
+func lockPeer(vIP net.IP) (unlock func()) {
+	mu, _ := peerLocks.LoadOrStore(vIP.String(), new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// startPeer starts the peer routing vIP to rIP. It does nothing if that
+// peer runs already and replaces one routing vIP elsewhere, so there is at
+// most one peer, queue and client per virtual IP however often and
+// concurrently it is called.
+func startPeer(ctx context.Context, vIP, rIP net.IP) {
+	defer lockPeer(vIP)()
+	if old, ok := peerTable.Get(vIP); ok {
+		if old.rIP.Equal(rIP) {
+			return
+		}
+		slog.Info("replace peer", "vIP", vIP, "from", old.rIP, "to", rIP)
+		removePeer(old)
+	}
+	p := newPeer(vIP, rIP)
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.done = ctx.Done()
+	iptable.Add(vIP, rIP)
+	peerTable.Add(p)
+	chanTable.Add(p.vIP, p.queue)
+	if p.shaper != nil {
+		p.senders.Add(1)
+		go func() {
+			defer p.senders.Done()
+			p.shaper.run(ctx, p.queue)
+		}()
+	}
+	if p.rxShaper != nil {
+		go p.runReceive(ctx)
+	}
+	if p.delay != nil {
+		go p.delay.run(ctx)
+		go p.ingressDelay.run(ctx)
+	}
+	go connectPeer(ctx, p)
+	// a blocking queue must not hold the peer's lock until it is connected
+	go pendingRoutes.flush(vIP)
+}
+
+// stopPeer stops p, leaving a peer that replaced it meanwhile running.
+func stopPeer(p *Peer) {
+	defer lockPeer(p.vIP)()
+	if cur, ok := peerTable.Get(p.vIP); ok && cur == p {
+		removePeer(p)
+		return
+	}
+	p.cancel()
+}
+
+// removePeer drops p from the tables and stops it, its lock must be held.
+func removePeer(p *Peer) {
+	chanTable.Delete(p.vIP)
+	peerTable.Delete(p.vIP)
+	iptable.Delete(p.vIP)
+	p.cancel()
+	p.closeQueue()
+	p.releaseBuffered()
+}
+
+// connectPeer keeps a connection to p up, redialing whenever it fails for
+// as long as the peer's circuit breaker lets it.
+func connectPeer(ctx context.Context, p *Peer) {
+	defer close(p.dialed)
+	rAddr := net.JoinHostPort(p.rIP.String(), lPort)
+	localAddr := p.conf.LocalAddr
+	// a migration is only kept once the peer was dialed from migrateAddr
+	var migrating bool
+	var migrateAddr string
+	backoff := newBackoff(p.conf.backoff())
+	limiter := reconnectLimiter{conf: p.conf.backoff()}
+	for {
+		if up, torn := p.link.tornDown(); torn {
+			select {
+			case <-ctx.Done():
+				return
+			case <-up:
+			}
+			continue
+		}
+		if !p.breaker.Allow() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-clock.After(p.breaker.RetryIn()):
+			}
+			continue
+		}
+		if wait := limiter.wait(); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-clock.After(wait):
+			}
+			continue
+		}
+		if limiter.exceeded() {
+			p.stats.ReconnectsLimited.Add(1)
+			p.breaker.Trip()
+			slog.Warn("peer reconnects too often, open circuit breaker", "vIP", p.vIP, "max_per_minute", limiter.conf.MaxPerMinute, "cooldown", breakerConfig.Cooldown)
+			continue
+		}
+		if len(limiter.recent) > 0 {
+			p.stats.ReconnectAttempts.Add(1)
+		}
+		limiter.attempt()
+		p.lastAttempt.Store(clock.Now().UnixNano())
+		dialAddr := localAddr
+		if migrating {
+			dialAddr = migrateAddr
+		}
+		conn, done, err := initClient(ctx, rAddr, dialAddr, p)
+		if err != nil && migrating {
+			migrating = false
+			slog.Warn("migration failed, redial from the old local address", "vIP", p.vIP, "to", dialAddr, "local", localAddr, "err", err)
+			continue
+		}
 		if err != nil {
-			if err.Error() == "timeout: handshake did not complete in time" {
-				slog.Info("timeout,try again")
-				time.Sleep(3 * time.Second)
-				goto InitClientLabel
-			} else {
-				slog.Error(err.Error())
-				return false
+			var timeout *quic.HandshakeTimeoutError
+			streamFailed := errors.Is(err, ErrStreamOpen)
+			switch {
+			case errors.As(err, &timeout):
+				slog.Info("timeout,try again", "vIP", p.vIP)
+			case streamFailed:
+				slog.Warn("connection alive but stream open failed, redial", "vIP", p.vIP, "err", err)
+			default:
+				slog.Error(err.Error(), "vIP", p.vIP)
 			}
+			// the peer is reachable, only a dead connection counts against it
+			if !streamFailed && p.breaker.Failure() {
+				slog.Error("circuit breaker open, stop reconnecting", "vIP", p.vIP, "cooldown", breakerConfig.Cooldown)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-clock.After(backoff.Next()):
+			}
+			continue
 		}
-		chanTable.Add(vIP, pChan)
-		return true
-	})
+		if migrating {
+			migrating = false
+			localAddr = dialAddr
+			p.stats.Migrations.Add(1)
+		}
+		p.breaker.Success()
+		backoff.Reset()
+		slog.Info("connected to peer", "vIP", p.vIP, "rAddr", rAddr, "local", conn.LocalAddr().String())
+		p.idle.lastActive.Store(clock.Now().UnixNano())
+		p.connected.Store(true)
+		reportRamp()
+		go p.reportResumption(conn)
+		if mtuProbeConfig.Enable {
+			go p.probeMTU(ctx, rAddr)
+		}
+		select {
+		case <-ctx.Done():
+			p.connected.Store(false)
+			conn.CloseWithError(0, "shutdown")
+			return
+		case <-done:
+			slog.Info("connection to peer lost, reconnect", "vIP", p.vIP)
+		case newAddr := <-p.migrate:
+			from := conn.LocalAddr().String()
+			conn.CloseWithError(0, "migrate")
+			<-done
+			migrating, migrateAddr = true, newAddr
+			slog.Info("migrate connection", "vIP", p.vIP, "from", from, "to", newAddr)
+		case <-p.link.teardown:
+			conn.CloseWithError(0, "link down")
+			<-done
+			slog.Info("link down, connection closed", "vIP", p.vIP)
+		case <-p.idle.close:
+			conn.CloseWithError(0, "idle")
+			<-done
+			p.connected.Store(false)
+			p.stats.IdleCloses.Add(1)
+			slog.Info("connection idle, closed until there is traffic", "vIP", p.vIP, "idle_timeout", p.conf.IdleTimeout)
+			if !p.waitForTraffic(ctx) {
+				return
+			}
+		}
+		p.connected.Store(false)
+	}
 }
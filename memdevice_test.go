@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startLoopback runs the server and a client peer dialing it on this
+// simulator, with conf applied on top of routes of 10.0.1.2 and fd00:1::2
+// to loopback. Packets injected into the mem device "lo-src" (10.0.1.1) or
+// "lo6-src" (fd00:1::1) reach the mem device "lo-dst" (10.0.1.2) or
+// "lo6-dst" (fd00:1::2) over a QUIC connection, whose writes are returned.
+func startLoopback(t *testing.T, conf string) <-chan []byte {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() { stopServer(cancel) })
+	c, err := parseConfig([]byte(`
+map1:
+  "10.0.1.2": 127.0.0.1
+  "fd00:1::2": 127.0.0.1
+listeners:
+  - transport: quic
+    addr: 127.0.0.1:`+lPort+`
+`+conf), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = applyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	for name, prefix := range map[string]string{"lo-src": "10.0.1.1/24", "lo-dst": "10.0.1.2/24", "lo6-src": "fd00:1::1/64", "lo6-dst": "fd00:1::2/64"} {
+		ip, addr, _ := net.ParseCIDR(prefix)
+		addr.IP = ip
+		if err = AddMemDevice(ctx, name, *addr, 1500); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make(chan []byte, 64)
+	for _, name := range []string{"lo-dst", "lo6-dst"} {
+		if err = CaptureDevice(name, func(packet []byte) { got <- packet }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runServer(ctx, make(chan struct{}, 1))
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if _, err = ListenAddrs(waitCtx); err != nil {
+		t.Fatal(err)
+	}
+	runClinet(ctx)
+	return got
+}
+
+// loopbackPacket is a UDP packet from lo-src to lo-dst with size bytes of
+// payload.
+func loopbackPacket(size int) []byte {
+	return buildUDPPacket(netip.MustParseAddr("10.0.1.1"), netip.MustParseAddr("10.0.1.2"), 40000, 9, make([]byte, size))
+}
+
+// TestMemDeviceRemoved checks that a mem device is gone once its context
+// is done and its name can be reused, while devices are looked up
+// concurrently under -race.
+func TestMemDeviceRemoved(t *testing.T) {
+	addr := net.IPNet{IP: net.ParseIP("10.0.8.1"), Mask: net.CIDRMask(24, 32)}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				deviceByName("mem-removed")
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := AddMemDevice(ctx, "mem-removed", addr, 1500); err != nil {
+			t.Fatal(err)
+		}
+		if deviceByName("mem-removed") == nil {
+			t.Fatal("mem device is not up")
+		}
+		cancel()
+		deadline := time.Now().Add(2 * time.Second)
+		for deviceByName("mem-removed") != nil || !errors.Is(InjectPacket("mem-removed", nil), ErrDeviceNotFound) {
+			if time.Now().After(deadline) {
+				t.Fatal("mem device still up after its context is done")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, ok := devTable.Get(addr.IP); ok {
+			t.Fatal("address still routed to the removed mem device")
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync/atomic"
+)
+
+// MemoryConfig caps the bytes of all packets the simulator buffers
+// together, read from "memory": the peer queues and bandwidth limits, the
+// delays of the impairments, IPv4 reassembly, the pause gate and the
+// pending routes. Above the cap packets are shed instead of buffered, so a
+// flood degrades forwarding rather than getting the simulator killed. The
+// last tenth of the budget is kept for priority packets: ICMP, TCP segments
+// without payload and DSCP CS5 and above, so bulk traffic is shed first. 0
+// disables the cap, the buffered bytes are tracked anyway.
+type MemoryConfig struct {
+	Limit int64 `mapstructure:"limit"`
+}
+
+var memoryConfig = MemoryConfig{Limit: 256 << 20}
+
+func (c MemoryConfig) validate() error {
+	if c.Limit < 0 {
+		return errors.New("memory: limit must not be negative")
+	}
+	return nil
+}
+
+// memoryShedding is set while packets are shed, so the start and end of
+// shedding are logged once rather than per packet.
+var memoryShedding atomic.Bool
+
+// chargeMemory counts pkt against the budget before it is buffered, it
+// reports false if the packet must be dropped instead. Every charged packet
+// is released once it leaves the buffer.
+func chargeMemory(pkt []byte) bool {
+	n := int64(len(pkt))
+	limit := memoryConfig.Limit
+	if limit > 0 && !memoryPriority(pkt) {
+		limit -= limit / 10
+	}
+	if used := globalStats.BufferedBytes.Add(n); memoryConfig.Limit > 0 && used > limit {
+		globalStats.BufferedBytes.Add(-n)
+		globalStats.MemoryDrops.Add(1)
+		if memoryShedding.CompareAndSwap(false, true) {
+			slog.Warn("memory limit reached, shedding packets", "buffered", used-n, "limit", memoryConfig.Limit)
+		}
+		return false
+	}
+	return true
+}
+
+// releaseMemory returns the bytes of a charged packet to the budget.
+func releaseMemory(pkt []byte) {
+	used := globalStats.BufferedBytes.Add(-int64(len(pkt)))
+	if memoryShedding.Load() && used < memoryConfig.Limit/2 && memoryShedding.CompareAndSwap(true, false) {
+		slog.Info("memory below limit, buffering again", "buffered", used, "limit", memoryConfig.Limit)
+	}
+}
+
+// memoryPriority reports whether pkt may use the budget kept for priority
+// packets.
+func memoryPriority(pkt []byte) bool {
+	_, inner := splitRelayHeader(pkt)
+	flow, ok := parseFlowKey(inner)
+	if !ok {
+		return false
+	}
+	if flow.isICMP() {
+		return true
+	}
+	var dscp byte
+	if flow.Src.Is4() {
+		dscp = inner[1] >> 2
+		if flow.Proto == protoTCP && payloadOffset(inner) >= len(inner) {
+			return true
+		}
+	} else {
+		dscp = (inner[0]<<4 | inner[1]>>4) >> 2
+	}
+	return dscp >= 40
+}
+
+// releaseBuffered drops what the stopped peer p still buffers and returns
+// it to the memory budget.
+func (p *Peer) releaseBuffered() {
+	for len(p.queue) > 0 {
+		select {
+		case pkt := <-p.queue:
+			releaseMemory(pkt)
+		default:
+		}
+	}
+	for _, s := range []*Shaper{p.shaper, p.rxShaper} {
+		if s != nil {
+			s.release()
+		}
+	}
+	for _, d := range []*delayLine{p.delay, p.ingressDelay} {
+		if d != nil {
+			d.release()
+		}
+	}
+}
+
+func (s *Shaper) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		q, ok := s.sched.pop()
+		if !ok {
+			return
+		}
+		releaseMemory(q.pkt)
+	}
+}
+
+func (d *delayLine) release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, q := range d.pkts {
+		releaseMemory(q.pkt)
+	}
+	d.pkts = nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quic-go does not implement active connection migration yet, it always
+// advertises disable_active_migration. A handover is simulated instead by
+// re-dialing the peer from the new local address: the QUIC connection is
+// replaced, the tunnel and the peer queue survive.
+
+// dialQUIC dials rAddr, binding to localAddr if it is not empty and
+// wrapping the socket with wrap if it is not nil. The connection is
+// returned early when it can send 0-RTT data.
+func dialQUIC(ctx context.Context, rAddr, localAddr string, tlsConf *tls.Config, conf *quic.Config, wrap func(net.PacketConn) net.PacketConn) (quic.EarlyConnection, error) {
+	if localAddr == "" && wrap == nil {
+		return quic.DialAddrEarly(ctx, rAddr, tlsConf, conf)
+	}
+	var laddr *net.UDPAddr
+	if localAddr != "" {
+		var err error
+		if laddr, err = net.ResolveUDPAddr("udp", localAddr); err != nil {
+			return nil, err
+		}
+	}
+	raddr, err := net.ResolveUDPAddr("udp", rAddr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	var pconn net.PacketConn = udpConn
+	if wrap != nil {
+		pconn = wrap(udpConn)
+	}
+	tr := &quic.Transport{Conn: pconn}
+	conn, err := tr.DialEarly(ctx, raddr, tlsConf, conf)
+	if err != nil {
+		tr.Close()
+		udpConn.Close()
+		return nil, err
+	}
+	go func() {
+		<-conn.Context().Done()
+		tr.Close()
+		udpConn.Close()
+	}()
+	return conn, nil
+}
+
+// Migrate moves the peer's connection to localAddr, an empty address lets
+// the OS pick one. It returns false if a migration is already pending.
+func (p *Peer) Migrate(localAddr string) bool {
+	select {
+	case p.migrate <- localAddr:
+		return true
+	default:
+		return false
+	}
+}
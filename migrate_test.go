@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitRedialed waits until p was dialed twice more than attempts and is
+// connected again.
+func waitRedialed(t *testing.T, p *Peer, attempts uint64) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); p.stats.ReconnectAttempts.Load() < attempts+2 || !p.connected.Load(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("peer not redialed")
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	got := startLoopback(t, "")
+	p, _ := peerTable.Get(net.ParseIP("10.0.1.2"))
+	for deadline := time.Now().Add(5 * time.Second); !p.connected.Load(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("peer not connected")
+		}
+	}
+	srv := httptest.NewServer(adminHandler())
+	defer srv.Close()
+	migrate := func(local string) int {
+		resp, err := http.Post(srv.URL+"/peers/migrate?vip=10.0.1.2&local="+local, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := migrate("not-an-address"); code != http.StatusBadRequest {
+		t.Fatalf("invalid local address answered %d, want 400", code)
+	}
+
+	// not an address of this host, the dial fails and the old one is kept
+	attempts := p.stats.ReconnectAttempts.Load()
+	if code := migrate("192.0.2.1:0"); code != http.StatusAccepted {
+		t.Fatalf("migrate answered %d, want 202", code)
+	}
+	waitRedialed(t, p, attempts)
+	if p.stats.Migrations.Load() != 0 {
+		t.Fatal("failed migration counted")
+	}
+	if err := InjectPacket("lo-src", loopbackPacket(10)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet delivered after the failed migration")
+	}
+
+	if code := migrate("127.0.0.1:0"); code != http.StatusAccepted {
+		t.Fatalf("migrate answered %d, want 202", code)
+	}
+	for deadline := time.Now().Add(5 * time.Second); p.stats.Migrations.Load() != 1 || !p.connected.Load(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("migration not done")
+		}
+	}
+}
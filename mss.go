@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const tcpOptMSS = 2
+
+// mssClamp is the largest MSS the SYNs forwarded either way may announce,
+// read from "mss_clamp"; 0 leaves them alone. TCP over the tunnel then
+// sends segments that fit its reduced MTU instead of relying on
+// fragmentation or path MTU discovery.
+var mssClamp int
+
+func validateMSSClamp(mss int) error {
+	if mss < 0 || mss > 0xffff {
+		return fmt.Errorf("mss_clamp: %d is not within [0, 65535]", mss)
+	}
+	return nil
+}
+
+// clampMSS lowers the MSS option of a TCP SYN in an IPv4 packet to
+// mssClamp, recomputing the TCP checksum.
+func clampMSS(packet []byte) {
+	if mssClamp == 0 {
+		return
+	}
+	if flags, ok := tcpFlags(packet); !ok || flags&tcpFlagSYN == 0 {
+		return
+	}
+	l4 := packet[ipv4HeaderLen(packet):]
+	dataOff := int(l4[12]>>4) * 4
+	if dataOff < 20 || dataOff > len(l4) {
+		return
+	}
+	opts := l4[20:dataOff]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case 0: // end of options
+			return
+		case 1: // no-op
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return
+		}
+		if opts[i] == tcpOptMSS && opts[i+1] == 4 {
+			if mss := binary.BigEndian.Uint16(opts[i+2:]); int(mss) > mssClamp {
+				binary.BigEndian.PutUint16(opts[i+2:], uint16(mssClamp))
+				updateL4Checksum(packet)
+				globalStats.MSSClamped.Add(1)
+			}
+			return
+		}
+		i += int(opts[i+1])
+	}
+}
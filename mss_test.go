@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// tcpSYN returns an IPv4 TCP SYN announcing mss.
+func tcpSYN(mss uint16) []byte {
+	pkt := make([]byte, ipv4MinHeaderLen+24)
+	pkt[0] = 4<<4 | ipv4MinHeaderLen/4
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = protoTCP
+	copy(pkt[12:16], []byte{10, 0, 1, 1})
+	copy(pkt[16:20], []byte{10, 0, 1, 2})
+	tcp := pkt[ipv4MinHeaderLen:]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 80)
+	tcp[12] = 6 << 4
+	tcp[13] = tcpFlagSYN
+	tcp[20], tcp[21] = tcpOptMSS, 4
+	binary.BigEndian.PutUint16(tcp[22:24], mss)
+	updateIPv4Checksum(pkt)
+	updateL4Checksum(pkt)
+	return pkt
+}
+
+// TestClampMSS checks that SYNs are clamped and that a first fragment, which
+// only looks like a SYN, is left alone.
+func TestClampMSS(t *testing.T) {
+	mssClamp = 1200
+	t.Cleanup(func() { mssClamp = 0 })
+
+	syn := tcpSYN(1460)
+	clampMSS(syn)
+	if mss := binary.BigEndian.Uint16(syn[ipv4MinHeaderLen+22:]); mss != 1200 {
+		t.Fatalf("clamped mss = %d, want 1200", mss)
+	}
+
+	frag := tcpSYN(1460)
+	binary.BigEndian.PutUint16(frag[6:8], ipv4FlagMF)
+	updateIPv4Checksum(frag)
+	if _, ok := tcpFlags(frag); ok {
+		t.Fatal("read tcp flags from a first fragment")
+	}
+	clampMSS(frag)
+	if mss := binary.BigEndian.Uint16(frag[ipv4MinHeaderLen+22:]); mss != 1460 {
+		t.Fatalf("first fragment clamped to mss %d", mss)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// MTLSConfig makes the server require client certificates, read from the
+// "mtls" section. Clients present the certificate configured for the peer.
+type MTLSConfig struct {
+	Enable bool `mapstructure:"enable"`
+	// CA is a PEM bundle the client certificates must chain to.
+	CA string `mapstructure:"ca"`
+	// Peers maps a client certificate identity to a peer name. When set,
+	// only the listed identities are accepted.
+	Peers map[string]string `mapstructure:"peers" comment:"client certificate identity (common name) -> peer, empty accepts every verified client"`
+
+	caPool *x509.CertPool
+}
+
+var mtlsConfig MTLSConfig
+
+func loadMTLSConfig(c MTLSConfig) error {
+	if !c.Enable {
+		mtlsConfig = c
+		return nil
+	}
+	if c.CA == "" {
+		return errors.New("mtls: ca is required when mtls is enabled")
+	}
+	pem, err := os.ReadFile(c.CA)
+	if err != nil {
+		return fmt.Errorf("mtls: %w", err)
+	}
+	c.caPool = x509.NewCertPool()
+	if !c.caPool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("mtls: no certificates found in %s", c.CA)
+	}
+	mtlsConfig = c
+	return nil
+}
+
+// requireClientCert sets up conf to require a client certificate signed by
+// the configured CA. It does what tls.RequireAndVerifyClientCert does, but
+// verifies the chain itself so rejected clients can be logged: the QUIC
+// listener silently drops connections whose handshake fails.
+func requireClientCert(conf *tls.Config) {
+	conf.ClientAuth = tls.RequireAnyClientCert
+	conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		err := verifyClientCert(rawCerts)
+		if err != nil {
+			slog.Error("reject client certificate", "err", err)
+		}
+		return err
+	}
+}
+
+func verifyClientCert(rawCerts [][]byte) error {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return errors.New("no client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         mtlsConfig.caPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("client %q: %w", certIdentity(certs[0]), err)
+	}
+	if _, ok := clientPeer(certs[0]); !ok {
+		return fmt.Errorf("client %q is not an authorized peer", certIdentity(certs[0]))
+	}
+	return nil
+}
+
+// certIdentity is the common name of cert, or its first DNS name if the
+// common name is empty.
+func certIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// clientPeer maps a client certificate to the configured peer name. Without
+// a peer mapping every verified client is accepted under its identity.
+func clientPeer(cert *x509.Certificate) (string, bool) {
+	id := certIdentity(cert)
+	if len(mtlsConfig.Peers) == 0 {
+		return id, true
+	}
+	peer, ok := mtlsConfig.Peers[id]
+	return peer, ok
+}
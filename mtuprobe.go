@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// MTUProbeConfig is read from "mtu_probe". When enabled, clients probe the
+// path MTU to every peer after connecting: did-not-fragment UDP datagrams
+// of increasing size are sent to the peer's QUIC port, which echoes a short
+// ack for every probe it receives, and the largest IP packet acknowledged is
+// the peer's path MTU. Both sides need it enabled.
+type MTUProbeConfig struct {
+	Enable bool `mapstructure:"enable"`
+	// Min and Max bound the probed IP packet sizes.
+	Min int `mapstructure:"min"`
+	Max int `mapstructure:"max"`
+	// Timeout is how long to wait for the ack of a probe, each size is
+	// tried twice.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+var mtuProbeConfig = MTUProbeConfig{Min: 576, Max: 1500, Timeout: 200 * time.Millisecond}
+
+func (c MTUProbeConfig) validate() error {
+	if c.Min < ipv4MinHeaderLen+udpHeaderLen+len(mtuProbeMagic)+4 || c.Max < c.Min || c.Max > 65535 {
+		return fmt.Errorf("mtu_probe: need %d <= min <= max <= 65535", ipv4MinHeaderLen+udpHeaderLen+len(mtuProbeMagic)+4)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("mtu_probe: timeout must be positive")
+	}
+	return nil
+}
+
+// mtuProbeMagic starts every probe and ack. Its first byte has the QUIC
+// fixed bit clear, so the listener's transport hands probes to
+// ReadNonQUICPacket instead of dropping them.
+var mtuProbeMagic = []byte("\x00nsimmtu")
+
+// echoMTUProbes acks the probes arriving at tr until ctx is done.
+func echoMTUProbes(ctx context.Context, tr *quic.Transport) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := tr.ReadNonQUICPacket(ctx, buf)
+		if err != nil {
+			return
+		}
+		probe := buf[:n]
+		if n < len(mtuProbeMagic)+4 || !bytes.HasPrefix(probe, mtuProbeMagic) {
+			continue
+		}
+		if _, err = tr.WriteTo(probe[:len(mtuProbeMagic)+4], addr); err != nil {
+			slog.Debug("ack mtu probe failed", "remote", addr.String(), "err", err)
+		}
+	}
+}
+
+// probeMTU binary searches the path MTU to rAddr and stores it in p's stats.
+func (p *Peer) probeMTU(ctx context.Context, rAddr string) {
+	conf := mtuProbeConfig
+	raddr, err := net.ResolveUDPAddr("udp", rAddr)
+	if err != nil {
+		slog.Error("mtu probe failed", "vIP", p.vIP, "err", err)
+		return
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		slog.Error("mtu probe failed", "vIP", p.vIP, "err", err)
+		return
+	}
+	defer conn.Close()
+	if err = setDontFragment(conn); err != nil {
+		slog.Warn("can not set dont fragment, mtu probes may be fragmented", "vIP", p.vIP, "err", err)
+	}
+
+	var seq uint32
+	fits := func(size int) bool {
+		probe := make([]byte, size-ipv4MinHeaderLen-udpHeaderLen)
+		copy(probe, mtuProbeMagic)
+		ack := make([]byte, 64)
+		for try := 0; try < 2; try++ {
+			seq++
+			binary.BigEndian.PutUint32(probe[len(mtuProbeMagic):], seq)
+			// EMSGSIZE: larger than the MTU the kernel knows for the route
+			if _, err := conn.Write(probe); err != nil {
+				return false
+			}
+			conn.SetReadDeadline(time.Now().Add(conf.Timeout))
+			for {
+				n, err := conn.Read(ack)
+				if err != nil {
+					break
+				}
+				if n == len(mtuProbeMagic)+4 && binary.BigEndian.Uint32(ack[len(mtuProbeMagic):]) == seq {
+					return true
+				}
+			}
+			if ctx.Err() != nil {
+				return false
+			}
+		}
+		return false
+	}
+
+	if !fits(conf.Min) {
+		slog.Warn("mtu probe got no ack, is mtu_probe enabled on the peer", "vIP", p.vIP, "size", conf.Min)
+		return
+	}
+	lo, hi := conf.Min, conf.Max
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	p.stats.PathMTU.Store(int64(lo))
+	slog.Info("probed path mtu", "vIP", p.vIP, "mtu", lo)
+}
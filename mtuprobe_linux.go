@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment makes the kernel send datagrams of conn with DF set and
+// fail writes larger than the known path MTU.
+func setDontFragment(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
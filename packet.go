@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+)
+
+const ipv4MinHeaderLen = 20
+
+var errShortPacket = errors.New("packet shorter than its ip header")
+
+// ipv4HeaderLen returns the header length in bytes given by the IHL field.
+func ipv4HeaderLen(packet []byte) int {
+	return int(packet[0]&0x0f) * 4
+}
+
+// validIPv4Header reports whether packet holds a complete IPv4 header.
+func validIPv4Header(packet []byte) bool {
+	if len(packet) < ipv4MinHeaderLen || packet[0]>>4 != 4 {
+		return false
+	}
+	hl := ipv4HeaderLen(packet)
+	return hl >= ipv4MinHeaderLen && hl <= len(packet)
+}
+
+// checksum is the internet checksum (RFC 1071) of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// updateIPv4Checksum recomputes the header checksum after the header changed.
+func updateIPv4Checksum(packet []byte) {
+	hdr := packet[:ipv4HeaderLen(packet)]
+	hdr[10], hdr[11] = 0, 0
+	binary.BigEndian.PutUint16(hdr[10:], checksum(hdr))
+}
+
+// setIPv4DSCP stamps dscp into the ToS byte, keeping the ECN bits.
+func setIPv4DSCP(packet []byte, dscp uint8) error {
+	if !validIPv4Header(packet) {
+		return errShortPacket
+	}
+	packet[1] = dscp<<2 | packet[1]&0x03
+	updateIPv4Checksum(packet)
+	return nil
+}
+
+const (
+	ecnMask = 0x03
+	ecnCE   = 0x03
+)
+
+// setIPv4CE marks packet as Congestion Experienced. Only packets of ECN
+// capable transports carry an ECT codepoint and may be marked, it reports
+// whether packet was.
+func setIPv4CE(packet []byte) bool {
+	if !validIPv4Header(packet) || packet[1]&ecnMask == 0 {
+		return false
+	}
+	if packet[1]&ecnMask != ecnCE {
+		packet[1] |= ecnCE
+		updateIPv4Checksum(packet)
+	}
+	return true
+}
+
+const (
+	protoICMP = 1
+	protoTCP  = 6
+	protoUDP  = 17
+)
+
+// FlowKey is the 5-tuple identifying the flow a packet belongs to. Ports
+// are zero for protocols other than TCP and UDP, ICMP packets carry their
+// type and code instead.
+type FlowKey struct {
+	Src, Dst           netip.Addr
+	SrcPort, DstPort   uint16
+	Proto              uint8
+	ICMPType, ICMPCode uint8
+}
+
+func (k FlowKey) isICMP() bool { return k.Proto == protoICMP || k.Proto == protoICMPv6 }
+
+func (k FlowKey) String() string {
+	if k.isICMP() {
+		return fmt.Sprintf("%d %s->%s type %d code %d", k.Proto, k.Src, k.Dst, k.ICMPType, k.ICMPCode)
+	}
+	return fmt.Sprintf("%d %s->%s", k.Proto,
+		netip.AddrPortFrom(k.Src, k.SrcPort), netip.AddrPortFrom(k.Dst, k.DstPort))
+}
+
+// parseL4 fills in the ports or the ICMP type and code from the L4 header.
+func (k *FlowKey) parseL4(l4 []byte) {
+	switch {
+	case (k.Proto == protoTCP || k.Proto == protoUDP) && len(l4) >= 4:
+		k.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+		k.DstPort = binary.BigEndian.Uint16(l4[2:4])
+	case k.isICMP() && len(l4) >= 2:
+		k.ICMPType, k.ICMPCode = l4[0], l4[1]
+	}
+}
+
+// parseFlowKey extracts the 5-tuple of an IPv4 or IPv6 packet.
+func parseFlowKey(packet []byte) (FlowKey, bool) {
+	if len(packet) > 0 && packet[0]>>4 == 6 {
+		return parseIPv6FlowKey(packet)
+	}
+	if !validIPv4Header(packet) {
+		return FlowKey{}, false
+	}
+	k := FlowKey{
+		Src:   netip.AddrFrom4([4]byte(packet[12:16])),
+		Dst:   netip.AddrFrom4([4]byte(packet[16:20])),
+		Proto: packet[9],
+	}
+	l4 := packet[ipv4HeaderLen(packet):]
+	// only the first fragment carries the ports, all fragments of a
+	// datagram are keyed without them
+	if !isIPv4Fragment(packet) {
+		k.parseL4(l4)
+	}
+	return k, true
+}
+
+const udpHeaderLen = 8
+
+// buildUDPPacket returns an IPv4 UDP packet with valid checksums.
+func buildUDPPacket(src, dst netip.Addr, srcPort, dstPort uint16, payload []byte) []byte {
+	total := ipv4MinHeaderLen + udpHeaderLen + len(payload)
+	pkt := make([]byte, total)
+	pkt[0] = 4<<4 | ipv4MinHeaderLen/4
+	binary.BigEndian.PutUint16(pkt[2:], uint16(total))
+	pkt[8] = 64 // ttl
+	pkt[9] = protoUDP
+	s, d := src.As4(), dst.As4()
+	copy(pkt[12:16], s[:])
+	copy(pkt[16:20], d[:])
+	updateIPv4Checksum(pkt)
+
+	udp := pkt[ipv4MinHeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[udpHeaderLen:], payload)
+	updateL4Checksum(pkt)
+	return pkt
+}
+
+// updateL4Checksum recomputes the TCP or UDP checksum of an IPv4 packet,
+// including the pseudo header.
+func updateL4Checksum(packet []byte) {
+	l4 := packet[ipv4HeaderLen(packet):]
+	var off int
+	switch packet[9] {
+	case protoTCP:
+		off = 16
+	case protoUDP:
+		off = 6
+	default:
+		return
+	}
+	if len(l4) < off+2 {
+		return
+	}
+	l4[off], l4[off+1] = 0, 0
+	pseudo := make([]byte, 12, 12+len(l4))
+	copy(pseudo[0:8], packet[12:20])
+	pseudo[9] = packet[9]
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(l4)))
+	sum := checksum(append(pseudo, l4...))
+	if sum == 0 && packet[9] == protoUDP {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(l4[off:], sum)
+}
+
+// buildICMPPacket returns an IPv4 ICMP message with valid checksums.
+func buildICMPPacket(src, dst netip.Addr, typ, code uint8, body []byte) []byte {
+	total := ipv4MinHeaderLen + 4 + len(body)
+	pkt := make([]byte, total)
+	pkt[0] = 4<<4 | ipv4MinHeaderLen/4
+	binary.BigEndian.PutUint16(pkt[2:], uint16(total))
+	pkt[8] = 64 // ttl
+	pkt[9] = protoICMP
+	s, d := src.As4(), dst.As4()
+	copy(pkt[12:16], s[:])
+	copy(pkt[16:20], d[:])
+	updateIPv4Checksum(pkt)
+
+	icmp := pkt[ipv4MinHeaderLen:]
+	icmp[0], icmp[1] = typ, code
+	copy(icmp[4:], body)
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp))
+	return pkt
+}
+
+const (
+	icmpEchoReply       = 0
+	icmpEchoRequest     = 8
+	icmpDestUnreachable = 3
+	icmpTimeExceeded    = 11
+	icmpParamProblem    = 12
+)
+
+// isICMPError reports whether packet is an ICMP error message, which must
+// never trigger another ICMP error.
+func isICMPError(packet []byte) bool {
+	if !validIPv4Header(packet) || packet[9] != protoICMP {
+		return false
+	}
+	l4 := packet[ipv4HeaderLen(packet):]
+	if len(l4) == 0 {
+		return false
+	}
+	switch l4[0] {
+	case icmpDestUnreachable, icmpTimeExceeded, icmpParamProblem:
+		return true
+	}
+	return false
+}
+
+// icmpQuote returns the part of packet an ICMP error carries: its IP
+// header and the first 8 bytes of its payload.
+func icmpQuote(packet []byte) []byte {
+	return packet[:min(len(packet), ipv4HeaderLen(packet)+8)]
+}
+
+// logFlow logs the 5-tuple of a packet, or the type and code of an ICMP packet.
+func logFlow(flow FlowKey) {
+	if flow.isICMP() {
+		slog.Info("get a packet", "src", flow.Src, "dst", flow.Dst, "icmpType", flow.ICMPType, "icmpCode", flow.ICMPCode)
+		return
+	}
+	slog.Info("get a packet", "src", flow.Src, "srcPort", flow.SrcPort, "dst", flow.Dst, "dstPort", flow.DstPort)
+}
+
+// countICMPEcho counts ICMP and ICMPv6 echo requests and replies.
+func countICMPEcho(flow FlowKey) {
+	switch {
+	case flow.Proto == protoICMP && flow.ICMPType == icmpEchoRequest,
+		flow.Proto == protoICMPv6 && flow.ICMPType == icmpv6EchoRequest:
+		globalStats.ICMPEchoRequests.Add(1)
+	case flow.Proto == protoICMP && flow.ICMPType == icmpEchoReply,
+		flow.Proto == protoICMPv6 && flow.ICMPType == icmpv6EchoReply:
+		globalStats.ICMPEchoReplies.Add(1)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// udpPacket returns an IPv4 UDP packet from src to dst with opts as IPv4
+// options.
+func udpPacket(src, dst netip.Addr, srcPort, dstPort uint16, opts, payload []byte) []byte {
+	hl := ipv4MinHeaderLen + len(opts)
+	pkt := make([]byte, hl+8+len(payload))
+	pkt[0] = 4<<4 | byte(hl/4)
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = protoUDP
+	s, d := src.As4(), dst.As4()
+	copy(pkt[12:16], s[:])
+	copy(pkt[16:20], d[:])
+	copy(pkt[ipv4MinHeaderLen:], opts)
+	updateIPv4Checksum(pkt)
+	udp := pkt[hl:]
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[8:], payload)
+	return pkt
+}
+
+func TestParseFlowKey(t *testing.T) {
+	src, dst := netip.MustParseAddr("10.0.1.1"), netip.MustParseAddr("10.0.1.2")
+	udp := udpPacket(src, dst, 40000, 53, nil, []byte("query"))
+	frags, err := fragmentIPv4(udpPacket(src, dst, 40000, 53, nil, make([]byte, 100)), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		pkt  []byte
+		want FlowKey
+		ok   bool
+	}{
+		{"udp", udp, FlowKey{Src: src, Dst: dst, SrcPort: 40000, DstPort: 53, Proto: protoUDP}, true},
+		// IHL 8: a NOP, a record route option of 7 bytes and EOL padding
+		{"options", udpPacket(src, dst, 40000, 53, []byte{1, 7, 7, 4, 0, 0, 0, 0, 0, 0, 0, 0}, []byte("query")), FlowKey{Src: src, Dst: dst, SrcPort: 40000, DstPort: 53, Proto: protoUDP}, true},
+		{"fragment", frags[1], FlowKey{Src: src, Dst: dst, Proto: protoUDP}, true},
+		{"truncated", udp[:ipv4MinHeaderLen-1], FlowKey{}, false},
+		{"empty", nil, FlowKey{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseFlowKey(tt.pkt)
+			if ok != tt.ok || got != tt.want {
+				t.Fatalf("parseFlowKey = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
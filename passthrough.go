@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// PassthroughConfig forwards frames that are not IP packets, e.g. ethernet
+// frames of a tap setup, as they are instead of dropping them, read from
+// "passthrough". Frames read from a tun device go to Peer, frames from the
+// peers are written to Device. They bypass the routing and every
+// impairment except the peer's impairment.loss.
+type PassthroughConfig struct {
+	// Peer is the virtual IP of the peer, empty disables the passthrough.
+	Peer string `mapstructure:"peer"`
+	// Device is the tun device name, default the first one.
+	Device string `mapstructure:"device"`
+
+	peer net.IP
+}
+
+var passthroughConfig PassthroughConfig
+
+func (c *PassthroughConfig) validate() error {
+	if c.Peer == "" {
+		return nil
+	}
+	if c.peer = net.ParseIP(c.Peer); c.peer == nil {
+		return fmt.Errorf("passthrough: invalid peer %q", c.Peer)
+	}
+	return nil
+}
+
+// baseLoss returns the loss impairment of p's impairment.loss, nil if it
+// has none.
+func (p *Peer) baseLoss() *lossImpairment {
+	if p.conf.Impairment.Loss == 0 {
+		return nil
+	}
+	// chain puts the loss first
+	return p.impairments[0].(*lossImpairment)
+}
+
+// forwardPassthrough sends a frame read from a tun device that is not an IP
+// packet to the passthrough peer. It returns false if the passthrough is
+// disabled.
+func forwardPassthrough(frame []byte) bool {
+	if passthroughConfig.peer == nil {
+		return false
+	}
+	p, err := lookupPeer(passthroughConfig.peer)
+	if err != nil {
+		slog.Error("can not find passthrough peer", "vIP", passthroughConfig.peer, "err", err)
+		return true
+	}
+	if p.breaker.Open() {
+		p.stats.BreakerDrops.Add(1)
+		return true
+	}
+	if p.link.isDown() {
+		p.stats.OutageDrops.Add(1)
+		return true
+	}
+	p.idle.active()
+	if l := p.baseLoss(); l != nil && p.impaired() {
+		if forward, _, _ := l.Apply(frame, DirEgress); !forward {
+			p.stats.ImpairDrops.Add(1)
+			return true
+		}
+	}
+	globalStats.PassthroughTx.Add(1)
+	p.stats.TxPackets.Add(1)
+	p.stats.TxBytes.Add(uint64(len(frame)))
+	p.txRate.add(len(frame))
+	if _, inner := splitRelayHeader(frame); len(inner) != len(frame) {
+		// would be taken for a relay header, escape it with one of no hops
+		p.enqueue(relayHeader(frame, 0))
+		return true
+	}
+	// frame is reused by the next read, the queue needs its own copy
+	p.enqueue(append([]byte(nil), frame...))
+	return true
+}
+
+// receivePassthrough writes a frame from a peer that is not an IP packet to
+// the passthrough device, dropping it if the passthrough is disabled.
+func receivePassthrough(frame []byte, rIP string) bool {
+	if passthroughConfig.peer == nil {
+		slog.Info("is not an ip packet", "rIP", rIP)
+		return true
+	}
+	var dev *TunDevice
+	if passthroughConfig.Device != "" {
+		dev = deviceByName(passthroughConfig.Device)
+	} else if devs := tunDevices(); len(devs) > 0 {
+		dev = devs[0]
+	}
+	if dev == nil {
+		slog.Error("can not find passthrough device", "name", passthroughConfig.Device)
+		return true
+	}
+	globalStats.PassthroughRx.Add(1)
+	dev.written.Add(1)
+	if dev.writer != nil {
+		// frame is reused by the stream reader, the batch needs its own copy
+		dev.writer.enqueue(append([]byte(nil), frame...))
+		return true
+	}
+	if _, err := dev.device.Write([][]byte{frame}, 0); err != nil {
+		slog.Error("write passthrough frame failed", "name", dev.name, "err", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// PauseBuffer holds packets while paused and forwards them on resume,
+	// PauseDrop discards them.
+	PauseBuffer = "buffer"
+	PauseDrop   = "drop"
+)
+
+// PauseConfig is read from "pause".
+type PauseConfig struct {
+	Mode string `mapstructure:"mode"`
+	// Limit bounds the buffered packets, those beyond it are dropped.
+	Limit int `mapstructure:"limit"`
+}
+
+var pauseConfig = PauseConfig{Mode: PauseBuffer, Limit: 10000}
+
+func (c PauseConfig) validate() error {
+	if c.Mode != PauseBuffer && c.Mode != PauseDrop {
+		return fmt.Errorf("pause: unknown mode %q", c.Mode)
+	}
+	if c.Limit < 0 {
+		return fmt.Errorf("pause: limit must not be negative")
+	}
+	return nil
+}
+
+type heldPacket struct {
+	pkt     []byte
+	forward func(pkt []byte)
+}
+
+// pauseGate stops forwarding in both directions while paused. Connections
+// and devices stay up, keepalives still flow.
+type pauseGate struct {
+	paused atomic.Bool
+	mu     sync.Mutex
+	held   []heldPacket
+
+	Drops atomic.Uint64
+}
+
+var gate pauseGate
+
+// Pause stops forwarding packets until Resume.
+func Pause() {
+	gate.paused.Store(true)
+	slog.Info("forwarding paused", "mode", pauseConfig.Mode)
+}
+
+// Resume forwards the packets held while paused, in order, and then
+// forwarding carries on as usual.
+func Resume() {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	held := gate.held
+	gate.held = nil
+	for _, h := range held {
+		releaseMemory(h.pkt)
+		h.forward(h.pkt)
+	}
+	gate.paused.Store(false)
+	slog.Info("forwarding resumed", "released", len(held))
+}
+
+// Paused reports whether forwarding is paused.
+func Paused() bool { return gate.paused.Load() }
+
+// hold keeps a copy of pkt to be passed to forward on resume if forwarding
+// is paused, and reports whether the packet was held or dropped. forward
+// must not go through the gate again.
+func (g *pauseGate) hold(pkt []byte, forward func(pkt []byte)) bool {
+	if !g.paused.Load() {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Resume may have finished meanwhile
+	if !g.paused.Load() {
+		return false
+	}
+	if pauseConfig.Mode == PauseDrop || len(g.held) >= pauseConfig.Limit {
+		g.Drops.Add(1)
+		return true
+	}
+	if !chargeMemory(pkt) {
+		return true
+	}
+	g.held = append(g.held, heldPacket{append([]byte(nil), pkt...), forward})
+	return true
+}
+
+// Held returns the number of packets waiting for Resume.
+func (g *pauseGate) Held() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.held)
+}
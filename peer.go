@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PeerMode selects how packets to a peer are handed to QUIC. quic-go has no
+// Nagle-style switch: stream data is sent as soon as its send loop runs, so
+// the mode controls how much the writer queues and coalesces in front of it.
+type PeerMode string
+
+const (
+	// ModeLowLatency writes every packet to the stream as soon as it is read.
+	// A writer_queue of 1 also keeps at most one packet waiting for it.
+	ModeLowLatency PeerMode = "low-latency"
+	// ModeThroughput coalesces queued packets into larger stream writes.
+	ModeThroughput PeerMode = "throughput"
+)
+
+const (
+	// QueueFullBlock waits for the writer, holding up the tun read, as a
+	// lossless link would. QueueFullDropNewest drops the packet that does
+	// not fit and QueueFullDropOldest the one at the head of the queue to
+	// make room, like a router's tail and head drop.
+	QueueFullBlock      = "block"
+	QueueFullDropNewest = "drop_newest"
+	QueueFullDropOldest = "drop_oldest"
+)
+
+const (
+	defaultQueueLen    = 10
+	throughputQueueLen = 64
+	// maxCoalesceBytes bounds a single coalesced stream write.
+	maxCoalesceBytes = 64 * 1024
+)
+
+// PeerConfig holds the settings of one peer, keyed by virtual IP under "peers".
+type PeerConfig struct {
+	Mode PeerMode `mapstructure:"mode"`
+	// ClientCert and ClientKey are presented to the peer for mutual TLS.
+	ClientCert string `mapstructure:"client_cert"`
+	ClientKey  string `mapstructure:"client_key"`
+	// Bandwidth caps the send rate to the peer in bits per second, 0 is unlimited.
+	Bandwidth int64 `mapstructure:"bandwidth"`
+	// ReceiveBandwidth caps the rate packets from the peer are written to
+	// the tun devices, independent of Bandwidth; 0 is unlimited.
+	ReceiveBandwidth int64 `mapstructure:"receive_bandwidth"`
+	// Queue is the discipline in front of the bandwidth limit: fifo or fair.
+	Queue string `mapstructure:"queue"`
+	// QueueLimit bounds the packets waiting for the bandwidth limit.
+	QueueLimit int `mapstructure:"queue_limit"`
+	// QueueFull is what happens to a packet for an unlimited peer whose
+	// writer queue is full: QueueFullBlock, QueueFullDropNewest or
+	// QueueFullDropOldest.
+	QueueFull string `mapstructure:"queue_full"`
+	// WriterQueue is the number of packets queued in front of the writer,
+	// 0 takes defaultQueueLen or throughputQueueLen in throughput mode.
+	WriterQueue int `mapstructure:"writer_queue"`
+	// Bottleneck names a link in "bottlenecks" the peer shares with others,
+	// Weight is its share of it relative to the other peers, default 1.
+	Bottleneck string  `mapstructure:"bottleneck"`
+	Weight     float64 `mapstructure:"weight"`
+	// CoDel drops packets that waited too long for the bandwidth limit.
+	CoDel CoDelConfig `mapstructure:"codel"`
+	// ECNThreshold marks ECN capable packets CE when at least this many
+	// packets wait for the bandwidth limit, 0 disables marking.
+	ECNThreshold int `mapstructure:"ecn_threshold"`
+	// LocalAddr is the local ip:port the peer is dialed from, empty lets the OS pick.
+	LocalAddr string `mapstructure:"local_addr"`
+	// Impairment is applied to the packets sent to the peer.
+	Impairment ImpairmentConfig `mapstructure:"impairment"`
+	// Impairments is a chain of named impairments applied after Impairment,
+	// see Impairment and RegisterImpairment.
+	Impairments []map[string]any `mapstructure:"impairments"`
+	// DelayLimit bounds the packets the impairments delay.
+	DelayLimit DelayLimitConfig `mapstructure:"delay_limit"`
+	// DNS is an impairment chain applied to DNS packets only, before
+	// Impairments.
+	DNS DNSConfig `mapstructure:"dns"`
+	// Backoff overrides the global reconnection backoff.
+	Backoff BackoffConfig `mapstructure:"backoff"`
+	// TTLDecrement overrides the global ttl_decrement for packets from the peer.
+	TTLDecrement *bool `mapstructure:"ttl_decrement"`
+	// ServerName is sent as SNI and, with Verify, checked against the peer's
+	// certificate, signed by the roots in the CA file or the system roots.
+	ServerName string `mapstructure:"server_name"`
+	Verify     bool   `mapstructure:"verify"`
+	CA         string `mapstructure:"ca"`
+	// Compression compresses the packets sent to the peer, see
+	// CompressionDeflate.
+	Compression string `mapstructure:"compression"`
+	// Datagrams forwards the packets to the peer as unreliable QUIC
+	// datagrams instead of over the stream, DatagramOversize is what
+	// happens to packets too large for one: DatagramOversizeFragment or
+	// DatagramOversizeDrop.
+	Datagrams        bool   `mapstructure:"datagrams"`
+	DatagramOversize string `mapstructure:"datagram_oversize"`
+	// TLSProfile names the tls_profiles entry used instead of the TLS
+	// settings above.
+	TLSProfile string `mapstructure:"tls_profile"`
+	// ZeroRTT resumes the TLS session with 0-RTT data when re-dialing.
+	ZeroRTT bool `mapstructure:"zero_rtt"`
+	// IdleTimeout closes the connection once no packet was forwarded to or
+	// from the peer for this long, it is redialed with the next packet to
+	// the peer; 0 keeps it open.
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+	// BypassImpairments starts the peer with its impairments switched off,
+	// see SetImpairments.
+	BypassImpairments bool `mapstructure:"bypass_impairments"`
+	// Relay forwards the packets other peers send to the peer's virtual IP
+	// on to it instead of writing them to a tun device, see RelayConfig.
+	Relay bool `mapstructure:"relay"`
+
+	clientCert *tls.Certificate
+	rootCAs    *x509.CertPool
+}
+
+var defaultPeerConfig = PeerConfig{Mode: ModeLowLatency, Queue: QueueFIFO, QueueFull: QueueFullBlock, DatagramOversize: DatagramOversizeFragment}
+
+var peerConfigs map[string]*PeerConfig // virtual IP -> peer settings
+
+func loadPeerConfigs(peers map[string]*PeerConfig) error {
+	for vIP, pc := range peers {
+		if net.ParseIP(vIP) == nil {
+			return fmt.Errorf("peers: invalid virtual ip %q", vIP)
+		}
+		if pc == nil {
+			pc = new(PeerConfig)
+			peers[vIP] = pc
+		}
+		switch pc.Mode {
+		case "":
+			pc.Mode = defaultPeerConfig.Mode
+		case ModeLowLatency, ModeThroughput:
+		default:
+			return fmt.Errorf("peers.%s: unknown mode %q", vIP, pc.Mode)
+		}
+		switch pc.QueueFull {
+		case "":
+			pc.QueueFull = QueueFullBlock
+		case QueueFullBlock, QueueFullDropNewest, QueueFullDropOldest:
+		default:
+			return fmt.Errorf("peers.%s: unknown queue_full %q", vIP, pc.QueueFull)
+		}
+		switch pc.Queue {
+		case "":
+			pc.Queue = QueueFIFO
+		case QueueFIFO, QueueFair:
+		default:
+			return fmt.Errorf("peers.%s: unknown queue %q", vIP, pc.Queue)
+		}
+		if err := validateCompression(pc.Compression); err != nil {
+			return fmt.Errorf("peers.%s: %w", vIP, err)
+		}
+		if err := validateDatagrams(pc); err != nil {
+			return fmt.Errorf("peers.%s: %w", vIP, err)
+		}
+		if pc.Bandwidth < 0 || pc.ReceiveBandwidth < 0 || pc.QueueLimit < 0 || pc.ECNThreshold < 0 || pc.WriterQueue < 0 {
+			return fmt.Errorf("peers.%s: bandwidth, receive_bandwidth, queue_limit, ecn_threshold and writer_queue must not be negative", vIP)
+		}
+		if pc.Bottleneck != "" {
+			if _, ok := bottlenecks[pc.Bottleneck]; !ok {
+				return fmt.Errorf("peers.%s: unknown bottleneck %q", vIP, pc.Bottleneck)
+			}
+		}
+		if pc.Weight < 0 {
+			return fmt.Errorf("peers.%s: weight must not be negative", vIP)
+		}
+		if pc.CoDel.enabled() && pc.CoDel.Interval == 0 {
+			pc.CoDel.Interval = defaultCoDelInterval
+		}
+		if err := pc.CoDel.validate(); err != nil {
+			return fmt.Errorf("peers.%s.%w", vIP, err)
+		}
+		if err := pc.Impairment.check("peers." + vIP + ".impairment"); err != nil {
+			return err
+		}
+		if err := checkChainParams("peers."+vIP, pc.Impairments); err != nil {
+			return err
+		}
+		if err := pc.DelayLimit.validate(); err != nil {
+			return fmt.Errorf("peers.%s.%w", vIP, err)
+		}
+		if err := pc.backoff().validate(); err != nil {
+			return fmt.Errorf("peers.%s.backoff: %w", vIP, err)
+		}
+		if _, err := buildImpairmentChain(pc.Impairments, 0); err != nil {
+			return fmt.Errorf("peers.%s.%w", vIP, err)
+		}
+		if err := pc.DNS.validate(vIP); err != nil {
+			return err
+		}
+		if err := checkIdleTimeout(vIP, pc); err != nil {
+			return err
+		}
+		if pc.ClientCert != "" || pc.ClientKey != "" {
+			cert, err := tls.LoadX509KeyPair(pc.ClientCert, pc.ClientKey)
+			if err != nil {
+				return fmt.Errorf("peers.%s: load client certificate: %w", vIP, err)
+			}
+			pc.clientCert = &cert
+		}
+		if pc.TLSProfile != "" {
+			if _, ok := tlsProfiles[pc.TLSProfile]; !ok {
+				return fmt.Errorf("peers.%s: unknown tls_profile %q", vIP, pc.TLSProfile)
+			}
+			if pc.ClientCert != "" || pc.ClientKey != "" || pc.ServerName != "" || pc.Verify || pc.CA != "" {
+				return fmt.Errorf("peers.%s: tls_profile replaces client_cert, client_key, server_name, verify and ca", vIP)
+			}
+		}
+		if pc.Verify && pc.ServerName == "" {
+			return fmt.Errorf("peers.%s: verify needs a server_name", vIP)
+		}
+		if pc.CA != "" {
+			pem, err := os.ReadFile(pc.CA)
+			if err != nil {
+				return fmt.Errorf("peers.%s: read ca: %w", vIP, err)
+			}
+			pc.rootCAs = x509.NewCertPool()
+			if !pc.rootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("peers.%s: no certificate found in ca %s", vIP, pc.CA)
+			}
+		}
+	}
+	peerConfigs = peers
+	return nil
+}
+
+// peerConfig returns the settings for vIP, falling back to the defaults.
+func peerConfig(vIP net.IP) *PeerConfig {
+	if pc, ok := peerConfigs[vIP.String()]; ok {
+		return pc
+	}
+	pc := defaultPeerConfig
+	return &pc
+}
+
+func (pc *PeerConfig) queueLen() int {
+	switch {
+	case pc.WriterQueue > 0:
+		return pc.WriterQueue
+	case pc.Mode == ModeThroughput:
+		return throughputQueueLen
+	default:
+		return defaultQueueLen
+	}
+}
+
+// tlsConfig builds the client TLS settings used when dialing the peer.
+func (pc *PeerConfig) tlsConfig() *tls.Config {
+	var conf *tls.Config
+	if tp, ok := tlsProfiles[pc.TLSProfile]; ok {
+		conf = tp.tlsConfig()
+	} else {
+		conf = &tls.Config{
+			ServerName:         pc.ServerName,
+			InsecureSkipVerify: !pc.Verify,
+			RootCAs:            pc.rootCAs,
+			NextProtos:         []string{alpnProto},
+		}
+		if pc.clientCert != nil {
+			conf.Certificates = []tls.Certificate{*pc.clientCert}
+		}
+	}
+	if pc.ZeroRTT {
+		conf.ClientSessionCache = sessionCache
+	}
+	return conf
+}
+
+// Peer is the runtime state of a route to a remote simulator. Its queue
+// outlives individual connections: every (re)connection starts a writer
+// draining it.
+type Peer struct {
+	vIP    net.IP
+	rIP    net.IP
+	conf   *PeerConfig
+	queue  chan []byte
+	cancel context.CancelFunc
+	// done is closed once the peer is stopped, dialed once connectPeer
+	// returned
+	done   <-chan struct{}
+	dialed chan struct{}
+	// queueMu guards closing queue on removal against enqueue, senders
+	// waits for the shaper feeding it
+	queueMu     sync.RWMutex
+	queueClosed bool
+	senders     sync.WaitGroup
+	// shaper enforces the bandwidth limit in front of queue, nil if unlimited
+	shaper *Shaper
+	// rxShaper enforces the receive bandwidth limit in front of the tun
+	// devices, nil if unlimited
+	rxShaper *Shaper
+	// migrate hands a new local address to connectPeer
+	migrate chan string
+	// impairments simulate the link conditions, delay and ingressDelay hold
+	// the packets they delayed; all nil if unimpaired
+	impairments  ImpairmentChain
+	delay        *delayLine
+	ingressDelay *delayLine
+	// wire corrupts datagrams below QUIC, nil if disabled
+	wire *wireCorrupter
+	// rxDevice is the device of the listener the peer's packets last came
+	// in on, nil for the device of their destination
+	rxDevice atomic.Pointer[TunDevice]
+	// bypass is set while the impairments are switched off
+	bypass atomic.Bool
+
+	breaker CircuitBreaker
+	link    linkState
+	idle    idleState
+	stats   PeerStats
+	// txRate and rxRate are the rates to and from the peer over the last minute
+	txRate, rxRate rateWindow
+	// lastSeen is when the peer was last heard from in unix nanoseconds,
+	// only tracked with dead peer detection
+	lastSeen atomic.Int64
+	// lastAttempt is when the peer was last dialed in unix nanoseconds
+	lastAttempt atomic.Int64
+	// connected is set while a connection to the peer is up
+	connected atomic.Bool
+}
+
+func newPeer(vIP, rIP net.IP) *Peer {
+	conf := peerConfig(vIP)
+	p := &Peer{vIP: vIP, rIP: rIP, conf: conf, queue: make(chan []byte, conf.queueLen()), migrate: make(chan string, 1), dialed: make(chan struct{})}
+	p.link.teardown = make(chan struct{}, 1)
+	p.idle.init()
+	p.bypass.Store(conf.BypassImpairments)
+	if conf.Bandwidth > 0 || conf.Bottleneck != "" {
+		p.shaper = newShaper(conf.Bandwidth, conf.Queue, conf.QueueLimit)
+		p.shaper.ecnThreshold = conf.ECNThreshold
+		if conf.CoDel.enabled() {
+			p.shaper.codel = newCoDel(conf.CoDel)
+		}
+		if b, ok := bottlenecks[conf.Bottleneck]; ok {
+			weight := conf.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			p.shaper.share = &bottleneckShare{b: b, weight: weight}
+		}
+	}
+	if conf.ReceiveBandwidth > 0 {
+		p.rxShaper = newShaper(conf.ReceiveBandwidth, conf.Queue, conf.QueueLimit)
+	}
+	// every random impairment draws from a stream of its own, so enabling one
+	// leaves the decisions of the others unchanged
+	seed := peerSeed(impairmentSeed, vIP)
+	p.impairments = conf.Impairment.chain(seed)
+	if len(conf.DNS.Impairments) > 0 {
+		// the streams after those of the chain below
+		p.impairments = append(p.impairments, newDNSImpairment(conf.DNS, seed+3+int64(len(conf.Impairments)), &p.stats.DNSPackets))
+	}
+	// validated by loadPeerConfigs
+	chain, _ := buildImpairmentChain(conf.Impairments, seed+3)
+	p.impairments = append(p.impairments, chain...)
+	if len(p.impairments) > 0 {
+		p.delay = newDelayLine(conf.DelayLimit, p.enqueue)
+		p.ingressDelay = newDelayLine(conf.DelayLimit, p.receive)
+	}
+	if conf.Impairment.WireCorrupt > 0 {
+		p.wire = newWireCorrupter(conf.Impairment.WireCorrupt, seed+2)
+	}
+	return p
+}
+
+// receive hands pkt from the peer to the receive bandwidth limit, or
+// writes it to its tun device if the peer is unlimited.
+func (p *Peer) receive(pkt []byte) {
+	if p.rxShaper == nil {
+		p.deliver(pkt)
+		return
+	}
+	if !chargeMemory(pkt) {
+		return
+	}
+	flow, _ := parseFlowKey(pkt)
+	p.rxShaper.Enqueue(flow, pkt)
+}
+
+// runReceive writes the packets released by the receive bandwidth limit
+// to the tun devices until ctx is done.
+func (p *Peer) runReceive(ctx context.Context) {
+	out := make(chan []byte)
+	go p.rxShaper.run(ctx, out)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pkt := <-out:
+			releaseMemory(pkt)
+			p.deliver(pkt)
+		}
+	}
+}
+
+// deliver writes pkt from the peer to the device of the listener it came
+// in on, or of its destination.
+func (p *Peer) deliver(pkt []byte) {
+	dev := p.rxDevice.Load()
+	if dev == nil {
+		deliverPacket(pkt)
+		return
+	}
+	if err := writeMessage(dev, pkt); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// enqueue hands pkt to the bandwidth limit, or straight to the writer if
+// the peer is unlimited.
+func (p *Peer) enqueue(pkt []byte) {
+	if !chargeMemory(pkt) {
+		return
+	}
+	p.queueMu.RLock()
+	defer p.queueMu.RUnlock()
+	if p.queueClosed {
+		releaseMemory(pkt)
+		return
+	}
+	if p.shaper != nil {
+		_, inner := splitRelayHeader(pkt)
+		flow, _ := parseFlowKey(inner)
+		p.shaper.Enqueue(flow, pkt)
+		return
+	}
+	select {
+	case p.queue <- pkt:
+		return
+	default:
+	}
+	switch p.conf.QueueFull {
+	case QueueFullDropNewest:
+		p.stats.QueueDropsNewest.Add(1)
+		releaseMemory(pkt)
+	case QueueFullDropOldest:
+		for {
+			select {
+			case old := <-p.queue:
+				p.stats.QueueDropsOldest.Add(1)
+				releaseMemory(old)
+			default:
+			}
+			select {
+			case p.queue <- pkt:
+				return
+			default:
+			}
+		}
+	default:
+		p.stats.QueueBlocked.Add(1)
+		select {
+		case p.queue <- pkt:
+		case <-p.done:
+			releaseMemory(pkt)
+		}
+	}
+}
+
+// closeQueue closes the queue of the stopped peer p, which ends its writer.
+func (p *Peer) closeQueue() {
+	p.senders.Wait()
+	p.queueMu.Lock()
+	defer p.queueMu.Unlock()
+	if !p.queueClosed {
+		p.queueClosed = true
+		close(p.queue)
+	}
+}
+
+type PeerTable sync.Map
+
+func (t *PeerTable) Add(p *Peer) {
+	(*sync.Map)(t).Store(p.vIP.String(), p)
+}
+
+func (t *PeerTable) Get(vIP net.IP) (*Peer, bool) {
+	p, ok := (*sync.Map)(t).Load(vIP.String())
+	if !ok {
+		return nil, false
+	}
+	return p.(*Peer), true
+}
+
+func (t *PeerTable) Delete(vIP net.IP) {
+	(*sync.Map)(t).Delete(vIP.String())
+}
+
+func (t *PeerTable) Range(f func(p *Peer) bool) {
+	(*sync.Map)(t).Range(func(_, value any) bool {
+		return f(value.(*Peer))
+	})
+}
+
+var peerTable = new(PeerTable) // virtual IP -> peer state
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWriterExitsOnClosedQueue checks that closing the queue of a peer
+// ends its writer and connection while its context is still live.
+func TestWriterExitsOnClosedQueue(t *testing.T) {
+	ctx := runListeners(t, []ListenerConfig{{Transport: TransportQUIC, Addr: "127.0.0.1:0"}})
+	addrs, err := ListenAddrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPeer(net.ParseIP("10.0.9.1"), net.ParseIP("127.0.0.1"))
+	session, done, err := initClient(ctx, addrs[0].String(), "", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.closeQueue()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("writer still running after its queue was closed")
+	}
+	select {
+	case <-session.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection still open after its queue was closed")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("context ended before the writer")
+	}
+}
+
+// TestStopPeerClosesQueue checks that stopping a peer closes its queue and
+// later packets for it are dropped.
+func TestStopPeerClosesQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vIP := net.ParseIP("10.0.9.2")
+	startPeer(ctx, vIP, net.ParseIP("127.0.0.1"))
+	p, ok := peerTable.Get(vIP)
+	if !ok {
+		t.Fatal("peer not started")
+	}
+	defer stopServer(cancel, p)
+	stopPeer(p)
+	if _, ok := <-p.queue; ok {
+		t.Fatal("queue of the stopped peer is open")
+	}
+	p.enqueue(make([]byte, 20))
+}
+
+func TestCoalesceClosedQueue(t *testing.T) {
+	q := make(chan []byte, 2)
+	q <- []byte{1}
+	close(q)
+	var stats PeerStats
+	enc := newFrameEncoder("", &stats)
+	frames := coalesce(nil, q, enc)
+	if want := enc.appendFrame(nil, []byte{1}); string(frames) != string(want) {
+		t.Fatalf("coalesce = %x, want %x", frames, want)
+	}
+}
+
+// TestStartPeerConcurrent adds the same route from many goroutines, run
+// with -race, and checks they end up with one peer and its queue.
+func TestStartPeerConcurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vIP, rIP := net.ParseIP("10.0.9.3"), net.ParseIP("127.0.0.1")
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			startPeer(ctx, vIP, rIP)
+		}()
+	}
+	wg.Wait()
+	var peers []*Peer
+	peerTable.Range(func(p *Peer) bool {
+		if p.vIP.Equal(vIP) {
+			peers = append(peers, p)
+		}
+		return true
+	})
+	if len(peers) != 1 {
+		t.Fatalf("%d peers for %s, want 1", len(peers), vIP)
+	}
+	p := peers[0]
+	defer stopServer(cancel, p)
+	if q, ok := chanTable.Get(vIP); !ok || q != p.queue {
+		t.Fatal("channel table does not hold the queue of the peer")
+	}
+	if r, ok := iptable.Get(vIP); !ok || !r.Equal(rIP) {
+		t.Fatalf("route table has %v, want %s", r, rIP)
+	}
+}
+
+func TestWriterQueueLen(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		want int
+	}{
+		{"{}", defaultQueueLen},
+		{"{mode: low-latency}", defaultQueueLen},
+		{"{mode: throughput}", throughputQueueLen},
+		{"{mode: low-latency, writer_queue: 1}", 1},
+	} {
+		c, err := parseConfig([]byte("peers:\n  \"10.0.9.4\": "+tt.conf+"\n"), "yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = applyConfig(c); err != nil {
+			t.Fatal(err)
+		}
+		if p := newPeer(net.ParseIP("10.0.9.4"), net.ParseIP("127.0.0.1")); cap(p.queue) != tt.want {
+			t.Fatalf("%s: queue of %d packets, want %d", tt.conf, cap(p.queue), tt.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// PendingRouteConfig is read from "pending_routes". Packets read for a
+// virtual IP without a route are held for up to Timeout, at most Depth per
+// destination and MaxDestinations destinations at once, and forwarded once
+// the route is added, so the first packets to a route started by a reload,
+// a scenario or the staged startup are not lost.
+// Those still held after Timeout are dropped. Depth 0 drops such packets
+// right away.
+type PendingRouteConfig struct {
+	Depth           int           `mapstructure:"depth"`
+	Timeout         time.Duration `mapstructure:"timeout"`
+	MaxDestinations int           `mapstructure:"max_destinations"`
+}
+
+var pendingRouteConfig = PendingRouteConfig{Timeout: time.Second, MaxDestinations: 256}
+
+func (c PendingRouteConfig) validate() error {
+	if c.Depth < 0 {
+		return errors.New("pending_routes: depth must not be negative")
+	}
+	if c.Depth > 0 && (c.Timeout <= 0 || c.MaxDestinations < 1) {
+		return errors.New("pending_routes: timeout and max_destinations must be positive")
+	}
+	return nil
+}
+
+type pendingPacket struct {
+	pkt  []byte
+	hops int
+}
+
+// pendingRoute holds the packets of one destination.
+type pendingRoute struct {
+	pkts []pendingPacket
+}
+
+type pendingRouteTable struct {
+	mu    sync.Mutex
+	dests map[string]*pendingRoute
+}
+
+var pendingRoutes = pendingRouteTable{dests: make(map[string]*pendingRoute)}
+
+// hold keeps a copy of buf for vIP until its route is added, reporting
+// false if it has to be dropped instead.
+func (t *pendingRouteTable) hold(vIP net.IP, buf []byte, hops int) bool {
+	if pendingRouteConfig.Depth == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := vIP.String()
+	r, ok := t.dests[key]
+	if !ok {
+		if len(t.dests) >= pendingRouteConfig.MaxDestinations {
+			globalStats.PendingRouteDrops.Add(1)
+			return false
+		}
+		r = &pendingRoute{}
+	}
+	if len(r.pkts) >= pendingRouteConfig.Depth {
+		globalStats.PendingRouteDrops.Add(1)
+		return false
+	}
+	// buf is reused by the next read
+	pkt := append([]byte(nil), buf...)
+	if !chargeMemory(pkt) {
+		return false
+	}
+	if !ok {
+		t.dests[key] = r
+		go t.expire(key, r)
+	}
+	r.pkts = append(r.pkts, pendingPacket{pkt, hops})
+	globalStats.PendingRouteHeld.Add(1)
+	return true
+}
+
+// expire drops the packets of r still held after the timeout.
+func (t *pendingRouteTable) expire(key string, r *pendingRoute) {
+	<-clock.After(pendingRouteConfig.Timeout)
+	t.mu.Lock()
+	if t.dests[key] != r {
+		// flushed meanwhile
+		t.mu.Unlock()
+		return
+	}
+	delete(t.dests, key)
+	t.mu.Unlock()
+	for _, q := range r.pkts {
+		releaseMemory(q.pkt)
+	}
+	globalStats.PendingRouteExpired.Add(uint64(len(r.pkts)))
+	slog.Info("drop packets held for a missing route", "vIP", key, "packets", len(r.pkts))
+}
+
+// flush forwards the packets held for vIP now that its route was added.
+func (t *pendingRouteTable) flush(vIP net.IP) {
+	key := vIP.String()
+	t.mu.Lock()
+	r, ok := t.dests[key]
+	delete(t.dests, key)
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, q := range r.pkts {
+		releaseMemory(q.pkt)
+		forwardRelayed(vIP, q.pkt, q.hops)
+	}
+	globalStats.PendingRouteFlushed.Add(uint64(len(r.pkts)))
+	slog.Info("forward packets held for a missing route", "vIP", vIP, "packets", len(r.pkts))
+}
+
+// Held returns the number of packets waiting for their routes.
+func (t *pendingRouteTable) Held() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, r := range t.dests {
+		n += len(r.pkts)
+	}
+	return n
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// FlowMatch selects packets by their 5-tuple. Empty fields and zero ports
+// match anything.
+type FlowMatch struct {
+	// Src and Dst are an address or a CIDR prefix.
+	Src     string `mapstructure:"src"`
+	Dst     string `mapstructure:"dst"`
+	Proto   string `mapstructure:"proto"`
+	SrcPort uint16 `mapstructure:"src_port"`
+	DstPort uint16 `mapstructure:"dst_port"`
+	// ICMPType and ICMPCode select ICMP packets, any if unset.
+	ICMPType *uint8 `mapstructure:"icmp_type"`
+	ICMPCode *uint8 `mapstructure:"icmp_code"`
+
+	src, dst netip.Prefix
+	proto    uint8
+}
+
+var protoNames = map[string]uint8{"icmp": protoICMP, "icmpv6": protoICMPv6, "tcp": protoTCP, "udp": protoUDP}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if s == "" {
+		return netip.Prefix{}, nil
+	}
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// compile parses the fields of m.
+func (m *FlowMatch) compile() error {
+	var err error
+	if m.src, err = parsePrefix(m.Src); err != nil {
+		return fmt.Errorf("src: %w", err)
+	}
+	if m.dst, err = parsePrefix(m.Dst); err != nil {
+		return fmt.Errorf("dst: %w", err)
+	}
+	if m.Proto != "" {
+		var ok bool
+		if m.proto, ok = protoNames[strings.ToLower(m.Proto)]; !ok {
+			return fmt.Errorf("unknown proto %q", m.Proto)
+		}
+	}
+	if (m.ICMPType != nil || m.ICMPCode != nil) && m.proto != protoICMP && m.proto != protoICMPv6 {
+		return fmt.Errorf("icmp_type and icmp_code need proto icmp or icmpv6")
+	}
+	return nil
+}
+
+func (m *FlowMatch) match(flow FlowKey) bool {
+	return (!m.src.IsValid() || m.src.Contains(flow.Src)) &&
+		(!m.dst.IsValid() || m.dst.Contains(flow.Dst)) &&
+		(m.proto == 0 || m.proto == flow.Proto) &&
+		(m.SrcPort == 0 || m.SrcPort == flow.SrcPort) &&
+		(m.DstPort == 0 || m.DstPort == flow.DstPort) &&
+		(m.ICMPType == nil || *m.ICMPType == flow.ICMPType) &&
+		(m.ICMPCode == nil || *m.ICMPCode == flow.ICMPCode)
+}
+
+// PolicyRule sends matching packets to the peer of Via instead of the one
+// routed for their destination, or spreads them over the peers of Paths.
+type PolicyRule struct {
+	// Rules are tried by ascending priority, the first match wins.
+	Priority  int `mapstructure:"priority"`
+	FlowMatch `mapstructure:",squash"`
+	Via       string `mapstructure:"via"`
+	// Paths replace Via with several peers picked per packet by Balance.
+	Paths   []PathConfig `mapstructure:"paths"`
+	Balance string       `mapstructure:"balance"`
+
+	via   net.IP
+	paths []net.IP // one entry per unit of weight
+	next  atomic.Uint64
+}
+
+// PathConfig is one of the peers of a multipath rule, Weight defaults to 1.
+type PathConfig struct {
+	Via    string `mapstructure:"via"`
+	Weight int    `mapstructure:"weight"`
+}
+
+const (
+	// BalanceRoundRobin sends packet after packet to the next path,
+	// BalanceHash keeps every flow on the path its 5-tuple hashes to like
+	// ECMP, so flows are not reordered. Both honour the path weights.
+	BalanceRoundRobin = "round_robin"
+	BalanceHash       = "hash"
+)
+
+// pick returns the path of the packet of flow.
+func (r *PolicyRule) pick(flow FlowKey) net.IP {
+	if len(r.paths) == 0 {
+		return r.via
+	}
+	if r.Balance == BalanceHash {
+		return r.paths[flowHash(flow)%uint32(len(r.paths))]
+	}
+	return r.paths[(r.next.Add(1)-1)%uint64(len(r.paths))]
+}
+
+// peek returns the path pick would return for flow, without moving the
+// round robin on.
+func (r *PolicyRule) peek(flow FlowKey) net.IP {
+	if len(r.paths) == 0 || r.Balance == BalanceHash {
+		return r.pick(flow)
+	}
+	return r.paths[r.next.Load()%uint64(len(r.paths))]
+}
+
+func (r *PolicyRule) compilePaths() error {
+	switch r.Balance {
+	case "":
+		r.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceHash:
+	default:
+		return fmt.Errorf("unknown balance %q", r.Balance)
+	}
+	if r.Via != "" {
+		return fmt.Errorf("via and paths are exclusive")
+	}
+	for i, pc := range r.Paths {
+		via := net.ParseIP(pc.Via)
+		if via == nil {
+			return fmt.Errorf("paths[%d]: via %q is not a virtual ip", i, pc.Via)
+		}
+		weight := pc.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		if weight < 0 || weight > 100 {
+			return fmt.Errorf("paths[%d]: weight must be within 1 and 100", i)
+		}
+		for j := 0; j < weight; j++ {
+			r.paths = append(r.paths, via)
+		}
+	}
+	return nil
+}
+
+var policyRules []*PolicyRule
+
+// loadPolicyRules validates rules and installs them in priority order.
+func loadPolicyRules(rules []*PolicyRule) error {
+	for i, r := range rules {
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		if len(r.Paths) > 0 {
+			if err := r.compilePaths(); err != nil {
+				return fmt.Errorf("rules[%d]: %w", i, err)
+			}
+			continue
+		}
+		if r.via = net.ParseIP(r.Via); r.via == nil {
+			return fmt.Errorf("rules[%d]: via %q is not a virtual ip", i, r.Via)
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority < rules[j].Priority })
+	policyRules = rules
+	return nil
+}
+
+// routeFor returns the virtual IP whose peer carries flow: that of the
+// first matching policy rule, or else the destination.
+func routeFor(flow FlowKey) net.IP {
+	if r := matchRule(flow); r != nil {
+		return r.pick(flow)
+	}
+	return net.IP(flow.Dst.AsSlice())
+}
+
+// matchRule returns the first policy rule matching flow, nil if none does.
+func matchRule(flow FlowKey) *PolicyRule {
+	for _, r := range policyRules {
+		if r.match(flow) {
+			return r
+		}
+	}
+	return nil
+}
+
+// RouteFunc decides where a packet read from a tun device goes, given its
+// flow and the packet, which it must neither change nor keep. It returns
+// the virtual IP of the peer to send it to, nil to fall back to the rules
+// and routes, or false to drop the packet. It is called concurrently for
+// every packet.
+type RouteFunc func(flow FlowKey, packet []byte) (vIP net.IP, forward bool)
+
+var routeFunc atomic.Pointer[RouteFunc]
+
+// SetRouteFunc makes f decide the routes before the rules and the route
+// table, nil restores the default routing.
+func SetRouteFunc(f RouteFunc) {
+	if f == nil {
+		routeFunc.Store(nil)
+		return
+	}
+	routeFunc.Store(&f)
+}
+
+// routePacketTo returns the virtual IP whose peer carries packet of flow,
+// asking the RouteFunc first if one is set. It reports false if the
+// RouteFunc dropped the packet.
+func routePacketTo(flow FlowKey, packet []byte) (net.IP, bool) {
+	if f := routeFunc.Load(); f != nil {
+		vIP, forward := (*f)(flow, packet)
+		if !forward {
+			return nil, false
+		}
+		if vIP != nil {
+			return vIP, true
+		}
+	}
+	return routeFor(flow), true
+}
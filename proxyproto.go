@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// PROXY protocol v2, see https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+const (
+	proxyV2HeaderLen = 16
+	proxyV2Version   = 0x2
+	proxyCmdLocal    = 0x0
+	proxyCmdProxy    = 0x1
+
+	proxyFamUnspec = 0x0
+	proxyFamInet   = 0x1
+	proxyFamInet6  = 0x2
+	proxyFamUnix   = 0x3
+
+	proxyProtoUnspec = 0x0
+	proxyProtoStream = 0x1
+	proxyProtoDgram  = 0x2
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errMalformedProxyHeader = errors.New("malformed proxy protocol header")
+
+// readProxyHeader reads a PROXY protocol v2 header from r and returns the
+// source address it carries. A LOCAL command or an unspecified/unix family
+// yields a nil address, in which case the caller should keep using the
+// address of the underlying connection.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	hdr := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedProxyHeader, err)
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return nil, fmt.Errorf("%w: bad signature", errMalformedProxyHeader)
+	}
+	if hdr[12]>>4 != proxyV2Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", errMalformedProxyHeader, hdr[12]>>4)
+	}
+	cmd := hdr[12] & 0x0f
+	fam, proto := hdr[13]>>4, hdr[13]&0x0f
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedProxyHeader, err)
+	}
+
+	switch cmd {
+	case proxyCmdLocal:
+		return nil, nil
+	case proxyCmdProxy:
+	default:
+		return nil, fmt.Errorf("%w: unknown command %d", errMalformedProxyHeader, cmd)
+	}
+
+	var ipLen int
+	switch fam {
+	case proxyFamUnspec, proxyFamUnix:
+		return nil, nil
+	case proxyFamInet:
+		ipLen = net.IPv4len
+	case proxyFamInet6:
+		ipLen = net.IPv6len
+	default:
+		return nil, fmt.Errorf("%w: unknown address family %d", errMalformedProxyHeader, fam)
+	}
+	// src addr, dst addr, src port, dst port; anything after is TLVs
+	if len(body) < 2*ipLen+4 {
+		return nil, fmt.Errorf("%w: address block too short (%d bytes)", errMalformedProxyHeader, len(body))
+	}
+	ip := net.IP(append([]byte(nil), body[:ipLen]...))
+	port := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+
+	switch proto {
+	case proxyProtoStream:
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	case proxyProtoDgram, proxyProtoUnspec:
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown transport protocol %d", errMalformedProxyHeader, proto)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/quic-go/quic-go"
+)
+
+// CCCubic is the congestion controller of quic-go. The library keeps its
+// congestion control internal: v0.39 always runs Cubic (with a Reno mode
+// that can not be enabled from outside) and offers no BBR, so "cubic" is
+// the only value accepted for congestion_control. The setting exists so
+// configs state the controller explicitly and fail loudly if they ask for
+// one that is not available.
+const CCCubic = "cubic"
+
+var congestionControls = []string{CCCubic}
+
+var congestionControl = CCCubic
+
+func validateCongestionControl(cc string) error {
+	if !slices.Contains(congestionControls, cc) {
+		return fmt.Errorf("congestion control %q is not supported, available: %v", cc, congestionControls)
+	}
+	return nil
+}
+
+// quicConfig returns the QUIC config shared by client and server
+// connections, with the selected congestion controller.
+func quicConfig() *quic.Config {
+	// quic-go has no knob for the controller, see CCCubic.
+	return &quic.Config{Versions: quicVersions}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+const quicModule = "github.com/quic-go/quic-go"
+
+var quicVersionNames = map[string]quic.VersionNumber{"v1": quic.Version1, "v2": quic.Version2}
+
+// quicVersions pins the QUIC versions offered and accepted, read from
+// "quic_versions" in order of preference; empty leaves the choice to
+// quic-go.
+var quicVersions []quic.VersionNumber
+
+// quicLibrary is the version of quic-go built in, "unknown" if the binary
+// carries no build info.
+var quicLibrary = func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == quicModule {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}()
+
+// loadQUICVersions reads the quic_versions names into quicVersions. A set
+// quic_library must name the built-in quic-go, so results are not compared
+// across library versions by accident.
+func loadQUICVersions(names []string, library string) error {
+	if library != "" && library != quicLibrary {
+		return fmt.Errorf("quic_library: config pins %s, built with %s", library, quicLibrary)
+	}
+	quicVersions = nil
+	for _, name := range names {
+		v, ok := quicVersionNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("quic_versions: unknown version %q", name)
+		}
+		quicVersions = append(quicVersions, v)
+	}
+	return nil
+}
+
+// QUICParams are what a QUIC connection negotiated.
+type QUICParams struct {
+	Version     string `json:"version"`
+	ALPN        string `json:"alpn"`
+	CipherSuite string `json:"cipher_suite"`
+	TLSVersion  string `json:"tls_version"`
+}
+
+func quicParams(state quic.ConnectionState) QUICParams {
+	return QUICParams{
+		Version:     state.Version.String(),
+		ALPN:        state.TLS.NegotiatedProtocol,
+		CipherSuite: tls.CipherSuiteName(state.TLS.CipherSuite),
+		TLSVersion:  tls.VersionName(state.TLS.Version),
+	}
+}
+
+func (q QUICParams) String() string {
+	return q.Version + " " + q.ALPN + " " + q.CipherSuite
+}
+
+func quicVersionNamesOf(versions []quic.VersionNumber) []string {
+	var names []string
+	for _, v := range versions {
+		names = append(names, v.String())
+	}
+	return names
+}
+
+// logQUICInfo logs the quic-go version and the QUIC versions in use at
+// startup.
+func logQUICInfo() {
+	versions := "default"
+	if len(quicVersions) > 0 {
+		versions = strings.Join(quicVersionNamesOf(quicVersions), ",")
+	}
+	slog.Info("quic", "library", quicLibrary, "versions", versions)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// rateBuckets is the window of a rateWindow in one second buckets.
+const rateBuckets = 60
+
+// rateWindow counts packets and bytes per second over the last minute in
+// a ring of buckets, so memory stays fixed however long the peer runs.
+type rateWindow struct {
+	mu      sync.Mutex
+	sec     [rateBuckets]int64 // unix second a bucket counts
+	packets [rateBuckets]uint64
+	bytes   [rateBuckets]uint64
+}
+
+func (w *rateWindow) add(n int) {
+	now := clock.Now().Unix()
+	i := now % rateBuckets
+	w.mu.Lock()
+	if w.sec[i] != now {
+		w.sec[i], w.packets[i], w.bytes[i] = now, 0, 0
+	}
+	w.packets[i]++
+	w.bytes[i] += uint64(n)
+	w.mu.Unlock()
+}
+
+func (w *rateWindow) reset() {
+	w.mu.Lock()
+	w.sec, w.packets, w.bytes = [rateBuckets]int64{}, [rateBuckets]uint64{}, [rateBuckets]uint64{}
+	w.mu.Unlock()
+}
+
+// Percentiles summarize the per-second rates of a window.
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// RateSnapshot is the distribution of the packet and bit rates over the
+// completed seconds of the last minute, seconds without traffic count as 0.
+type RateSnapshot struct {
+	PPS Percentiles `json:"pps"`
+	BPS Percentiles `json:"bps"`
+}
+
+func (w *rateWindow) snapshot() RateSnapshot {
+	now := clock.Now().Unix()
+	pps := make([]float64, 0, rateBuckets-1)
+	bps := make([]float64, 0, rateBuckets-1)
+	w.mu.Lock()
+	for s := now - rateBuckets + 1; s < now; s++ {
+		i := s % rateBuckets
+		if w.sec[i] == s {
+			pps = append(pps, float64(w.packets[i]))
+			bps = append(bps, float64(w.bytes[i]*8))
+		} else {
+			pps = append(pps, 0)
+			bps = append(bps, 0)
+		}
+	}
+	w.mu.Unlock()
+	return RateSnapshot{PPS: percentiles(pps), BPS: percentiles(bps)}
+}
+
+func percentiles(v []float64) Percentiles {
+	sort.Float64s(v)
+	at := func(q float64) float64 { return v[int(q*float64(len(v)-1))] }
+	return Percentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: v[len(v)-1]}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"net"
+)
+
+// TunReadConfig spreads the work after a tun read over a worker pool, read
+// from "tun_read". A device is still read by a single goroutine; packets of
+// the same flow always go to the same worker so they stay in order.
+type TunReadConfig struct {
+	Workers int `mapstructure:"workers"`
+	// Queue is the number of packets waiting per worker.
+	Queue int `mapstructure:"queue"`
+}
+
+var tunReadConfig = TunReadConfig{Workers: 1, Queue: 256}
+
+// forwardPacket routes a packet read from a tun device to its peer,
+// reassembling fragments first if configured.
+func forwardPacket(packet []byte, send func(vIP net.IP, buf []byte)) {
+	if isIPv4Fragment(packet) {
+		if fragOffset(packet) == 0 {
+			globalStats.FragmentedDatagrams.Add(1)
+		}
+		if fragmentConfig.Reassemble {
+			for _, pkt := range fragments.add(packet) {
+				routePacket(pkt, send)
+			}
+			return
+		}
+	}
+	routePacket(packet, send)
+}
+
+func routePacket(packet []byte, send func(vIP net.IP, buf []byte)) {
+	// parseFlowKey honours the IHL field and skips IPv6 extension headers,
+	// so packets carrying IP options get their ports read from the real L4
+	// header.
+	flow, ok := parseFlowKey(routingHeader(packet))
+	if !ok {
+		if !forwardPassthrough(packet) {
+			slog.Info("is not an ip packet")
+		}
+		return
+	}
+	countIPv6ExtHeaders(packet)
+	logFlow(flow)
+	countICMPEcho(flow)
+	flowTable.Record(flow, packet)
+	vIP, forward := routePacketTo(flow, packet)
+	if !forward {
+		globalStats.RouteFuncDrops.Add(1)
+		return
+	}
+	send(vIP, packet)
+	slog.Info("send packet", "len", len(packet), "vIP", vIP.String())
+}
+
+// flowWorker picks the worker of packet's flow, non-IPv4 packets all go
+// to the first one.
+func flowWorker(packet []byte, n int) int {
+	flow, ok := parseFlowKey(routingHeader(packet))
+	if !ok {
+		return 0
+	}
+	return int(flowHash(flow) % uint32(n))
+}
+
+// flowHash is the FNV-1a hash of the 5-tuple, the same for every packet of
+// a flow.
+func flowHash(flow FlowKey) uint32 {
+	h := fnv.New32a()
+	h.Write(flow.Src.AsSlice())
+	h.Write(flow.Dst.AsSlice())
+	h.Write([]byte{byte(flow.SrcPort >> 8), byte(flow.SrcPort), byte(flow.DstPort >> 8), byte(flow.DstPort), flow.Proto})
+	return h.Sum32()
+}
+
+// readPool forwards packets on a fixed set of workers.
+type readPool struct {
+	workers []chan []byte
+}
+
+func newReadPool(ctx context.Context, conf TunReadConfig, send func(vIP net.IP, buf []byte)) *readPool {
+	pool := &readPool{workers: make([]chan []byte, conf.Workers)}
+	for i := range pool.workers {
+		ch := make(chan []byte, conf.Queue)
+		pool.workers[i] = ch
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case pkt := <-ch:
+					forwardPacket(pkt, send)
+				}
+			}
+		}()
+	}
+	return pool
+}
+
+// dispatch hands a copy of packet to the worker of its flow.
+func (pool *readPool) dispatch(ctx context.Context, packet []byte) {
+	pkt := append([]byte(nil), packet...)
+	select {
+	case <-ctx.Done():
+	case pool.workers[flowWorker(pkt, len(pool.workers))] <- pkt:
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// flowPackets returns n packets spread round robin over flows UDP flows,
+// each carrying its flow and its number within the flow.
+func flowPackets(flows, n int) [][]byte {
+	src, dst := netip.MustParseAddr("10.0.1.1"), netip.MustParseAddr("10.0.9.9")
+	pkts := make([][]byte, n)
+	for i := range pkts {
+		payload := make([]byte, 64)
+		binary.BigEndian.PutUint32(payload, uint32(i%flows))
+		binary.BigEndian.PutUint32(payload[4:], uint32(i/flows))
+		pkts[i] = udpPacket(src, dst, uint16(40000+i%flows), 9, nil, payload)
+	}
+	return pkts
+}
+
+// quietLog discards the per-packet logs until the test ends.
+func quietLog(tb testing.TB) {
+	log := slog.Default()
+	tb.Cleanup(func() { slog.SetDefault(log) })
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestReadPoolFlowOrder(t *testing.T) {
+	quietLog(t)
+	const flows, n = 16, 4000
+	pkts := flowPackets(flows, n)
+	workers := map[int]bool{}
+	for _, pkt := range pkts[:flows] {
+		workers[flowWorker(pkt, 4)] = true
+	}
+	if len(workers) < 2 {
+		t.Fatal("the flows all map to one worker")
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make([]uint32, flows)
+	wg.Add(n)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := newReadPool(ctx, TunReadConfig{Workers: 4, Queue: 16}, func(_ net.IP, pkt []byte) {
+		defer wg.Done()
+		payload := pkt[ipv4MinHeaderLen+8:]
+		flow, seq := binary.BigEndian.Uint32(payload), binary.BigEndian.Uint32(payload[4:])
+		mu.Lock()
+		defer mu.Unlock()
+		if seq != next[flow] {
+			t.Errorf("flow %d: packet %d forwarded before %d", flow, seq, next[flow])
+		}
+		next[flow] = seq + 1
+	})
+	for _, pkt := range pkts {
+		pool.dispatch(ctx, pkt)
+	}
+	wg.Wait()
+}
+
+// BenchmarkForward forwards packets of many flows inline, as with one
+// tun_read worker, and over a pool of four workers.
+func BenchmarkForward(b *testing.B) {
+	quietLog(b)
+	pkts := flowPackets(64, 1024)
+	for _, workers := range []int{1, 4} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			var wg sync.WaitGroup
+			send := func(net.IP, []byte) { wg.Done() }
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var pool *readPool
+			if workers > 1 {
+				pool = newReadPool(ctx, TunReadConfig{Workers: workers, Queue: 256}, send)
+			}
+			wg.Add(b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pkt := pkts[i%len(pkts)]
+				if pool != nil {
+					pool.dispatch(ctx, pkt)
+					continue
+				}
+				forwardPacket(pkt, send)
+			}
+			wg.Wait()
+		})
+	}
+}
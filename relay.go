@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+)
+
+// Packets a peer with relay set receives from other peers for the virtual
+// IP of a relay peer are forwarded to that peer instead of written to a tun
+// device, so connected simulators form a multi-hop path with the
+// impairments of every hop. A relayed packet travels with a relay header in
+// front of it: relayMagic and the number of hops it was relayed, dropped
+// once it reaches the max_hops of "relay" so routing loops die out.
+
+// relayMagic starts the relay header, IP packets start with their version,
+// never 0.
+const relayMagic = "\x00RL"
+
+const relayHeaderLen = len(relayMagic) + 1
+
+// RelayConfig is read from "relay".
+type RelayConfig struct {
+	MaxHops int `mapstructure:"max_hops"`
+}
+
+var relayConfig = RelayConfig{MaxHops: 8}
+
+func (c *RelayConfig) validate() error {
+	if c.MaxHops < 1 || c.MaxHops > 255 {
+		return errors.New("relay: max_hops must be within [1, 255]")
+	}
+	return nil
+}
+
+// withRelayHeader returns pkt behind a relay header of hops, pkt itself for
+// a packet that was not relayed.
+func withRelayHeader(pkt []byte, hops int) []byte {
+	if hops == 0 {
+		return pkt
+	}
+	return relayHeader(pkt, hops)
+}
+
+func relayHeader(pkt []byte, hops int) []byte {
+	out := make([]byte, 0, relayHeaderLen+len(pkt))
+	out = append(out, relayMagic...)
+	out = append(out, byte(hops))
+	return append(out, pkt...)
+}
+
+// splitRelayHeader returns the hops of the relay header of pkt and the
+// packet behind it, 0 and pkt if it has none.
+func splitRelayHeader(pkt []byte) (int, []byte) {
+	if len(pkt) < relayHeaderLen || !bytes.HasPrefix(pkt, []byte(relayMagic)) {
+		return 0, pkt
+	}
+	return int(pkt[len(relayMagic)]), pkt[relayHeaderLen:]
+}
+
+// relayPacket forwards packet, received from a peer after hops relays, to
+// the relay peer it is addressed to. It reports false if the destination is
+// no relay peer and the packet is for a tun device.
+func relayPacket(packet []byte, hops int, flow FlowKey) bool {
+	vIP := net.IP(flow.Dst.AsSlice())
+	p, ok := peerTable.Get(vIP)
+	if !ok || !p.conf.Relay {
+		return false
+	}
+	if hops >= relayConfig.MaxHops {
+		globalStats.RelayHopDrops.Add(1)
+		slog.Warn("drop relayed packet exceeding max hops, routing loop?", "flow", flow, "hops", hops)
+		logAccess(DirIngress, packet, vIP, "max hops")
+		return true
+	}
+	globalStats.Relayed.Add(1)
+	if Paused() && gate.hold(packet, func(pkt []byte) { forwardRelayed(vIP, pkt, hops+1) }) {
+		return true
+	}
+	forwardRelayed(vIP, packet, hops+1)
+	return true
+}
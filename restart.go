@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Graceful restart on SIGUSR2 starts a new simulator process that inherits
+// the server's UDP socket, so the listen port never goes away, and then
+// exits. Limitations:
+//   - it relies on passing file descriptors to a child and only works on
+//     Unix-like systems.
+//   - QUIC connection state lives in the process: connections to the old
+//     process are lost and peers reconnect to the new one, which is quick
+//     with zero_rtt but not seamless.
+//   - the tun devices can not be shared, the new process only creates its
+//     own once the old one exited and released them.
+var gracefulRestart bool
+
+const (
+	listenFDEnv  = "SIMULATOR_LISTEN_FD"
+	parentPIDEnv = "SIMULATOR_PARENT_PID"
+)
+
+// serverConn is the socket of the first QUIC listener, handed to the new
+// process.
+var serverConn *net.UDPConn
+
+// listenUDP binds addr, or returns the inherited listen socket if inherit
+// is set and there is one.
+func listenUDP(addr string, inherit bool) (*net.UDPConn, error) {
+	if s := os.Getenv(listenFDEnv); inherit && s != "" {
+		fd, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", listenFDEnv, err)
+		}
+		f := os.NewFile(uintptr(fd), "listener")
+		defer f.Close()
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, err
+		}
+		conn, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			return nil, fmt.Errorf("inherited listener is not a udp socket")
+		}
+		slog.Info("inherited listen socket", "addr", conn.LocalAddr().String())
+		return conn, nil
+	}
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", uaddr)
+}
+
+// restart starts a copy of the running binary with the listen socket.
+func restart() error {
+	if serverConn == nil {
+		return fmt.Errorf("server is not listening")
+	}
+	f, err := serverConn.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// ExtraFiles start at fd 3 in the child
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", parentPIDEnv+"="+strconv.Itoa(os.Getpid()))
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	slog.Info("started new process", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// waitForParent blocks a restarted process until the old one exited.
+func waitForParent() {
+	pid, err := strconv.Atoi(os.Getenv(parentPIDEnv))
+	if err != nil {
+		return
+	}
+	for os.Getppid() == pid {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "fmt"
+
+const (
+	// RoleServer only accepts peers, RoleClient only dials them.
+	RoleServer = "server"
+	RoleClient = "client"
+	RoleBoth   = "both"
+)
+
+// role is read from "role" and decides which of the listeners and the peer
+// connections a node runs.
+var role = RoleBoth
+
+func validateRole(r string) error {
+	switch r {
+	case RoleServer, RoleClient, RoleBoth:
+		return nil
+	}
+	return fmt.Errorf("role: %q is none of %s, %s and %s", r, RoleServer, RoleClient, RoleBoth)
+}
+
+func runsServer() bool { return role != RoleClient }
+
+func runsClient() bool { return role != RoleServer }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync/atomic"
+)
+
+const (
+	// RPFStrict accepts packets read from an interface only from sources
+	// within its own subnet.
+	RPFStrict = "strict"
+	// RPFLoose accepts sources within the subnet of any tun interface.
+	RPFLoose = "loose"
+)
+
+// RPFConfig is the reverse path filter of one tun interface, read from
+// "rpf" keyed by interface name. Interfaces without one accept any source.
+// Only IPv4 sources are checked, the interface subnets are IPv4.
+type RPFConfig struct {
+	Mode string `mapstructure:"mode"`
+	// Allow lists further addresses or prefixes accepted as sources.
+	Allow []string `mapstructure:"allow"`
+}
+
+var rpfConfigs map[string]RPFConfig
+
+func validateRPFConfigs(confs map[string]RPFConfig) error {
+	for name, rc := range confs {
+		if rc.Mode != RPFStrict && rc.Mode != RPFLoose {
+			return fmt.Errorf("rpf.%s: mode must be %s or %s, got %q", name, RPFStrict, RPFLoose, rc.Mode)
+		}
+		for i, s := range rc.Allow {
+			if prefix, err := parsePrefix(s); err != nil || !prefix.IsValid() {
+				return fmt.Errorf("rpf.%s.allow[%d]: %q is not an address or prefix", name, i, s)
+			}
+		}
+	}
+	return nil
+}
+
+// rpfFilter drops the packets of a device from unexpected sources.
+type rpfFilter struct {
+	mode  string
+	own   *net.IPNet
+	allow []netip.Prefix
+	drops atomic.Uint64
+}
+
+// newRPFFilter returns the filter configured for dev, nil if none is.
+func newRPFFilter(dev *TunDevice) *rpfFilter {
+	rc, ok := rpfConfigs[dev.name]
+	if !ok {
+		return nil
+	}
+	f := &rpfFilter{mode: rc.Mode, own: &net.IPNet{IP: net.ParseIP(dev.ip).Mask(dev.mask), Mask: dev.mask}}
+	for _, s := range rc.Allow {
+		// validated by validateRPFConfigs
+		prefix, _ := parsePrefix(s)
+		f.allow = append(f.allow, prefix.Masked())
+	}
+	return f
+}
+
+// accept reports whether packet read from the device has an acceptable
+// source, counting and logging it if not.
+func (f *rpfFilter) accept(name string, packet []byte) bool {
+	if f == nil || !validIPv4Header(packet) {
+		return true
+	}
+	src := net.IP(packet[12:16])
+	if f.own.Contains(src) || f.allowed(src) {
+		return true
+	}
+	if f.mode == RPFLoose {
+		loose := false
+		devTable.Range(func(dev *TunDevice) bool {
+			loose = (&net.IPNet{IP: net.ParseIP(dev.ip).Mask(dev.mask), Mask: dev.mask}).Contains(src)
+			return !loose
+		})
+		if loose {
+			return true
+		}
+	}
+	f.drops.Add(1)
+	globalStats.RPFDrops.Add(1)
+	slog.Warn("drop packet failing reverse path filter", "name", name, "src", src, "mode", f.mode)
+	return false
+}
+
+func (f *rpfFilter) allowed(src net.IP) bool {
+	addr, _ := netip.AddrFromSlice(src.To4())
+	for _, prefix := range f.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// scenarioFile is the -scenario to run, empty runs none.
+var scenarioFile string
+
+// Actions of a scenario step. Most do what the admin api endpoint of the
+// same name does.
+const (
+	// ActionLink takes the link to Peer down or brings it up, see SetLink.
+	ActionLink = "link"
+	// ActionLoss replaces the egress impairment.loss of Peer with Loss.
+	ActionLoss = "loss"
+	// ActionRoute starts routing Peer to Remote, an empty Remote removes
+	// the route.
+	ActionRoute = "route"
+	// ActionInject forwards Count packets of Flow, Interval apart, as if
+	// they had been read from a tun device.
+	ActionInject = "inject"
+	// ActionAssert compares Counter of the stats, of Peer if set, with
+	// Value.
+	ActionAssert = "assert"
+	ActionPause  = "pause"
+	ActionResume = "resume"
+	ActionCycle  = "cycle"
+	// ActionMigrate re-dials Peer from Local.
+	ActionMigrate = "migrate"
+	// ActionImpairments switches the impairments of Peer off or on by State.
+	ActionImpairments = "impairments"
+)
+
+// ScenarioStep is an action run At after the scenario started.
+type ScenarioStep struct {
+	At       time.Duration `mapstructure:"at"`
+	Action   string        `mapstructure:"action"`
+	Peer     string        `mapstructure:"peer"`
+	State    string        `mapstructure:"state"`
+	Teardown bool          `mapstructure:"teardown"`
+	Loss     float64       `mapstructure:"loss"`
+	Remote   string        `mapstructure:"remote"`
+	Local    string        `mapstructure:"local"`
+	// Flow takes the keys of the query of GET /route/explain.
+	Flow     map[string]string `mapstructure:"flow"`
+	Count    int               `mapstructure:"count"`
+	Interval time.Duration     `mapstructure:"interval"`
+	// Counter names a field of GET /stats, or of the peer's stats there,
+	// with dots into nested objects, e.g. aggregate.tx_pps.
+	Counter string  `mapstructure:"counter"`
+	Op      string  `mapstructure:"op"`
+	Value   float64 `mapstructure:"value"`
+
+	flow FlowKey
+}
+
+// Scenario is a sequence of timed steps read from a -scenario file.
+type Scenario struct {
+	Name  string         `mapstructure:"name"`
+	Steps []ScenarioStep `mapstructure:"steps"`
+}
+
+var assertOps = map[string]func(got, want float64) bool{
+	"==": func(got, want float64) bool { return got == want },
+	"!=": func(got, want float64) bool { return got != want },
+	"<":  func(got, want float64) bool { return got < want },
+	"<=": func(got, want float64) bool { return got <= want },
+	">":  func(got, want float64) bool { return got > want },
+	">=": func(got, want float64) bool { return got >= want },
+}
+
+// loadScenario reads and validates the scenario in file, yaml or json by
+// its extension.
+func loadScenario(file string) (*Scenario, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(data, formatOf(file))
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	if err = c.Decode(&s); err != nil {
+		return nil, err
+	}
+	for i := range s.Steps {
+		if err = s.Steps[i].validate(); err != nil {
+			return nil, fmt.Errorf("steps[%d]: %w", i, err)
+		}
+	}
+	sort.SliceStable(s.Steps, func(i, j int) bool { return s.Steps[i].At < s.Steps[j].At })
+	return &s, nil
+}
+
+func (st *ScenarioStep) validate() error {
+	if st.At < 0 {
+		return errors.New("at must not be negative")
+	}
+	needsPeer := false
+	switch st.Action {
+	case ActionLink:
+		needsPeer = true
+		if st.State != "up" && st.State != "down" {
+			return errors.New("link: state must be down or up")
+		}
+	case ActionLoss:
+		needsPeer = true
+		if st.Loss < 0 || st.Loss > 1 {
+			return errors.New("loss: loss must be within [0, 1]")
+		}
+	case ActionRoute:
+		needsPeer = true
+		if st.Remote != "" && net.ParseIP(st.Remote) == nil {
+			return fmt.Errorf("route: invalid remote %q", st.Remote)
+		}
+	case ActionMigrate:
+		needsPeer = true
+	case ActionImpairments:
+		needsPeer = true
+		if st.State != "off" && st.State != "on" {
+			return errors.New("impairments: state must be off or on")
+		}
+	case ActionInject:
+		q := make(url.Values)
+		for k, v := range st.Flow {
+			q.Set(k, v)
+		}
+		flow, err := flowFromQuery(q)
+		if err != nil {
+			return fmt.Errorf("inject: flow %w", err)
+		}
+		st.flow = flow
+		if st.Count == 0 {
+			st.Count = 1
+		}
+		if st.Count < 0 || st.Interval < 0 {
+			return errors.New("inject: count and interval must not be negative")
+		}
+	case ActionAssert:
+		if st.Counter == "" {
+			return errors.New("assert: counter is required")
+		}
+		if _, ok := assertOps[st.Op]; !ok {
+			return fmt.Errorf("assert: unknown op %q", st.Op)
+		}
+		if st.Peer != "" && net.ParseIP(st.Peer) == nil {
+			return fmt.Errorf("assert: invalid peer %q", st.Peer)
+		}
+	case ActionPause, ActionResume, ActionCycle:
+	default:
+		return fmt.Errorf("unknown action %q", st.Action)
+	}
+	if needsPeer && net.ParseIP(st.Peer) == nil {
+		return fmt.Errorf("%s: invalid peer %q", st.Action, st.Peer)
+	}
+	return nil
+}
+
+// runScenario runs the steps of s at their time until they are done or ctx
+// is. It returns whether every step succeeded and every assertion held.
+func runScenario(ctx context.Context, s *Scenario) bool {
+	slog.Info("scenario started", "name", s.Name, "steps", len(s.Steps))
+	start := clock.Now()
+	var failed, asserts int
+	for i, st := range s.Steps {
+		if wait := st.At - clock.Now().Sub(start); wait > 0 {
+			select {
+			case <-ctx.Done():
+				slog.Warn("scenario aborted", "name", s.Name, "step", i)
+				return false
+			case <-clock.After(wait):
+			}
+		}
+		if st.Action == ActionAssert {
+			asserts++
+		}
+		if err := st.run(ctx); err != nil {
+			failed++
+			slog.Error("scenario step failed", "step", i, "at", st.At, "action", st.Action, "err", err)
+			continue
+		}
+		slog.Info("scenario step done", "step", i, "at", st.At, "action", st.Action)
+	}
+	slog.Info("scenario finished", "name", s.Name, "passed", failed == 0, "steps", len(s.Steps), "asserts", asserts, "failed", failed)
+	return failed == 0
+}
+
+func (st *ScenarioStep) run(ctx context.Context) error {
+	vIP := net.ParseIP(st.Peer)
+	switch st.Action {
+	case ActionRoute:
+		if st.Remote == "" {
+			p, ok := peerTable.Get(vIP)
+			if !ok {
+				return errors.New("unknown peer")
+			}
+			stopPeer(p)
+			return nil
+		}
+		startPeer(ctx, vIP, net.ParseIP(st.Remote))
+		return nil
+	case ActionInject:
+		for i := 0; i < st.Count; i++ {
+			if i > 0 && st.Interval > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-clock.After(st.Interval):
+				}
+			}
+			forwardPacket(flowPacket(st.flow), sendToPeer)
+		}
+		return nil
+	case ActionAssert:
+		got, err := statsCounter(st.Peer, st.Counter)
+		if err != nil {
+			return err
+		}
+		if !assertOps[st.Op](got, st.Value) {
+			return fmt.Errorf("assertion %s %s %g does not hold, got %g", st.Counter, st.Op, st.Value, got)
+		}
+		return nil
+	case ActionPause:
+		Pause()
+		return nil
+	case ActionResume:
+		Resume()
+		return nil
+	case ActionCycle:
+		if !CycleConnections() {
+			return errors.New("cycle already running")
+		}
+		return nil
+	}
+	p, ok := peerTable.Get(vIP)
+	if !ok {
+		return errors.New("unknown peer")
+	}
+	switch st.Action {
+	case ActionLink:
+		p.SetLink(st.State == "up", st.Teardown)
+	case ActionLoss:
+		return p.setLoss(st.Loss)
+	case ActionImpairments:
+		p.SetImpairments(st.State == "on")
+	case ActionMigrate:
+		if !p.Migrate(st.Local) {
+			return errors.New("migration already pending")
+		}
+	}
+	return nil
+}
+
+// setLoss changes the probability of p's impairment.loss, a peer without
+// one has no loss stage to change.
+func (p *Peer) setLoss(prob float64) error {
+	l := p.baseLoss()
+	if l == nil {
+		return errors.New("peer has no impairment.loss configured")
+	}
+	l.mu.Lock()
+	l.prob = prob
+	l.mu.Unlock()
+	slog.Info("loss changed", "vIP", p.vIP, "loss", prob)
+	return nil
+}
+
+// statsCounter looks up counter in the stats snapshot, or in the one of
+// peer if it is set.
+func statsCounter(peer, counter string) (float64, error) {
+	var v any = statsSnapshot()
+	if peer != "" {
+		p, ok := peerTable.Get(net.ParseIP(peer))
+		if !ok {
+			return 0, errors.New("unknown peer")
+		}
+		v = p.snapshot()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	var node any
+	if err = json.Unmarshal(data, &node); err != nil {
+		return 0, err
+	}
+	t := reflect.TypeOf(v)
+	for _, key := range strings.Split(counter, ".") {
+		if t = jsonFieldType(t, key); t == nil {
+			return 0, fmt.Errorf("unknown counter %s", counter)
+		}
+		obj, _ := node.(map[string]any)
+		if node = obj[key]; node == nil {
+			// omitted when empty
+			return 0, nil
+		}
+	}
+	switch n := node.(type) {
+	case float64:
+		return n, nil
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("counter %s is not a number", counter)
+}
+
+// jsonFieldType returns the type of the value at key in the JSON encoding
+// of t, nil if there is none.
+func jsonFieldType(t reflect.Type, key string) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name == key {
+				return f.Type
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+var selfTestEnabled bool
+
+const selfTestTimeout = 5 * time.Second
+
+// selfTest sends a packet over a loopback QUIC connection built from the
+// loaded config — server and peer TLS settings, QUIC config and framing —
+// and checks it arrives intact, so broken setups fail at startup.
+func selfTest(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	serverConf, err := generateTLSConfig()
+	if err != nil {
+		return err
+	}
+	pc := &defaultPeerConfig
+	if mtlsConfig.Enable {
+		pc = nil
+		for _, c := range peerConfigs {
+			if c.clientCert != nil {
+				pc = c
+				break
+			}
+		}
+		if pc == nil {
+			slog.Warn("self test: no peer has a client certificate, test without mtls")
+			pc = &defaultPeerConfig
+			serverConf = serverConf.Clone()
+			serverConf.ClientAuth = tls.NoClientCert
+			serverConf.VerifyPeerCertificate = nil
+		}
+	}
+
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", serverConf, quicConfig())
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	failed := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			failed <- fmt.Errorf("accept: %w", err)
+			return
+		}
+		s, err := conn.AcceptStream(ctx)
+		if err != nil {
+			failed <- fmt.Errorf("accept stream: %w", err)
+			return
+		}
+		buf := make([]byte, BUFSIZE)
+		n, err := readFrame(s, buf)
+		if err != nil {
+			failed <- fmt.Errorf("read frame: %w", err)
+			return
+		}
+		received <- buf[:n]
+	}()
+
+	conn, err := quic.DialAddrEarly(ctx, ln.Addr().String(), pc.tlsConfig(), quicConfig())
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	defer conn.CloseWithError(0, "")
+	s, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	loopback := netip.MustParseAddr("127.0.0.1")
+	pkt := buildUDPPacket(loopback, loopback, 1, 9, []byte("simulator self test"))
+	if _, err = s.Write(appendFrame(nil, pkt)); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("no packet received within %v", selfTestTimeout)
+	case err = <-failed:
+		return err
+	case got := <-received:
+		if !bytes.Equal(got, pkt) {
+			return fmt.Errorf("packet corrupted: sent %d bytes, received %d", len(pkt), len(got))
+		}
+		if _, ok := parseFlowKey(got); !ok {
+			return fmt.Errorf("received packet does not parse")
+		}
+	}
+	return nil
+}
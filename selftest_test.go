@@ -0,0 +1,15 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// TestSelfTest runs the self test on the default config with a fake clock,
+// which does not move, so the packet has to arrive before any timeout.
+func TestSelfTest(t *testing.T) {
+	useFakeClock(t)
+	if err := selfTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Key types of the self-signed server certificate.
+const (
+	KeyTypeRSA2048 = "rsa2048"
+	KeyTypeRSA4096 = "rsa4096"
+	KeyTypeP256    = "p256"
+	KeyTypeP384    = "p384"
+)
+
+// ServerCertConfig is the certificate the listeners present, read from
+// "server_cert". It is loaded from Cert and Key if set, otherwise a
+// self-signed one is generated at startup.
+type ServerCertConfig struct {
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+	// KeyType is the key of the self-signed certificate, Validity how long
+	// it is valid.
+	KeyType  string        `mapstructure:"key_type"`
+	Validity time.Duration `mapstructure:"validity"`
+	// Names are DNS names or IPs the self-signed certificate is valid for,
+	// on top of localhost, the server_name of the peers and tls_profiles and
+	// the IPs of the listeners.
+	Names []string `mapstructure:"names"`
+	// Export writes the self-signed certificate to this PEM file, for the
+	// clients verifying it to use as their ca.
+	Export string `mapstructure:"export"`
+}
+
+var serverCertConfig = ServerCertConfig{KeyType: KeyTypeP256, Validity: 365 * 24 * time.Hour}
+
+func (c *ServerCertConfig) validate() error {
+	if (c.Cert == "") != (c.Key == "") {
+		return errors.New("server_cert: cert and key must be set together")
+	}
+	switch c.KeyType {
+	case KeyTypeRSA2048, KeyTypeRSA4096, KeyTypeP256, KeyTypeP384:
+	default:
+		return fmt.Errorf("server_cert: unknown key_type %q", c.KeyType)
+	}
+	if c.Validity <= 0 {
+		return errors.New("server_cert: validity must be positive")
+	}
+	return nil
+}
+
+var (
+	serverCertOnce sync.Once
+	serverCert     tls.Certificate
+	serverCertErr  error
+)
+
+// serverCertificate returns the certificate of the listeners, loaded or
+// generated on first use and shared by all of them.
+func serverCertificate() (tls.Certificate, error) {
+	serverCertOnce.Do(func() {
+		c := serverCertConfig
+		if c.Cert != "" {
+			if serverCert, serverCertErr = tls.LoadX509KeyPair(c.Cert, c.Key); serverCertErr != nil {
+				serverCertErr = fmt.Errorf("server_cert: %w", serverCertErr)
+			}
+			return
+		}
+		serverCert, serverCertErr = selfSign(c)
+	})
+	return serverCert, serverCertErr
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+}
+
+// selfSign generates a certificate for the names of c signed by its own key.
+// It is its own CA, so clients can verify it with it as their ca.
+func selfSign(c ServerCertConfig) (tls.Certificate, error) {
+	key, err := generateKey(c.KeyType)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("server_cert: generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("server_cert: serial: %w", err)
+	}
+	usage := x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		usage |= x509.KeyUsageKeyEncipherment
+	}
+	// clients drop resumed sessions whose certificate is expired, so it needs
+	// a validity period for 0-RTT
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "network-simulator"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(c.Validity),
+		KeyUsage:              usage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	template.DNSNames, template.IPAddresses = certNames(c.Names)
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("server_cert: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("server_cert: %w", err)
+	}
+	if c.Export != "" {
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		if err = os.WriteFile(c.Export, certPEM, 0o644); err != nil {
+			return tls.Certificate{}, fmt.Errorf("server_cert: export: %w", err)
+		}
+	}
+	slog.Info("generated server certificate", "key_type", c.KeyType, "dns", leaf.DNSNames, "ips", leaf.IPAddresses, "not_after", leaf.NotAfter)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// certNames collects the subject alternative names of the self-signed
+// certificate.
+func certNames(names []string) ([]string, []net.IP) {
+	var dnsNames []string
+	var ips []net.IP
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name == "" || seen[name] {
+			return
+		}
+		seen[name] = true
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	add("localhost")
+	for _, name := range names {
+		add(name)
+	}
+	for _, pc := range peerConfigs {
+		add(pc.ServerName)
+	}
+	for _, tp := range tlsProfiles {
+		add(tp.ServerName)
+	}
+	for _, lc := range listenerConfigs {
+		host, _, err := net.SplitHostPort(lc.Addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+			add(host)
+			continue
+		}
+		// listening on every address
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				add(n.IP.String())
+			}
+		}
+	}
+	return dnsNames, ips
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QueueFIFO = "fifo"
+	// QueueFair serves flows by deficit round robin so one heavy flow can
+	// not starve the others sharing the link.
+	QueueFair = "fair"
+
+	defaultQueueLimit = 1000
+	// drrQuantum is the credit a flow earns per round, at least one packet.
+	drrQuantum = BUFSIZE
+)
+
+// queuedPacket is a packet waiting in a scheduler since at.
+type queuedPacket struct {
+	pkt []byte
+	at  time.Time
+}
+
+// scheduler holds the packets waiting in front of a bandwidth limiter and
+// decides which one goes next. It is not safe for concurrent use.
+type scheduler interface {
+	push(flow FlowKey, q queuedPacket)
+	pop() (queuedPacket, bool)
+	len() int
+	// depths returns the queued packets per flow, nil if not tracked.
+	depths() map[string]int
+}
+
+type fifoScheduler struct {
+	pkts []queuedPacket
+}
+
+func (q *fifoScheduler) push(_ FlowKey, p queuedPacket) { q.pkts = append(q.pkts, p) }
+
+func (q *fifoScheduler) pop() (queuedPacket, bool) {
+	if len(q.pkts) == 0 {
+		return queuedPacket{}, false
+	}
+	pkt := q.pkts[0]
+	q.pkts = q.pkts[1:]
+	return pkt, true
+}
+
+func (q *fifoScheduler) len() int { return len(q.pkts) }
+
+func (q *fifoScheduler) depths() map[string]int { return nil }
+
+type flowQueue struct {
+	key     FlowKey
+	pkts    []queuedPacket
+	deficit int
+}
+
+// drrScheduler is a deficit round robin scheduler over per-flow queues.
+type drrScheduler struct {
+	flows  map[FlowKey]*flowQueue
+	active []*flowQueue
+	n      int
+}
+
+func newDRRScheduler() *drrScheduler {
+	return &drrScheduler{flows: make(map[FlowKey]*flowQueue)}
+}
+
+func (q *drrScheduler) push(flow FlowKey, p queuedPacket) {
+	fq, ok := q.flows[flow]
+	if !ok {
+		fq = &flowQueue{key: flow}
+		q.flows[flow] = fq
+		q.active = append(q.active, fq)
+	}
+	fq.pkts = append(fq.pkts, p)
+	q.n++
+}
+
+func (q *drrScheduler) pop() (queuedPacket, bool) {
+	for len(q.active) > 0 {
+		fq := q.active[0]
+		pkt := fq.pkts[0]
+		if fq.deficit < len(pkt.pkt) {
+			fq.deficit += drrQuantum
+			q.active = append(q.active[1:], fq)
+			continue
+		}
+		fq.deficit -= len(pkt.pkt)
+		fq.pkts = fq.pkts[1:]
+		if len(fq.pkts) == 0 {
+			q.active = q.active[1:]
+			delete(q.flows, fq.key)
+		}
+		q.n--
+		return pkt, true
+	}
+	return queuedPacket{}, false
+}
+
+func (q *drrScheduler) len() int { return q.n }
+
+func (q *drrScheduler) depths() map[string]int {
+	depths := make(map[string]int, len(q.flows))
+	for key, fq := range q.flows {
+		depths[key.String()] = len(fq.pkts)
+	}
+	return depths
+}
+
+// Shaper limits the rate packets are handed to a peer's writer with a token
+// bucket, queueing the excess in a scheduler.
+type Shaper struct {
+	mu    sync.Mutex
+	sched scheduler
+	limit int
+	ready chan struct{}
+	// ecnThreshold marks packets CE once this many are queued, 0 disables it
+	ecnThreshold int
+	// codel drops packets queued for too long on dequeue, nil tail drops only
+	codel *codel
+	// share draws every packet from a shared bottleneck after the peer's own
+	// limit, nil if the peer has the link to itself
+	share *bottleneckShare
+
+	rate  float64 // bytes per second
+	burst float64
+
+	Drops atomic.Uint64
+	// AQMDrops are the packets dropped by codel, Sojourn is how long the
+	// last dequeued packet waited in nanoseconds.
+	AQMDrops atomic.Uint64
+	Sojourn  atomic.Int64
+}
+
+// newShaper returns a shaper for bandwidth bits per second, 0 leaves the
+// rate to the shared bottleneck.
+func newShaper(bandwidth int64, queue string, limit int) *Shaper {
+	s := &Shaper{
+		limit: limit,
+		ready: make(chan struct{}, 1),
+		rate:  float64(bandwidth) / 8,
+	}
+	if s.limit <= 0 {
+		s.limit = defaultQueueLimit
+	}
+	// allow bursts of 10ms worth of traffic, but at least one full packet
+	s.burst = max(s.rate/100, BUFSIZE)
+	if queue == QueueFair {
+		s.sched = newDRRScheduler()
+	} else {
+		s.sched = &fifoScheduler{}
+	}
+	return s
+}
+
+// Enqueue queues pkt, reporting false if the queue is full and it was dropped.
+// pkt is charged to the memory budget, the shaper releases the packets it
+// drops and the receiver of run those it releases.
+func (s *Shaper) Enqueue(flow FlowKey, pkt []byte) bool {
+	s.mu.Lock()
+	if s.sched.len() >= s.limit {
+		s.mu.Unlock()
+		s.Drops.Add(1)
+		releaseMemory(pkt)
+		return false
+	}
+	if s.ecnThreshold > 0 && s.sched.len() >= s.ecnThreshold {
+		// mark the packet behind a relay header in place
+		if _, inner := splitRelayHeader(pkt); setIPv4CE(inner) {
+			globalStats.ECNMarked.Add(1)
+		}
+	}
+	s.sched.push(flow, queuedPacket{pkt: pkt, at: clock.Now()})
+	s.mu.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *Shaper) dequeue() ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.codel != nil {
+		return s.codel.dequeue(s)
+	}
+	q, ok := s.sched.pop()
+	if ok {
+		s.Sojourn.Store(int64(clock.Now().Sub(q.at)))
+	}
+	return q.pkt, ok
+}
+
+// QueueLen returns the number of packets waiting for the limiter.
+func (s *Shaper) QueueLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sched.len()
+}
+
+// FlowDepths returns the queued packets per flow for the fair queue.
+func (s *Shaper) FlowDepths() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sched.depths()
+}
+
+// run releases queued packets into out at the configured rate until ctx is done.
+func (s *Shaper) run(ctx context.Context, out chan<- []byte) {
+	tokens := s.burst
+	last := clock.Now()
+	for {
+		pkt, ok := s.dequeue()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.ready:
+			}
+			continue
+		}
+		if s.rate > 0 {
+			now := clock.Now()
+			tokens = min(s.burst, tokens+now.Sub(last).Seconds()*s.rate)
+			last = now
+			if need := float64(len(pkt)) - tokens; need > 0 {
+				select {
+				case <-ctx.Done():
+					releaseMemory(pkt)
+					return
+				case <-clock.After(time.Duration(need / s.rate * float64(time.Second))):
+				}
+				now = clock.Now()
+				tokens += now.Sub(last).Seconds() * s.rate
+				last = now
+			}
+			tokens -= float64(len(pkt))
+		}
+		if s.share != nil && !s.share.acquire(ctx, len(pkt)) {
+			releaseMemory(pkt)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			releaseMemory(pkt)
+			return
+		case out <- pkt:
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// TestShaperMarksRelayed checks ECN marking reaches a packet behind a relay
+// header and leaves the header intact.
+func TestShaperMarksRelayed(t *testing.T) {
+	s := newShaper(1<<20, "", 8)
+	s.ecnThreshold = 1
+	for i := 0; i < 2; i++ {
+		pkt := loopbackPacket(10)
+		pkt[1] = 0x02 // ECT(0)
+		s.Enqueue(FlowKey{}, relayHeader(pkt, 1))
+	}
+	s.dequeue()
+	pkt, _ := s.dequeue()
+	hops, inner := splitRelayHeader(pkt)
+	if hops != 1 {
+		t.Fatalf("relay header hops = %d, want 1", hops)
+	}
+	if inner[1]&ecnMask != ecnCE {
+		t.Fatalf("ECN bits = %02b, want CE", inner[1]&ecnMask)
+	}
+	if !validIPv4Header(inner) {
+		t.Fatal("marked packet has a bad header")
+	}
+}
+
+// feedShaper runs s and feeds it n packets of size bytes through feed, it
+// returns where s releases them.
+func feedShaper(ctx context.Context, s *Shaper, feed func([]byte), n, size int) <-chan []byte {
+	out := make(chan []byte, n)
+	go s.run(ctx, out)
+	src, dst := netip.MustParseAddr("10.0.1.1"), netip.MustParseAddr("10.0.9.8")
+	for i := 0; i < n; i++ {
+		feed(udpPacket(src, dst, 40000, 9, nil, make([]byte, size-ipv4MinHeaderLen-8)))
+	}
+	return out
+}
+
+// drainShaper receives n packets from out, advancing c a millisecond at a
+// time while a timer is pending, and returns how far it advanced c.
+func drainShaper(t *testing.T, c *FakeClock, out <-chan []byte, n int) time.Duration {
+	t.Helper()
+	var advanced time.Duration
+	deadline := time.Now().Add(5 * time.Second)
+	for got := 0; got < n; {
+		select {
+		case <-out:
+			got++
+			continue
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("released %d of %d packets", got, n)
+		}
+		if c.Pending() == 0 {
+			time.Sleep(100 * time.Microsecond)
+			continue
+		}
+		c.Advance(time.Millisecond)
+		advanced += time.Millisecond
+	}
+	return advanced
+}
+
+// TestBandwidthDirectionsIndependent saturates the send and the receive
+// cap of a peer at once, the fast direction must not wait for the slow one.
+func TestBandwidthDirectionsIndependent(t *testing.T) {
+	for _, tt := range []struct {
+		name               string
+		bandwidth, receive int64
+		slowRecv           bool
+	}{
+		{"slow upload", 800_000, 1_000_000_000, false},
+		{"slow download", 1_000_000_000, 800_000, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeClock(t)
+			c, err := parseConfig([]byte(fmt.Sprintf("peers:\n  \"10.0.9.8\":\n    bandwidth: %d\n    receive_bandwidth: %d\n", tt.bandwidth, tt.receive)), "yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = applyConfig(c); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			p := newPeer(net.ParseIP("10.0.9.8"), net.ParseIP("127.0.0.1"))
+			slow := feedShaper(ctx, p.shaper, p.enqueue, 20, 1000)
+			fast := feedShaper(ctx, p.rxShaper, p.receive, 20, 1000)
+			if tt.slowRecv {
+				slow, fast = fast, slow
+			}
+			// the uncapped direction is done before the clock moves at all
+			for i := 0; i < 20; i++ {
+				select {
+				case <-fast:
+				case <-time.After(2 * time.Second):
+					t.Fatalf("uncapped direction released %d of 20 packets, throttled like the capped one", i)
+				}
+			}
+			// 20 kB take 200ms at 800 kbit/s, less the burst of 4 kB
+			if took := drainShaper(t, fake, slow, 20); took < 150*time.Millisecond || took > 250*time.Millisecond {
+				t.Fatalf("capped direction took %v, want about 160ms", took)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ShutdownPhase orders the teardown of the subsystems, see Close.
+type ShutdownPhase int
+
+const (
+	// PhaseAccept stops the listeners so no new peers connect.
+	PhaseAccept ShutdownPhase = iota
+	// PhaseDrain waits for the packets queued towards peers to be sent.
+	PhaseDrain
+	// PhaseTransport closes the peer connections.
+	PhaseTransport
+	// PhaseInterface takes the tun devices down.
+	PhaseInterface
+	// PhaseServer stops the admin api and flushes the capture.
+	PhaseServer
+
+	numShutdownPhases
+)
+
+var shutdownPhaseNames = [numShutdownPhases]string{"accept", "drain", "transport", "interface", "server"}
+
+func (p ShutdownPhase) String() string { return shutdownPhaseNames[p] }
+
+// drainTimeout bounds how long PhaseDrain waits for the peer queues.
+const drainTimeout = 2 * time.Second
+
+type shutdownHook struct {
+	name string
+	fn   func() error
+}
+
+var shutdown struct {
+	mu    sync.Mutex
+	hooks [numShutdownPhases][]shutdownHook
+	done  bool
+}
+
+// OnShutdown registers fn to run in phase when Close is called. Hooks of a
+// phase run one after the other in registration order. Registering after
+// Close runs fn right away.
+func OnShutdown(phase ShutdownPhase, name string, fn func() error) {
+	shutdown.mu.Lock()
+	if shutdown.done {
+		shutdown.mu.Unlock()
+		runShutdownHook(phase, shutdownHook{name, fn})
+		return
+	}
+	shutdown.hooks[phase] = append(shutdown.hooks[phase], shutdownHook{name, fn})
+	shutdown.mu.Unlock()
+}
+
+// Close tears the simulator down phase by phase. Only the first call does
+// anything.
+func Close() {
+	shutdown.mu.Lock()
+	if shutdown.done {
+		shutdown.mu.Unlock()
+		return
+	}
+	shutdown.done = true
+	hooks := shutdown.hooks
+	shutdown.mu.Unlock()
+
+	for phase := ShutdownPhase(0); phase < numShutdownPhases; phase++ {
+		slog.Info("shutdown phase", "phase", phase, "hooks", len(hooks[phase]))
+		for _, h := range hooks[phase] {
+			runShutdownHook(phase, h)
+		}
+	}
+	slog.Info("shutdown complete")
+}
+
+// forceExitOnInterrupt exits right away if an interrupt arrives during the
+// graceful shutdown, e.g. a second Ctrl-C while the drain waits on a peer
+// that stopped reading, cancelling ctx to close the connections first.
+func forceExitOnInterrupt(interrupt <-chan os.Signal, cancel context.CancelFunc) {
+	go func() {
+		s := <-interrupt
+		slog.Warn("forced shutdown, interrupted during graceful shutdown", "signal", s)
+		cancel()
+		os.Exit(1)
+	}()
+}
+
+// shuttingDown reports whether Close was called.
+func shuttingDown() bool {
+	shutdown.mu.Lock()
+	defer shutdown.mu.Unlock()
+	return shutdown.done
+}
+
+func runShutdownHook(phase ShutdownPhase, h shutdownHook) {
+	if err := h.fn(); err != nil {
+		slog.Error("shutdown step failed", "phase", phase, "step", h.name, "err", err)
+	}
+}
+
+// drainPeers waits until nothing is queued towards any peer or timeout
+// passed.
+func drainPeers(timeout time.Duration) error {
+	deadline := clock.Now().Add(timeout)
+	for clock.Now().Before(deadline) {
+		queued := 0
+		peerTable.Range(func(p *Peer) bool {
+			queued += len(p.queue)
+			if p.shaper != nil {
+				queued += p.shaper.QueueLen()
+			}
+			if p.rxShaper != nil {
+				queued += p.rxShaper.QueueLen()
+			}
+			return true
+		})
+		if queued == 0 {
+			return nil
+		}
+		<-clock.After(10 * time.Millisecond)
+	}
+	slog.Warn("drain timed out, dropping queued packets", "timeout", timeout)
+	return nil
+}
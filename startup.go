@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// StartupConfig is read from "startup". Delay holds off forwarding and
+// dialing after startup, Ramp spreads the initial peer dials evenly over
+// its duration instead of starting them all at once. The packets of the
+// Warmup after the delay are left out of the stats.
+type StartupConfig struct {
+	Delay  time.Duration `mapstructure:"delay"`
+	Ramp   time.Duration `mapstructure:"ramp"`
+	Warmup time.Duration `mapstructure:"warmup"`
+}
+
+var startupConfig StartupConfig
+
+func (c StartupConfig) validate() error {
+	if c.Delay < 0 || c.Ramp < 0 || c.Warmup < 0 {
+		return fmt.Errorf("startup: delay, ramp and warmup must not be negative")
+	}
+	return nil
+}
+
+// waitStartupDelay waits out the startup delay, it reports false if ctx
+// was done or an interrupt arrived first.
+func waitStartupDelay(ctx context.Context, interrupt <-chan os.Signal) bool {
+	if startupConfig.Delay == 0 {
+		return true
+	}
+	slog.Info("delay startup", "delay", startupConfig.Delay)
+	select {
+	case <-ctx.Done():
+		return false
+	case s := <-interrupt:
+		slog.Info("interrupt", "signal", s)
+		return false
+	case <-clock.After(startupConfig.Delay):
+		return true
+	}
+}
+
+// rampState is the progress of the initial peer dials, done once all of
+// them connected.
+type rampState struct {
+	active, done   atomic.Bool
+	started, total atomic.Int64
+}
+
+var ramp rampState
+
+// StartupSnapshot is the progress of the connection ramp and the warmup.
+type StartupSnapshot struct {
+	Ramping   bool  `json:"ramping"`
+	Started   int64 `json:"started"`
+	Connected int   `json:"connected"`
+	Total     int64 `json:"total"`
+	// WarmingUp is set while the warmup runs, the stats are reset at
+	// WarmupEnded.
+	WarmingUp   bool   `json:"warming_up,omitempty"`
+	WarmupEnded string `json:"warmup_ended,omitempty"`
+}
+
+func startupSnapshot() *StartupSnapshot {
+	if startupConfig.Ramp == 0 && startupConfig.Warmup == 0 {
+		return nil
+	}
+	return &StartupSnapshot{
+		Ramping:     ramp.active.Load(),
+		Started:     ramp.started.Load(),
+		Connected:   connectedPeers(),
+		Total:       ramp.total.Load(),
+		WarmingUp:   warmingUp(),
+		WarmupEnded: warmupSnapshot(),
+	}
+}
+
+// connectedPeers counts the peers with a connection up.
+func connectedPeers() int {
+	n := 0
+	peerTable.Range(func(p *Peer) bool {
+		if p.connected.Load() {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// reportRamp logs the progress of the ramp when a peer connected.
+func reportRamp() {
+	if ramp.total.Load() == 0 || ramp.done.Load() {
+		return
+	}
+	connected := connectedPeers()
+	slog.Info("startup ramp", "connected", connected, "total", ramp.total.Load())
+	if int64(connected) >= ramp.total.Load() {
+		ramp.done.Store(true)
+	}
+}
+
+type route struct {
+	vIP, rIP net.IP
+}
+
+// rampPeers starts the peers of routes one after the other over the ramp
+// duration until ctx is done.
+func rampPeers(ctx context.Context, routes []route) {
+	sort.Slice(routes, func(i, j int) bool { return routes[i].vIP.String() < routes[j].vIP.String() })
+	ramp.total.Store(int64(len(routes)))
+	ramp.active.Store(true)
+	defer ramp.active.Store(false)
+	step := startupConfig.Ramp / time.Duration(len(routes))
+	slog.Info("ramp up peers", "peers", len(routes), "ramp", startupConfig.Ramp)
+	for i, r := range routes {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-clock.After(step):
+			}
+		}
+		// a reload may have started the peer meanwhile
+		if _, ok := peerTable.Get(r.vIP); !ok {
+			startPeer(ctx, r.vIP, r.rIP)
+		}
+		ramp.started.Add(1)
+	}
+}
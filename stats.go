@@ -0,0 +1,455 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// PeerStats counts the traffic of one peer. It is updated from the data
+// path, so every counter is atomic.
+type PeerStats struct {
+	TxPackets atomic.Uint64
+	TxBytes   atomic.Uint64
+	// RxPackets and RxBytes are received from the peer.
+	RxPackets    atomic.Uint64
+	RxBytes      atomic.Uint64
+	BreakerDrops atomic.Uint64
+	Migrations   atomic.Uint64
+	ImpairDrops  atomic.Uint64
+	// Resumptions are connections resuming a TLS session, ZeroRTTConns
+	// those whose early data the server accepted.
+	Resumptions  atomic.Uint64
+	ZeroRTTConns atomic.Uint64
+	// WireCorrupted are datagrams corrupted below QUIC, QUICLostPackets the
+	// packets QUIC declared lost and retransmitted.
+	WireCorrupted   atomic.Uint64
+	QUICLostPackets atomic.Uint64
+	// DeadPeers counts the connections closed by dead peer detection.
+	DeadPeers atomic.Uint64
+	// StreamResets are streams the peer reset and that were reopened.
+	StreamResets atomic.Uint64
+	// StreamOpenRetries are stream opens retried on a live connection,
+	// StreamOpenFailures connections closed as no stream could be opened.
+	StreamOpenRetries  atomic.Uint64
+	StreamOpenFailures atomic.Uint64
+	// CompressIn and CompressOut are the bytes of the packets to the peer
+	// before and after compression.
+	CompressIn  atomic.Uint64
+	CompressOut atomic.Uint64
+	// QueueBlocked counts the packets that waited for a full writer queue,
+	// QueueDropsNewest and QueueDropsOldest those dropped instead.
+	QueueBlocked     atomic.Uint64
+	QueueDropsNewest atomic.Uint64
+	QueueDropsOldest atomic.Uint64
+	// OutageDrops are packets to and from the peer dropped while its link
+	// was down.
+	OutageDrops atomic.Uint64
+	// IdleCloses are connections closed for the idle_timeout.
+	IdleCloses atomic.Uint64
+	// DNSPackets are the packets to and from the peer the dns impairments
+	// matched.
+	DNSPackets atomic.Uint64
+	// Devices counts the packets from the peer by the tun device they were
+	// written to.
+	Devices deviceCounts
+	// QUIC is what the current connection to the peer negotiated.
+	QUIC atomic.Pointer[QUICParams]
+	// ReconnectAttempts are the dials after the first one, ReconnectsLimited
+	// the times max_per_minute opened the circuit breaker.
+	ReconnectAttempts atomic.Uint64
+	ReconnectsLimited atomic.Uint64
+	// DatagramsSent are datagrams sent to the peer, DatagramSendErrors
+	// those that failed. DatagramsFragmented are packets split to fit into
+	// datagrams, DatagramOversizeDrops packets dropped for not fitting.
+	DatagramsSent         atomic.Uint64
+	DatagramSendErrors    atomic.Uint64
+	DatagramsFragmented   atomic.Uint64
+	DatagramOversizeDrops atomic.Uint64
+	// PathMTU is the probed path MTU, 0 until probed.
+	PathMTU atomic.Int64
+}
+
+// Stats counts what happens outside of any single peer.
+type Stats struct {
+	// ZeroLengthReads are tun reads that returned no data and were skipped.
+	ZeroLengthReads atomic.Uint64
+	// OversizedDrops are packets from peers dropped for exceeding the tun MTU.
+	OversizedDrops atomic.Uint64
+	// TTLExceeded are packets from peers dropped when their TTL expired.
+	TTLExceeded atomic.Uint64
+	// DecapFailures are encapsulated packets without a readable inner header.
+	DecapFailures atomic.Uint64
+	// IPv6ExtHeaders are IPv6 packets read from the tun devices carrying
+	// extension headers.
+	IPv6ExtHeaders atomic.Uint64
+	// ECNMarked are packets marked Congestion Experienced.
+	ECNMarked atomic.Uint64
+	// FragmentedDatagrams are IPv4 datagrams read from the tun devices in
+	// fragments. Reassembled were forwarded whole, FragmentsPassed forwarded
+	// as fragments for being too large and FragmentDrops dropped incomplete
+	// or inconsistent.
+	FragmentedDatagrams atomic.Uint64
+	Reassembled         atomic.Uint64
+	FragmentsPassed     atomic.Uint64
+	FragmentDrops       atomic.Uint64
+	// Refragmented are packets from the peers fragmented again to fit the
+	// MTU of their tun device, reassembled datagrams among them.
+	Refragmented atomic.Uint64
+	// PendingRouteHeld are packets held for a missing route, of which
+	// PendingRouteFlushed were forwarded once it was added and
+	// PendingRouteExpired dropped after pending_routes.timeout.
+	// PendingRouteDrops were dropped for not fitting into the buffer.
+	PendingRouteHeld    atomic.Uint64
+	PendingRouteFlushed atomic.Uint64
+	PendingRouteExpired atomic.Uint64
+	PendingRouteDrops   atomic.Uint64
+	// RouteFuncDrops are packets the RouteFunc dropped.
+	RouteFuncDrops atomic.Uint64
+	// RPFDrops are packets read from the tun devices dropped by the reverse
+	// path filter.
+	RPFDrops atomic.Uint64
+	// DatagramsReceived are datagrams received from clients.
+	DatagramsReceived atomic.Uint64
+	// ICMP echo requests and replies read from and written to the tun
+	// devices
+	ICMPEchoRequests atomic.Uint64
+	ICMPEchoReplies  atomic.Uint64
+	// StreamResets are streams clients reset on the server.
+	StreamResets atomic.Uint64
+	// packets read from the tun devices with and without an 802.1Q tag
+	VLANTagged   atomic.Uint64
+	VLANUntagged atomic.Uint64
+	// SizePadded and SizeDrops are packets the size transforms padded and
+	// dropped for their size.
+	SizePadded atomic.Uint64
+	SizeDrops  atomic.Uint64
+	// PassthroughTx and PassthroughRx are non-IP frames forwarded to and
+	// received from the passthrough peer.
+	PassthroughTx atomic.Uint64
+	PassthroughRx atomic.Uint64
+	// Relayed are the packets forwarded on to a relay peer, RelayHopDrops
+	// those dropped for reaching relay.max_hops.
+	Relayed       atomic.Uint64
+	RelayHopDrops atomic.Uint64
+	// ServerQUIC counts the connections clients made by what they
+	// negotiated, QUIC version, ALPN and cipher suite.
+	ServerQUIC deviceCounts
+	// MSSClamped are the TCP SYNs whose MSS was lowered to mss_clamp.
+	MSSClamped atomic.Uint64
+	// BufferedBytes are the bytes of the packets buffered right now,
+	// MemoryDrops the packets shed for exceeding memory.limit.
+	BufferedBytes atomic.Int64
+	MemoryDrops   atomic.Uint64
+	// generated packets sent by the traffic generator and received from peers
+	GenTxPackets atomic.Uint64
+	GenTxBytes   atomic.Uint64
+	GenRxPackets atomic.Uint64
+	GenRxBytes   atomic.Uint64
+}
+
+var globalStats Stats
+
+// StatsSnapshot is a point-in-time copy of all stats.
+type StatsSnapshot struct {
+	Peers map[string]PeerStatsSnapshot `json:"peers"`
+	// Aggregate is the throughput of all peers together.
+	Aggregate           AggregateSnapshot `json:"aggregate"`
+	ZeroLengthReads     uint64            `json:"zero_length_reads"`
+	OversizedDrops      uint64            `json:"oversized_drops"`
+	TTLExceeded         uint64            `json:"ttl_exceeded"`
+	DecapFailures       uint64            `json:"decap_failures"`
+	IPv6ExtHeaders      uint64            `json:"ipv6_ext_headers"`
+	ECNMarked           uint64            `json:"ecn_marked"`
+	StreamResets        uint64            `json:"stream_resets"`
+	RouteFuncDrops      uint64            `json:"route_func_drops"`
+	RPFDrops            uint64            `json:"rpf_drops"`
+	DatagramsReceived   uint64            `json:"datagrams_received"`
+	ICMPEchoRequests    uint64            `json:"icmp_echo_requests"`
+	ICMPEchoReplies     uint64            `json:"icmp_echo_replies"`
+	FragmentedDatagrams uint64            `json:"fragmented_datagrams"`
+	Reassembled         uint64            `json:"reassembled"`
+	FragmentsPassed     uint64            `json:"fragments_passed"`
+	FragmentDrops       uint64            `json:"fragment_drops"`
+	Refragmented        uint64            `json:"refragmented"`
+	VLANTagged          uint64            `json:"vlan_tagged"`
+	VLANUntagged        uint64            `json:"vlan_untagged"`
+	SizePadded          uint64            `json:"size_padded"`
+	SizeDrops           uint64            `json:"size_drops"`
+	PassthroughTx       uint64            `json:"passthrough_tx"`
+	PassthroughRx       uint64            `json:"passthrough_rx"`
+	Relayed             uint64            `json:"relayed"`
+	RelayHopDrops       uint64            `json:"relay_hop_drops"`
+	// PendingRoutes are the packets held for missing routes right now.
+	PendingRoutes       int    `json:"pending_routes"`
+	PendingRouteHeld    uint64 `json:"pending_route_held"`
+	PendingRouteFlushed uint64 `json:"pending_route_flushed"`
+	PendingRouteExpired uint64 `json:"pending_route_expired"`
+	PendingRouteDrops   uint64 `json:"pending_route_drops"`
+	// QUICLibrary is the quic-go version built in, QUICVersions the pinned
+	// quic_versions.
+	QUICLibrary    string                  `json:"quic_library"`
+	QUICVersions   []string                `json:"quic_versions,omitempty"`
+	ServerQUIC     map[string]uint64       `json:"server_quic,omitempty"`
+	MSSClamped     uint64                  `json:"mss_clamped"`
+	BufferedBytes  int64                   `json:"buffered_bytes"`
+	MemoryLimit    int64                   `json:"memory_limit"`
+	MemoryDrops    uint64                  `json:"memory_drops"`
+	Listeners      []ListenerStatsSnapshot `json:"listeners"`
+	Bottlenecks    []BottleneckSnapshot    `json:"bottlenecks,omitempty"`
+	Draining       bool                    `json:"draining"`
+	Cycling        bool                    `json:"cycling"`
+	CycledConns    uint64                  `json:"cycled_connections"`
+	CycleRemaining int64                   `json:"cycle_remaining"`
+	Startup        *StartupSnapshot        `json:"startup,omitempty"`
+	Paused         bool                    `json:"paused"`
+	PausedHeld     int                     `json:"paused_held"`
+	PausedDrops    uint64                  `json:"paused_drops"`
+	Flows          int                     `json:"flows"`
+	FlowEvictions  uint64                  `json:"flow_evictions"`
+	GenTxPackets   uint64                  `json:"gen_tx_packets"`
+	GenTxBytes     uint64                  `json:"gen_tx_bytes"`
+	GenRxPackets   uint64                  `json:"gen_rx_packets"`
+	GenRxBytes     uint64                  `json:"gen_rx_bytes"`
+}
+
+// ListenerStatsSnapshot is a point-in-time copy of a listener's stats.
+type ListenerStatsSnapshot struct {
+	Transport string `json:"transport"`
+	Addr      string `json:"addr"`
+	// Bound is the address listened on, unlike Addr with the port the OS
+	// picked for port 0.
+	Bound       string `json:"bound,omitempty"`
+	Device      string `json:"device,omitempty"`
+	Connections uint64 `json:"connections"`
+	Active      int64  `json:"active"`
+	Rejected    uint64 `json:"rejected"`
+
+	index int
+}
+
+// PeerStatsSnapshot is a point-in-time copy of a peer's stats.
+type PeerStatsSnapshot struct {
+	TxPackets             uint64 `json:"tx_packets"`
+	TxBytes               uint64 `json:"tx_bytes"`
+	RxPackets             uint64 `json:"rx_packets"`
+	RxBytes               uint64 `json:"rx_bytes"`
+	BreakerDrops          uint64 `json:"breaker_drops"`
+	Migrations            uint64 `json:"migrations"`
+	ImpairDrops           uint64 `json:"impair_drops"`
+	Resumptions           uint64 `json:"resumptions"`
+	ZeroRTTConns          uint64 `json:"zero_rtt_conns"`
+	WireCorrupted         uint64 `json:"wire_corrupted"`
+	QUICLostPackets       uint64 `json:"quic_lost_packets"`
+	DeadPeers             uint64 `json:"dead_peers"`
+	StreamResets          uint64 `json:"stream_resets"`
+	StreamOpenRetries     uint64 `json:"stream_open_retries"`
+	StreamOpenFailures    uint64 `json:"stream_open_failures"`
+	OutageDrops           uint64 `json:"outage_drops"`
+	ReconnectAttempts     uint64 `json:"reconnect_attempts"`
+	ReconnectsLimited     uint64 `json:"reconnects_limited"`
+	DatagramsSent         uint64 `json:"datagrams_sent"`
+	DatagramSendErrors    uint64 `json:"datagram_send_errors"`
+	DatagramsFragmented   uint64 `json:"datagrams_fragmented"`
+	DatagramOversizeDrops uint64 `json:"datagram_oversize_drops"`
+	QueueBlocked          uint64 `json:"queue_blocked"`
+	QueueDropsNewest      uint64 `json:"queue_drops_newest"`
+	QueueDropsOldest      uint64 `json:"queue_drops_oldest"`
+	// CompressionRatio is the compressed size relative to the original,
+	// only reported for compressing peers.
+	CompressionRatio float64 `json:"compression_ratio,omitempty"`
+	PathMTU          int64   `json:"path_mtu,omitempty"`
+	LastSeen         string  `json:"last_seen,omitempty"`
+	LastAttempt      string  `json:"last_attempt,omitempty"`
+	// TxRate and RxRate are the per-second rates over the last minute.
+	TxRate  RateSnapshot `json:"tx_rate"`
+	RxRate  RateSnapshot `json:"rx_rate"`
+	Breaker string       `json:"breaker"`
+	Link    string       `json:"link"`
+	// Impaired is false while the impairments are switched off.
+	Impaired bool `json:"impaired"`
+	// QueueLen and ShaperDrops are only reported for bandwidth limited peers,
+	// FlowQueues only for the fair queue.
+	QueueLen    int            `json:"queue_len,omitempty"`
+	ShaperDrops uint64         `json:"shaper_drops,omitempty"`
+	FlowQueues  map[string]int `json:"flow_queues,omitempty"`
+	// AQMDrops are the codel drops, SojournUs the queue delay of the last
+	// packet sent in microseconds.
+	AQMDrops  uint64 `json:"aqm_drops,omitempty"`
+	SojournUs int64  `json:"sojourn_us,omitempty"`
+	// Bandwidth and ReceiveBandwidth are the configured caps in bits per
+	// second, RxQueueLen and RxShaperDrops those of the receive limit.
+	Bandwidth        int64  `json:"bandwidth,omitempty"`
+	ReceiveBandwidth int64  `json:"receive_bandwidth,omitempty"`
+	RxQueueLen       int    `json:"rx_queue_len,omitempty"`
+	RxShaperDrops    uint64 `json:"rx_shaper_drops,omitempty"`
+	// DelayLen and IngressDelayLen are the packets the impairments hold
+	// towards and from the peer, DelayDrops and DelayReleased those
+	// dropped or sent early for delay_limit; only reported for impaired
+	// peers.
+	DelayLen        int    `json:"delay_len,omitempty"`
+	IngressDelayLen int    `json:"ingress_delay_len,omitempty"`
+	DelayDrops      uint64 `json:"delay_drops,omitempty"`
+	DelayReleased   uint64 `json:"delay_released,omitempty"`
+	DNSPackets      uint64 `json:"dns_packets,omitempty"`
+	IdleCloses      uint64 `json:"idle_closes,omitempty"`
+	// Idle is set while the connection is closed for the idle_timeout.
+	Idle bool `json:"idle,omitempty"`
+	// Devices are the packets from the peer written per tun device.
+	Devices map[string]uint64 `json:"devices,omitempty"`
+	QUIC    *QUICParams       `json:"quic,omitempty"`
+}
+
+func (p *Peer) snapshot() PeerStatsSnapshot {
+	snap := PeerStatsSnapshot{
+		TxPackets:             p.stats.TxPackets.Load(),
+		TxBytes:               p.stats.TxBytes.Load(),
+		RxPackets:             p.stats.RxPackets.Load(),
+		RxBytes:               p.stats.RxBytes.Load(),
+		BreakerDrops:          p.stats.BreakerDrops.Load(),
+		Migrations:            p.stats.Migrations.Load(),
+		ImpairDrops:           p.stats.ImpairDrops.Load(),
+		Resumptions:           p.stats.Resumptions.Load(),
+		ZeroRTTConns:          p.stats.ZeroRTTConns.Load(),
+		WireCorrupted:         p.stats.WireCorrupted.Load(),
+		QUICLostPackets:       p.stats.QUICLostPackets.Load(),
+		DeadPeers:             p.stats.DeadPeers.Load(),
+		StreamResets:          p.stats.StreamResets.Load(),
+		StreamOpenRetries:     p.stats.StreamOpenRetries.Load(),
+		StreamOpenFailures:    p.stats.StreamOpenFailures.Load(),
+		OutageDrops:           p.stats.OutageDrops.Load(),
+		ReconnectAttempts:     p.stats.ReconnectAttempts.Load(),
+		ReconnectsLimited:     p.stats.ReconnectsLimited.Load(),
+		DatagramsSent:         p.stats.DatagramsSent.Load(),
+		DatagramSendErrors:    p.stats.DatagramSendErrors.Load(),
+		DatagramsFragmented:   p.stats.DatagramsFragmented.Load(),
+		DatagramOversizeDrops: p.stats.DatagramOversizeDrops.Load(),
+		QueueBlocked:          p.stats.QueueBlocked.Load(),
+		QueueDropsNewest:      p.stats.QueueDropsNewest.Load(),
+		QueueDropsOldest:      p.stats.QueueDropsOldest.Load(),
+		PathMTU:               p.stats.PathMTU.Load(),
+		Breaker:               p.breaker.State(),
+		Link:                  p.link.String(),
+		Impaired:              !p.bypass.Load(),
+		TxRate:                p.txRate.snapshot(),
+		RxRate:                p.rxRate.snapshot(),
+		DNSPackets:            p.stats.DNSPackets.Load(),
+		IdleCloses:            p.stats.IdleCloses.Load(),
+		Idle:                  p.idle.closed.Load(),
+		Devices:               p.stats.Devices.snapshot(),
+		QUIC:                  p.stats.QUIC.Load(),
+	}
+	if in := p.stats.CompressIn.Load(); in > 0 {
+		snap.CompressionRatio = float64(p.stats.CompressOut.Load()) / float64(in)
+	}
+	if at := p.lastAttempt.Load(); at != 0 {
+		snap.LastAttempt = time.Unix(0, at).Format(time.RFC3339Nano)
+	}
+	if seen := p.lastSeen.Load(); seen != 0 {
+		snap.LastSeen = time.Unix(0, seen).Format(time.RFC3339Nano)
+	}
+	if p.shaper != nil {
+		snap.QueueLen = p.shaper.QueueLen()
+		snap.ShaperDrops = p.shaper.Drops.Load()
+		snap.FlowQueues = p.shaper.FlowDepths()
+		snap.AQMDrops = p.shaper.AQMDrops.Load()
+		snap.SojournUs = time.Duration(p.shaper.Sojourn.Load()).Microseconds()
+	}
+	snap.Bandwidth, snap.ReceiveBandwidth = p.conf.Bandwidth, p.conf.ReceiveBandwidth
+	if p.rxShaper != nil {
+		snap.RxQueueLen = p.rxShaper.QueueLen()
+		snap.RxShaperDrops = p.rxShaper.Drops.Load()
+	}
+	if p.delay != nil {
+		snap.DelayLen, snap.IngressDelayLen = p.delay.Len(), p.ingressDelay.Len()
+		snap.DelayDrops = p.delay.Drops.Load() + p.ingressDelay.Drops.Load()
+		snap.DelayReleased = p.delay.Released.Load() + p.ingressDelay.Released.Load()
+	}
+	return snap
+}
+
+// statsSnapshot returns the global stats and those of every peer keyed by
+// virtual IP.
+func statsSnapshot() StatsSnapshot {
+	snap := StatsSnapshot{
+		Peers:               make(map[string]PeerStatsSnapshot),
+		Aggregate:           aggregate.snapshot(),
+		ZeroLengthReads:     globalStats.ZeroLengthReads.Load(),
+		OversizedDrops:      globalStats.OversizedDrops.Load(),
+		TTLExceeded:         globalStats.TTLExceeded.Load(),
+		DecapFailures:       globalStats.DecapFailures.Load(),
+		IPv6ExtHeaders:      globalStats.IPv6ExtHeaders.Load(),
+		ECNMarked:           globalStats.ECNMarked.Load(),
+		StreamResets:        globalStats.StreamResets.Load(),
+		RouteFuncDrops:      globalStats.RouteFuncDrops.Load(),
+		RPFDrops:            globalStats.RPFDrops.Load(),
+		DatagramsReceived:   globalStats.DatagramsReceived.Load(),
+		ICMPEchoRequests:    globalStats.ICMPEchoRequests.Load(),
+		ICMPEchoReplies:     globalStats.ICMPEchoReplies.Load(),
+		FragmentedDatagrams: globalStats.FragmentedDatagrams.Load(),
+		Reassembled:         globalStats.Reassembled.Load(),
+		FragmentsPassed:     globalStats.FragmentsPassed.Load(),
+		FragmentDrops:       globalStats.FragmentDrops.Load(),
+		Refragmented:        globalStats.Refragmented.Load(),
+		VLANTagged:          globalStats.VLANTagged.Load(),
+		VLANUntagged:        globalStats.VLANUntagged.Load(),
+		SizePadded:          globalStats.SizePadded.Load(),
+		SizeDrops:           globalStats.SizeDrops.Load(),
+		PassthroughTx:       globalStats.PassthroughTx.Load(),
+		PassthroughRx:       globalStats.PassthroughRx.Load(),
+		Relayed:             globalStats.Relayed.Load(),
+		RelayHopDrops:       globalStats.RelayHopDrops.Load(),
+		QUICLibrary:         quicLibrary,
+		QUICVersions:        quicVersionNamesOf(quicVersions),
+		ServerQUIC:          globalStats.ServerQUIC.snapshot(),
+		MSSClamped:          globalStats.MSSClamped.Load(),
+		PendingRoutes:       pendingRoutes.Held(),
+		PendingRouteHeld:    globalStats.PendingRouteHeld.Load(),
+		PendingRouteFlushed: globalStats.PendingRouteFlushed.Load(),
+		PendingRouteExpired: globalStats.PendingRouteExpired.Load(),
+		PendingRouteDrops:   globalStats.PendingRouteDrops.Load(),
+		BufferedBytes:       globalStats.BufferedBytes.Load(),
+		MemoryLimit:         memoryConfig.Limit,
+		MemoryDrops:         globalStats.MemoryDrops.Load(),
+		Bottlenecks:         bottleneckSnapshots(),
+		Flows:               flowTable.Len(),
+		FlowEvictions:       flowTable.Evictions.Load(),
+		Draining:            draining.Load(),
+		Cycling:             cycling.Load(),
+		CycledConns:         cycledConns.Load(),
+		CycleRemaining:      cycleRemaining.Load(),
+		Startup:             startupSnapshot(),
+		Paused:              Paused(),
+		PausedHeld:          gate.Held(),
+		PausedDrops:         gate.Drops.Load(),
+		GenTxPackets:        globalStats.GenTxPackets.Load(),
+		GenTxBytes:          globalStats.GenTxBytes.Load(),
+		GenRxPackets:        globalStats.GenRxPackets.Load(),
+		GenRxBytes:          globalStats.GenRxBytes.Load(),
+	}
+	peerTable.Range(func(p *Peer) bool {
+		snap.Peers[p.vIP.String()] = p.snapshot()
+		return true
+	})
+	listenerStats.Range(func(_, value any) bool {
+		s := value.(*ListenerStats)
+		ls := ListenerStatsSnapshot{
+			Transport:   s.Transport,
+			Addr:        s.Addr,
+			Device:      s.Device,
+			Connections: s.Connections.Load(),
+			Active:      s.Active.Load(),
+			Rejected:    s.Rejected.Load(),
+			index:       s.index,
+		}
+		if addr := s.BoundAddr(); addr != nil {
+			ls.Bound = addr.String()
+		}
+		snap.Listeners = append(snap.Listeners, ls)
+		return true
+	})
+	sort.Slice(snap.Listeners, func(i, j int) bool {
+		return snap.Listeners[i].index < snap.Listeners[j].index
+	})
+	return snap
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// StatsExportConfig appends a stats snapshot as a JSON line every Interval,
+// read from "stats_export". File "-" is stdout. Once a file grew beyond
+// MaxSize bytes it is renamed to File.1 and a new one started, 0 never
+// rotates.
+type StatsExportConfig struct {
+	File     string        `mapstructure:"file"`
+	Interval time.Duration `mapstructure:"interval"`
+	MaxSize  int64         `mapstructure:"max_size"`
+}
+
+var statsExportConfig = StatsExportConfig{Interval: 10 * time.Second}
+
+func (c StatsExportConfig) validate() error {
+	if c.File != "" && c.Interval <= 0 {
+		return fmt.Errorf("stats_export: interval must be positive")
+	}
+	if c.MaxSize < 0 {
+		return fmt.Errorf("stats_export: max_size must not be negative")
+	}
+	return nil
+}
+
+// statsLine is one exported snapshot.
+type statsLine struct {
+	Time string `json:"time"`
+	StatsSnapshot
+}
+
+// statsExporter writes the snapshots to the configured file.
+type statsExporter struct {
+	conf StatsExportConfig
+	w    io.Writer
+	f    *os.File // nil for stdout
+	size int64
+}
+
+func (e *statsExporter) open() error {
+	f, err := os.OpenFile(e.conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	e.f, e.w, e.size = f, f, info.Size()
+	return nil
+}
+
+func (e *statsExporter) rotate() error {
+	e.f.Close()
+	if err := os.Rename(e.conf.File, e.conf.File+".1"); err != nil {
+		return err
+	}
+	return e.open()
+}
+
+func (e *statsExporter) export() error {
+	line, err := json.Marshal(statsLine{Time: clock.Now().Format(time.RFC3339Nano), StatsSnapshot: statsSnapshot()})
+	if err != nil {
+		return err
+	}
+	if e.f != nil && e.conf.MaxSize > 0 && e.size > 0 && e.size+int64(len(line))+1 > e.conf.MaxSize {
+		if err := e.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := e.w.Write(append(line, '\n'))
+	e.size += int64(n)
+	return err
+}
+
+// startStatsExport exports snapshots until ctx is done and a last one at
+// shutdown, if a file is configured.
+func startStatsExport(ctx context.Context) error {
+	if statsExportConfig.File == "" {
+		return nil
+	}
+	e := &statsExporter{conf: statsExportConfig, w: os.Stdout}
+	if e.conf.File != "-" {
+		if err := e.open(); err != nil {
+			return fmt.Errorf("stats_export: %w", err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(e.conf.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := e.export(); err != nil {
+					slog.Error("export stats failed", "file", e.conf.File, "err", err)
+				}
+			}
+		}
+	}()
+	OnShutdown(PhaseServer, "stats export", func() error {
+		<-done
+		err := e.export()
+		if e.f != nil {
+			e.f.Close()
+		}
+		return err
+	})
+	slog.Info("exporting stats", "file", e.conf.File, "interval", e.conf.Interval)
+	return nil
+}
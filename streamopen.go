@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	defaultStreamRetries = 3
+	defaultStreamTimeout = 5 * time.Second
+	// the wait between stream attempts starts here, doubling up to the
+	// initial reconnection backoff
+	streamRetryInitial = 100 * time.Millisecond
+)
+
+// openStream opens the stream to the peer on session, retrying up to
+// StreamRetries times with attempts cut off after StreamTimeout, e.g. while
+// the peer's stream limit is reached. The error wraps ErrStreamOpen if the
+// connection is still alive and ErrPeerUnreachable if it died meanwhile.
+func (p *Peer) openStream(ctx context.Context, session quic.Connection) (quic.Stream, error) {
+	conf := p.conf.backoff()
+	retry := newBackoff(BackoffConfig{Initial: min(streamRetryInitial, conf.Initial), Max: conf.Initial, Multiplier: 2})
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, conf.StreamTimeout)
+		stream, err := session.OpenStreamSync(attemptCtx)
+		cancel()
+		if err == nil {
+			return stream, nil
+		}
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case session.Context().Err() != nil:
+			return nil, fmt.Errorf("%w: open stream: connection closed: %w", ErrPeerUnreachable, err)
+		case attempt >= conf.StreamRetries:
+			p.stats.StreamOpenFailures.Add(1)
+			return nil, fmt.Errorf("%w: %d attempts: %w", ErrStreamOpen, attempt+1, err)
+		}
+		p.stats.StreamOpenRetries.Add(1)
+		wait := retry.Next()
+		slog.Warn("open stream failed on a live connection, retry", "vIP", p.vIP, "attempt", attempt+1, "wait", wait, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-session.Context().Done():
+			return nil, fmt.Errorf("%w: open stream: connection closed", ErrPeerUnreachable)
+		case <-clock.After(wait):
+		}
+	}
+}
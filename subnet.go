@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// allocTunAddrs hands out n consecutive host addresses of cidr, starting at
+// the first usable one, for the tun interfaces. For IPv4 subnets larger than
+// /31 the network and broadcast addresses are never handed out.
+func allocTunAddrs(cidr string, n int) ([]net.IPNet, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tun cidr %q: %w", cidr, err)
+	}
+	prefix = prefix.Masked()
+	network := prefix.Addr()
+	bits := network.BitLen()
+	skipEnds := network.Is4() && prefix.Bits() < 31
+
+	mask := net.CIDRMask(prefix.Bits(), bits)
+	addrs := make([]net.IPNet, 0, n)
+	addr := network
+	if skipEnds {
+		addr = addr.Next()
+	}
+	for len(addrs) < n {
+		if !addr.IsValid() || !prefix.Contains(addr) || (skipEnds && isBroadcast(addr, prefix)) {
+			return nil, fmt.Errorf("%d tun interfaces do not fit in %s, only %d usable addresses", n, prefix, len(addrs))
+		}
+		addrs = append(addrs, net.IPNet{IP: net.IP(addr.AsSlice()), Mask: mask})
+		addr = addr.Next()
+	}
+	return addrs, nil
+}
+
+// isBroadcast reports whether addr is the last address of the IPv4 prefix.
+func isBroadcast(addr netip.Addr, prefix netip.Prefix) bool {
+	next := addr.Next()
+	return !next.IsValid() || !prefix.Contains(next)
+}
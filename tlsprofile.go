@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSProfile is a named set of client TLS settings, read from
+// "tls_profiles". Peers pick one with tls_profile, so a simulator can dial
+// peers that authenticate differently.
+type TLSProfile struct {
+	// Cert and Key are presented to peers requiring a client certificate.
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+	// CA is a PEM bundle the peer certificate must chain to, the system
+	// roots if empty.
+	CA         string `mapstructure:"ca"`
+	ServerName string `mapstructure:"server_name"`
+	// Insecure skips verifying the peer certificate.
+	Insecure bool `mapstructure:"insecure"`
+	// ALPN is offered to the peer, the simulator's own protocol if empty.
+	ALPN []string `mapstructure:"alpn"`
+
+	cert    *tls.Certificate
+	rootCAs *x509.CertPool
+}
+
+var tlsProfiles map[string]*TLSProfile
+
+func loadTLSProfiles(profiles map[string]*TLSProfile) error {
+	for name, tp := range profiles {
+		if tp == nil {
+			return fmt.Errorf("tls_profiles.%s: empty profile", name)
+		}
+		if !tp.Insecure && tp.ServerName == "" {
+			return fmt.Errorf("tls_profiles.%s: verifying needs a server_name", name)
+		}
+		if tp.Cert != "" || tp.Key != "" {
+			cert, err := tls.LoadX509KeyPair(tp.Cert, tp.Key)
+			if err != nil {
+				return fmt.Errorf("tls_profiles.%s: load certificate: %w", name, err)
+			}
+			tp.cert = &cert
+		}
+		if tp.CA != "" {
+			pem, err := os.ReadFile(tp.CA)
+			if err != nil {
+				return fmt.Errorf("tls_profiles.%s: read ca: %w", name, err)
+			}
+			tp.rootCAs = x509.NewCertPool()
+			if !tp.rootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("tls_profiles.%s: no certificate found in ca %s", name, tp.CA)
+			}
+		}
+		if len(tp.ALPN) == 0 {
+			tp.ALPN = []string{alpnProto}
+		}
+	}
+	tlsProfiles = profiles
+	return nil
+}
+
+// tlsConfig builds the client TLS settings of the profile.
+func (tp *TLSProfile) tlsConfig() *tls.Config {
+	conf := &tls.Config{
+		ServerName:         tp.ServerName,
+		InsecureSkipVerify: tp.Insecure,
+		RootCAs:            tp.rootCAs,
+		NextProtos:         tp.ALPN,
+	}
+	if tp.cert != nil {
+		conf.Certificates = []tls.Certificate{*tp.cert}
+	}
+	return conf
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TracingConfig exports OpenTelemetry spans for sampled packets, read from
+// "tracing". Spans are sent as OTLP/HTTP JSON to Endpoint, e.g.
+// http://localhost:4318/v1/traces.
+type TracingConfig struct {
+	Endpoint string `mapstructure:"endpoint"`
+	// Sample is the fraction of packets traced.
+	Sample      float64       `mapstructure:"sample"`
+	ServiceName string        `mapstructure:"service_name"`
+	Interval    time.Duration `mapstructure:"interval"`
+}
+
+var tracingConfig = TracingConfig{Sample: 0.01, ServiceName: "network-simulator", Interval: 5 * time.Second}
+
+func (c TracingConfig) validate() error {
+	if c.Sample < 0 || c.Sample > 1 {
+		return fmt.Errorf("tracing: sample %v is not a fraction", c.Sample)
+	}
+	if c.Endpoint != "" && c.Interval <= 0 {
+		return fmt.Errorf("tracing: interval must be positive")
+	}
+	return nil
+}
+
+// maxPendingSpans bounds the spans buffered between exports, the newest
+// are dropped beyond it.
+const maxPendingSpans = 10000
+
+// spanExporter batches the spans of sampled packets and exports them.
+type spanExporter struct {
+	conf   TracingConfig
+	client *http.Client
+	mu     sync.Mutex
+	spans  []otlpSpan
+}
+
+// spans is the running exporter, nil if tracing is disabled.
+var spans *spanExporter
+
+// packetTraceID derives the trace of packet from the fields both simulators
+// see unchanged: addresses, protocol, IP identification and the start of the
+// L4 header, so the spans of the sending and the receiving side of a packet
+// end up in one trace without any header added to the packet.
+func packetTraceID(packet []byte) ([16]byte, bool) {
+	var id [16]byte
+	if !validIPv4Header(packet) {
+		return id, false
+	}
+	h := fnv.New128a()
+	h.Write(packet[4:6])   // identification
+	h.Write(packet[9:10])  // protocol
+	h.Write(packet[12:20]) // addresses
+	l4 := packet[ipv4HeaderLen(packet):]
+	h.Write(l4[:min(len(l4), 8)])
+	h.Sum(id[:0])
+	return id, true
+}
+
+// packetSpan is the span of one packet passing one simulator.
+type packetSpan struct {
+	span otlpSpan
+}
+
+// startPacketSpan starts span name for packet if the packet is sampled, nil
+// otherwise. The decision is taken from the trace ID, so both sides sample
+// the same packets.
+func startPacketSpan(name string, packet []byte) *packetSpan {
+	if spans == nil {
+		return nil
+	}
+	traceID, ok := packetTraceID(packet)
+	if !ok || float64(binary.BigEndian.Uint64(traceID[8:]))/(1<<64) >= spans.conf.Sample {
+		return nil
+	}
+	var spanID [8]byte
+	rand.Read(spanID[:])
+	s := &packetSpan{span: otlpSpan{
+		TraceID:   hex.EncodeToString(traceID[:]),
+		SpanID:    hex.EncodeToString(spanID[:]),
+		Name:      name,
+		Kind:      1, // internal
+		StartTime: unixNano(clock.Now()),
+	}}
+	if flow, ok := parseFlowKey(packet); ok {
+		s.attr("flow", flow.String())
+	}
+	s.attr("len", strconv.Itoa(len(packet)))
+	return s
+}
+
+func unixNano(t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) }
+
+func (s *packetSpan) attr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.span.Attributes = append(s.span.Attributes, otlpAttr{Key: key, Value: otlpValue{String: value}})
+}
+
+// event records that the packet reached stage name.
+func (s *packetSpan) event(name string) {
+	if s == nil {
+		return
+	}
+	s.span.Events = append(s.span.Events, otlpEvent{Time: unixNano(clock.Now()), Name: name})
+}
+
+// end finishes the span and queues it for export.
+func (s *packetSpan) end() {
+	if s == nil {
+		return
+	}
+	s.span.EndTime = unixNano(clock.Now())
+	spans.mu.Lock()
+	if len(spans.spans) < maxPendingSpans {
+		spans.spans = append(spans.spans, s.span)
+	}
+	spans.mu.Unlock()
+}
+
+// run exports the queued spans every interval until ctx is done.
+func (e *spanExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(e.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.export(ctx); err != nil {
+				slog.Error("export spans failed", "endpoint", e.conf.Endpoint, "err", err)
+			}
+		}
+	}
+}
+
+func (e *spanExporter) export(ctx context.Context) error {
+	e.mu.Lock()
+	batch := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttr{{Key: "service.name", Value: otlpValue{String: e.conf.ServiceName}}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "network-simulator"},
+			Spans: batch,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.conf.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// startTracing starts the span exporter if an endpoint is configured.
+func startTracing(ctx context.Context) {
+	if tracingConfig.Endpoint == "" {
+		return
+	}
+	spans = &spanExporter{conf: tracingConfig, client: &http.Client{Timeout: 10 * time.Second}}
+	go spans.run(ctx)
+	OnShutdown(PhaseServer, "tracing", func() error {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		return spans.export(shutdownCtx)
+	})
+	slog.Info("tracing packets", "endpoint", tracingConfig.Endpoint, "sample", tracingConfig.Sample)
+}
+
+// The OTLP/HTTP JSON encoding of an export request, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID    string      `json:"traceId"`
+	SpanID     string      `json:"spanId"`
+	Name       string      `json:"name"`
+	Kind       int         `json:"kind"`
+	StartTime  string      `json:"startTimeUnixNano"`
+	EndTime    string      `json:"endTimeUnixNano"`
+	Attributes []otlpAttr  `json:"attributes,omitempty"`
+	Events     []otlpEvent `json:"events,omitempty"`
+}
+
+type otlpEvent struct {
+	Time string `json:"timeUnixNano"`
+	Name string `json:"name"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	String string `json:"stringValue"`
+}
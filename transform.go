@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Packet is a packet handed to a TransformFunc with its fields parsed.
+// Data is a copy the transform may change freely, Payload is the part of it
+// after the TCP or UDP header, or after the IP header for other protocols.
+type Packet struct {
+	Data    []byte
+	Flow    FlowKey
+	Dir     Direction
+	Payload []byte
+}
+
+// TransformFunc mutates a packet in flight, returning the packet to forward
+// or false to drop it. out may be p.Data, a slice of it or a new packet.
+type TransformFunc func(p *Packet) (out []byte, forward bool)
+
+// RegisterTransform makes f available as impairment name, so it can be put
+// into a peer's impairments chain with a direction and checksums (default
+// true) recomputing the IPv4 and TCP/UDP checksums of the transformed packet.
+func RegisterTransform(name string, f TransformFunc) {
+	RegisterImpairment(name, func(params map[string]any, _ int64) (Impairment, error) {
+		return transformFromParams(params, nil, func() (TransformFunc, error) { return f, nil })
+	})
+}
+
+// transformImpairment runs a TransformFunc on the IPv4 packets of dir.
+type transformImpairment struct {
+	f         TransformFunc
+	dir       Direction
+	checksums bool
+}
+
+func (t *transformImpairment) Apply(pkt []byte, dir Direction) (bool, time.Duration, []byte) {
+	if t.dir&dir == 0 {
+		return true, 0, pkt
+	}
+	flow, ok := parseFlowKey(pkt)
+	if !ok || !validIPv4Header(pkt) {
+		return true, 0, pkt
+	}
+	data := append([]byte(nil), pkt...)
+	p := &Packet{Data: data, Flow: flow, Dir: dir, Payload: data[payloadOffset(data):]}
+	out, forward := t.f(p)
+	if !forward {
+		return false, 0, nil
+	}
+	if t.checksums && validIPv4Header(out) {
+		fixChecksums(out)
+	}
+	return true, 0, out
+}
+
+// payloadOffset returns where the L4 payload of an IPv4 packet starts.
+func payloadOffset(packet []byte) int {
+	off := ipv4HeaderLen(packet)
+	l4 := packet[off:]
+	switch packet[9] {
+	case protoTCP:
+		if len(l4) >= 20 {
+			return off + min(int(l4[12]>>4)*4, len(l4))
+		}
+	case protoUDP:
+		if len(l4) >= udpHeaderLen {
+			return off + udpHeaderLen
+		}
+	}
+	return off
+}
+
+// fixChecksums makes the lengths and checksums of an IPv4 packet match its
+// content again after it was changed.
+func fixChecksums(packet []byte) {
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	updateIPv4Checksum(packet)
+	l4 := packet[ipv4HeaderLen(packet):]
+	if packet[9] == protoUDP && len(l4) >= udpHeaderLen {
+		binary.BigEndian.PutUint16(l4[4:], uint16(len(l4)))
+	}
+	updateL4Checksum(packet)
+}
+
+// transformFromParams decodes the params shared by all transforms and has
+// build make the TransformFunc. The other params are decoded into conf, a
+// transform without params of its own passes nil.
+func transformFromParams(params map[string]any, conf any, build func() (TransformFunc, error)) (Impairment, error) {
+	var common struct {
+		Direction string `mapstructure:"direction"`
+		Checksums *bool  `mapstructure:"checksums"`
+	}
+	shared, own := make(map[string]any), make(map[string]any)
+	for k, v := range params {
+		if k == "direction" || k == "checksums" {
+			shared[k] = v
+		} else {
+			own[k] = v
+		}
+	}
+	if err := decodeParams(shared, &common); err != nil {
+		return nil, err
+	}
+	if conf != nil {
+		if err := decodeParams(own, conf); err != nil {
+			return nil, err
+		}
+	} else if len(own) > 0 {
+		return nil, fmt.Errorf("unknown params %v", own)
+	}
+	dir, err := parseDirection(common.Direction)
+	if err != nil {
+		return nil, err
+	}
+	f, err := build()
+	if err != nil {
+		return nil, err
+	}
+	return &transformImpairment{f: f, dir: dir, checksums: common.Checksums == nil || *common.Checksums}, nil
+}
+
+// truncate keeps the first keep bytes of the payload.
+func newTruncateFromParams(params map[string]any, _ int64) (Impairment, error) {
+	var conf struct {
+		Keep int `mapstructure:"keep"`
+	}
+	return transformFromParams(params, &conf, func() (TransformFunc, error) {
+		if conf.Keep < 0 {
+			return nil, fmt.Errorf("keep must not be negative")
+		}
+		return func(p *Packet) ([]byte, bool) {
+			if len(p.Payload) <= conf.Keep {
+				return p.Data, true
+			}
+			return p.Data[:len(p.Data)-len(p.Payload)+conf.Keep], true
+		}, nil
+	})
+}
+
+// pad appends bytes bytes of value to the payload, as long as the packet
+// stays within BUFSIZE.
+func newPadFromParams(params map[string]any, _ int64) (Impairment, error) {
+	var conf struct {
+		Bytes int  `mapstructure:"bytes"`
+		Value byte `mapstructure:"value"`
+	}
+	return transformFromParams(params, &conf, func() (TransformFunc, error) {
+		if conf.Bytes < 0 {
+			return nil, fmt.Errorf("bytes must not be negative")
+		}
+		return func(p *Packet) ([]byte, bool) {
+			n := min(conf.Bytes, BUFSIZE-len(p.Data))
+			for i := 0; i < n; i++ {
+				p.Data = append(p.Data, conf.Value)
+			}
+			return p.Data, true
+		}, nil
+	})
+}
+
+// byteflip xors the payload byte at offset with mask, with probability
+// probability. A negative offset picks a random byte.
+func newByteFlipFromParams(params map[string]any, seed int64) (Impairment, error) {
+	conf := struct {
+		Offset      int     `mapstructure:"offset"`
+		Mask        byte    `mapstructure:"mask"`
+		Probability float64 `mapstructure:"probability"`
+	}{Mask: 0xff, Probability: 1}
+	return transformFromParams(params, &conf, func() (TransformFunc, error) {
+		if err := probability("probability", conf.Probability); err != nil {
+			return nil, err
+		}
+		var mu sync.Mutex
+		rng := rand.New(rand.NewSource(seed))
+		return func(p *Packet) ([]byte, bool) {
+			if len(p.Payload) == 0 {
+				return p.Data, true
+			}
+			mu.Lock()
+			flip := rng.Float64() < conf.Probability
+			off := conf.Offset
+			if off < 0 {
+				off = rng.Intn(len(p.Payload))
+			}
+			mu.Unlock()
+			if flip && off < len(p.Payload) {
+				p.Payload[off] ^= conf.Mask
+			}
+			return p.Data, true
+		}, nil
+	})
+}
+
+// size enforces the total length of the IP packets to be within [min, max],
+// 0 leaving either side open. Larger packets are dropped, smaller ones too
+// unless pad is set: they are padded up to min with bytes of value, which
+// become part of the L4 payload, also of TCP segments. With checksums the
+// IP total length and checksum and the UDP length and the TCP/UDP checksum
+// are adjusted to the padded packet. min = max with pad makes every packet
+// one size.
+func newSizeFromParams(params map[string]any, _ int64) (Impairment, error) {
+	var conf struct {
+		Min   int  `mapstructure:"min"`
+		Max   int  `mapstructure:"max"`
+		Pad   bool `mapstructure:"pad"`
+		Value byte `mapstructure:"value"`
+	}
+	return transformFromParams(params, &conf, func() (TransformFunc, error) {
+		if conf.Min < 0 || conf.Max < 0 || conf.Max > 0 && conf.Min > conf.Max {
+			return nil, fmt.Errorf("min and max must not be negative and min not above max")
+		}
+		if conf.Pad && (conf.Min == 0 || conf.Min > BUFSIZE) {
+			return nil, fmt.Errorf("pad needs a min within [1, %d]", BUFSIZE)
+		}
+		return func(p *Packet) ([]byte, bool) {
+			switch n := len(p.Data); {
+			case conf.Max > 0 && n > conf.Max, n < conf.Min && !conf.Pad:
+				globalStats.SizeDrops.Add(1)
+				return nil, false
+			case n < conf.Min:
+				for len(p.Data) < conf.Min {
+					p.Data = append(p.Data, conf.Value)
+				}
+				globalStats.SizePadded.Add(1)
+			}
+			return p.Data, true
+		}, nil
+	})
+}
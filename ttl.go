@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+)
+
+// ttlDecrement makes the simulator act as a router hop: the TTL (IPv6 hop
+// limit) of every packet from a peer is decremented, and an expiring IPv4
+// packet is answered with an ICMP Time Exceeded. Peers can override it.
+var ttlDecrement bool
+
+// ttlDecrementFor reports whether packets from the peer src decrement their TTL.
+func ttlDecrementFor(src netip.Addr) bool {
+	if pc := peerConfig(net.IP(src.AsSlice())); pc.TTLDecrement != nil {
+		return *pc.TTLDecrement
+	}
+	return ttlDecrement
+}
+
+// decrementTTL lowers the TTL or hop limit of packet by one, reporting
+// false if the packet expired and must be dropped.
+func decrementTTL(packet []byte) bool {
+	switch packet[0] >> 4 {
+	case 4:
+		if !validIPv4Header(packet) {
+			return true
+		}
+		if packet[8] <= 1 {
+			return false
+		}
+		packet[8]--
+		updateIPv4Checksum(packet)
+	case 6:
+		if len(packet) < 40 {
+			return true
+		}
+		if packet[7] <= 1 {
+			return false
+		}
+		packet[7]--
+	}
+	return true
+}
+
+// sendTimeExceeded answers an expired packet that was to be written to dev
+// with an ICMP Time Exceeded from dev's address back to its source. IPv6 is
+// not routed yet, so expired IPv6 packets are only dropped.
+func sendTimeExceeded(dev *TunDevice, packet []byte) {
+	if packet[0]>>4 != 4 || isICMPError(packet) {
+		return
+	}
+	src, ok := netip.AddrFromSlice(net.ParseIP(dev.ip).To4())
+	if !ok {
+		return
+	}
+	dst := netip.AddrFrom4([4]byte(packet[12:16]))
+	body := append(make([]byte, 4), icmpQuote(packet)...)
+	icmp := buildICMPPacket(src, dst, icmpTimeExceeded, 0, body)
+	flow, _ := parseFlowKey(icmp)
+	slog.Info("ttl exceeded", "src", dst, "dst", netip.AddrFrom4([4]byte(packet[16:20])))
+	sendToPeer(routeFor(flow), icmp)
+}
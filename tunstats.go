@@ -0,0 +1,24 @@
+package main
+
+// KernelDeviceStats are the counters the OS keeps for a tun device. From
+// the kernel's point of view packets it transmits are the ones the
+// simulator reads, and packets it receives the ones the simulator writes:
+// compare TxPackets with DeviceInfo.Read and RxPackets with
+// DeviceInfo.Written to see on which side packets got lost.
+type KernelDeviceStats struct {
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxErrors  uint64 `json:"rx_errors"`
+	RxDropped uint64 `json:"rx_dropped"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxErrors  uint64 `json:"tx_errors"`
+	TxDropped uint64 `json:"tx_dropped"`
+}
+
+// KernelStats reads the OS counters of dev. It is best effort: only Linux
+// is supported, reading sysfs, and devices the OS does not know, such as
+// in-memory ones, fail.
+func (dev *TunDevice) KernelStats() (KernelDeviceStats, error) {
+	return readKernelStats(dev.name)
+}
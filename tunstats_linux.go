@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func readKernelStats(name string) (KernelDeviceStats, error) {
+	var stats KernelDeviceStats
+	dir := filepath.Join("/sys/class/net", name, "statistics")
+	for file, v := range map[string]*uint64{
+		"rx_packets": &stats.RxPackets,
+		"rx_bytes":   &stats.RxBytes,
+		"rx_errors":  &stats.RxErrors,
+		"rx_dropped": &stats.RxDropped,
+		"tx_packets": &stats.TxPackets,
+		"tx_bytes":   &stats.TxBytes,
+		"tx_errors":  &stats.TxErrors,
+		"tx_dropped": &stats.TxDropped,
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return KernelDeviceStats{}, err
+		}
+		if *v, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return KernelDeviceStats{}, err
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func readKernelStats(string) (KernelDeviceStats, error) {
+	return KernelDeviceStats{}, errors.New("not supported on this platform")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"gitee.com/czy_hit/softbus-go/net/tun"
+)
+
+// TunWriteConfig batches packets written to the tun devices, read from
+// "tun_write". A batch is written once it is full or FlushInterval after
+// its first packet arrived, whichever comes first.
+type TunWriteConfig struct {
+	// Batch is the number of packets per write, 1 writes every packet at once.
+	Batch         int           `mapstructure:"batch"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// Queue bounds the packets waiting for a device write, so a device that
+	// stops taking packets does not hold up the streams from the peers. 0
+	// writes from the stream readers unless batching. Full is what happens
+	// to a packet arriving at a full queue: QueueFullBlock waits up to
+	// Timeout, forever if 0, then drops it, QueueFullDropNewest and
+	// QueueFullDropOldest drop at once.
+	Queue   int           `mapstructure:"queue"`
+	Full    string        `mapstructure:"full"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+var tunWriteConfig = TunWriteConfig{Batch: 1, FlushInterval: time.Millisecond, Full: QueueFullBlock}
+
+func (c *TunWriteConfig) validate() error {
+	if c.Batch < 1 || c.FlushInterval <= 0 {
+		return fmt.Errorf("tun_write: batch must be at least 1 and flush_interval positive")
+	}
+	if c.Queue < 0 || c.Timeout < 0 {
+		return fmt.Errorf("tun_write: queue and timeout must not be negative")
+	}
+	switch c.Full {
+	case "":
+		c.Full = QueueFullBlock
+	case QueueFullBlock, QueueFullDropNewest, QueueFullDropOldest:
+	default:
+		return fmt.Errorf("tun_write: unknown full %q", c.Full)
+	}
+	return nil
+}
+
+// queued reports whether the writes to the devices go through a batchWriter.
+func (c TunWriteConfig) queued() bool { return c.Batch > 1 || c.Queue > 0 }
+
+// batchWriter collects packets for one tun device and writes them in batches.
+type batchWriter struct {
+	dev      tun.Device
+	in       chan []byte
+	size     int
+	interval time.Duration
+	full     string
+	timeout  time.Duration
+
+	batches atomic.Uint64
+	packets atomic.Uint64
+	// Drops are packets dropped at a full queue, Timeouts those dropped
+	// after waiting for it in vain.
+	Drops    atomic.Uint64
+	Timeouts atomic.Uint64
+}
+
+func newBatchWriter(dev tun.Device, conf TunWriteConfig) *batchWriter {
+	return &batchWriter{
+		dev:      dev,
+		in:       make(chan []byte, max(conf.Batch, conf.Queue)),
+		size:     conf.Batch,
+		interval: conf.FlushInterval,
+		full:     conf.Full,
+		timeout:  conf.Timeout,
+	}
+}
+
+// enqueue hands pkt to the writer, applying the full policy if the queue
+// is full.
+func (w *batchWriter) enqueue(pkt []byte) {
+	select {
+	case w.in <- pkt:
+		return
+	default:
+	}
+	switch w.full {
+	case QueueFullDropNewest:
+		w.Drops.Add(1)
+	case QueueFullDropOldest:
+		for {
+			select {
+			case <-w.in:
+				w.Drops.Add(1)
+			default:
+			}
+			select {
+			case w.in <- pkt:
+				return
+			default:
+			}
+		}
+	default:
+		if w.timeout == 0 {
+			w.in <- pkt
+			return
+		}
+		select {
+		case w.in <- pkt:
+		case <-clock.After(w.timeout):
+			w.Timeouts.Add(1)
+		}
+	}
+}
+
+// QueueLen is the number of packets waiting for the device.
+func (w *batchWriter) QueueLen() int { return len(w.in) }
+
+// AvgBatch is the average number of packets per tun write so far.
+func (w *batchWriter) AvgBatch() float64 {
+	batches := w.batches.Load()
+	if batches == 0 {
+		return 0
+	}
+	return float64(w.packets.Load()) / float64(batches)
+}
+
+func (w *batchWriter) run(ctx context.Context) {
+	batch := make([][]byte, 0, w.size)
+	timer := clock.NewTimer(w.interval)
+	stopTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+	}
+	stopTimer()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pkt := <-w.in:
+			batch = append(batch, pkt)
+			if len(batch) == 1 {
+				timer.Reset(w.interval)
+			}
+			if len(batch) < w.size {
+				continue
+			}
+			stopTimer()
+		case <-timer.C():
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if _, err := w.dev.Write(batch, 0); err != nil {
+			slog.Error("write tun batch failed", "packets", len(batch), "err", err)
+		}
+		w.batches.Add(1)
+		w.packets.Add(uint64(len(batch)))
+		batch = batch[:0]
+	}
+}
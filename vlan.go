@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// VLANStrip drops the 802.1Q tag of packets read from the interface,
+	// VLANPreserve also tags the packets written to it again.
+	VLANStrip    = "strip"
+	VLANPreserve = "preserve"
+
+	tpid8021Q = 0x8100
+	// vlanTagLen is the tag and the ethertype following it.
+	vlanTagLen = 6
+)
+
+// VLANConfig is the VLAN handling of one tun interface, read from "vlan"
+// keyed by interface name. Interfaces without one pass tagged packets on
+// untouched, which peers can not route.
+type VLANConfig struct {
+	Mode string `mapstructure:"mode"`
+	// ID is the tag control information written by preserve, 0 reuses the
+	// last one read from the interface.
+	ID uint16 `mapstructure:"id"`
+}
+
+var vlanConfigs map[string]VLANConfig
+
+func validateVLANConfigs(confs map[string]VLANConfig) error {
+	for name, vc := range confs {
+		if vc.Mode != VLANStrip && vc.Mode != VLANPreserve {
+			return fmt.Errorf("vlan.%s: mode must be %s or %s, got %q", name, VLANStrip, VLANPreserve, vc.Mode)
+		}
+	}
+	return nil
+}
+
+// vlanState handles the tags of one device.
+type vlanState struct {
+	conf VLANConfig
+	// lastTCI is the tag control information last read, with bit 16 set
+	// once one was read
+	lastTCI atomic.Uint32
+}
+
+func newVLANState(name string) *vlanState {
+	vc, ok := vlanConfigs[name]
+	if !ok {
+		return nil
+	}
+	return &vlanState{conf: vc}
+}
+
+// isVLANTagged reports whether packet starts with an 802.1Q tag. An IP
+// packet never does, its first nibble is the IP version.
+func isVLANTagged(packet []byte) bool {
+	return len(packet) >= vlanTagLen && binary.BigEndian.Uint16(packet) == tpid8021Q
+}
+
+// untag counts packet as tagged or untagged and returns it without its tag
+// if the device handles VLANs.
+func (v *vlanState) untag(packet []byte) []byte {
+	if !isVLANTagged(packet) {
+		globalStats.VLANUntagged.Add(1)
+		return packet
+	}
+	globalStats.VLANTagged.Add(1)
+	if v == nil {
+		return packet
+	}
+	v.lastTCI.Store(1<<16 | uint32(binary.BigEndian.Uint16(packet[2:])))
+	return packet[vlanTagLen:]
+}
+
+// tci returns the tag control information tag writes, false if it does not
+// tag.
+func (v *vlanState) tci() (uint16, bool) {
+	if v == nil || v.conf.Mode != VLANPreserve {
+		return 0, false
+	}
+	if v.conf.ID != 0 {
+		return v.conf.ID, true
+	}
+	last := v.lastTCI.Load()
+	return uint16(last), last != 0
+}
+
+// tagLen is the number of bytes tag adds to packet.
+func (v *vlanState) tagLen(packet []byte) int {
+	if _, ok := v.tci(); !ok || isVLANTagged(packet) {
+		return 0
+	}
+	return vlanTagLen
+}
+
+// tag returns packet with the tag of a preserving device put back, or
+// packet itself.
+func (v *vlanState) tag(packet []byte) []byte {
+	tci, ok := v.tci()
+	if !ok || isVLANTagged(packet) {
+		return packet
+	}
+	tagged := make([]byte, vlanTagLen, vlanTagLen+len(packet))
+	binary.BigEndian.PutUint16(tagged[0:], tpid8021Q)
+	binary.BigEndian.PutUint16(tagged[2:], tci)
+	binary.BigEndian.PutUint16(tagged[4:], etherTypeIPv4)
+	return append(tagged, packet...)
+}
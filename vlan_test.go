@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// TestVLANTagWithinMTU sends a packet filling the MTU to a preserving
+// device, which must fragment it so the tagged fragments fit the MTU.
+func TestVLANTagWithinMTU(t *testing.T) {
+	got := startLoopback(t, "vlan:\n  lo-dst:\n    mode: preserve\n    id: 5\n")
+	if err := InjectPacket("lo-src", loopbackPacket(1500-ipv4MinHeaderLen-udpHeaderLen)); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	var data int
+	for data < 1500-ipv4MinHeaderLen {
+		select {
+		case frame := <-got:
+			if len(frame) > 1500 {
+				t.Fatalf("wrote %d bytes to a device with mtu 1500", len(frame))
+			}
+			if !isVLANTagged(frame) || binary.BigEndian.Uint16(frame[2:]) != 5 {
+				t.Fatal("frame written without the vlan tag")
+			}
+			frag := frame[vlanTagLen:]
+			if !isIPv4Fragment(frag) {
+				t.Fatalf("delivered %d bytes unfragmented", len(frag))
+			}
+			data += len(frag) - ipv4HeaderLen(frag)
+		case <-timeout:
+			t.Fatalf("only %d bytes of data arrived", data)
+		}
+	}
+}
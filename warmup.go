@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// The startup warmup forwards as usual but leaves its packets out of the
+// stats: once it is over every counter, rate window and the aggregate
+// start again from zero, so the reported numbers reflect the steady state
+// rather than connection setup. Gauges such as the path MTU are kept.
+
+// warmupEnded is when the warmup ended in unix nanoseconds, 0 while it
+// runs or without one.
+var warmupEnded atomic.Int64
+
+// warmingUp reports whether the warmup is still running.
+func warmingUp() bool {
+	return startupConfig.Warmup > 0 && warmupEnded.Load() == 0
+}
+
+// runWarmup resets the stats once the warmup is over, unless ctx is done
+// first.
+func runWarmup(ctx context.Context) {
+	if startupConfig.Warmup == 0 {
+		return
+	}
+	slog.Info("warmup started, stats are reset once it ends", "warmup", startupConfig.Warmup)
+	select {
+	case <-ctx.Done():
+		return
+	case <-clock.After(startupConfig.Warmup):
+	}
+	resetStats()
+	warmupEnded.Store(clock.Now().UnixNano())
+	slog.Info("warmup ended, stats reset", "warmup", startupConfig.Warmup)
+}
+
+// resetStats zeroes the counters of the stats.
+func resetStats() {
+	// the aggregate would see the peer counters go back otherwise
+	aggregate.mu.Lock()
+	defer aggregate.mu.Unlock()
+	resetCounters(&globalStats)
+	peerTable.Range(func(p *Peer) bool {
+		resetCounters(&p.stats)
+		p.txRate.reset()
+		p.rxRate.reset()
+		aggregate.last[p] = aggregateTotals{}
+		return true
+	})
+	aggregate.samples, aggregate.total = nil, aggregateTotals{}
+	for _, dev := range tunDevices() {
+		dev.read.Store(0)
+		dev.written.Store(0)
+	}
+}
+
+// resetCounters zeroes the atomic.Uint64 and deviceCounts fields of the
+// struct s points to.
+func resetCounters(s any) {
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch f := v.Field(i).Addr().Interface().(type) {
+		case *atomic.Uint64:
+			f.Store(0)
+		case *deviceCounts:
+			f.m.Range(func(name, _ any) bool {
+				f.m.Delete(name)
+				return true
+			})
+		}
+	}
+}
+
+// warmupSnapshot reports the end of the warmup, empty without one.
+func warmupSnapshot() string {
+	if at := warmupEnded.Load(); at != 0 {
+		return time.Unix(0, at).Format(time.RFC3339Nano)
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// TransportWebSocket is WebSocket over TLS for clients such as browsers that
+// can not speak QUIC. Every binary message carries one length-prefixed frame.
+const TransportWebSocket = "wss"
+
+type wsStream struct {
+	*websocket.Conn
+}
+
+func (s wsStream) closeConn(string) { s.Close() }
+
+// serveWebSocket accepts WebSocket connections on any path of addr.
+func serveWebSocket(ctx context.Context, addr string, stats *ListenerStats) error {
+	ws := websocket.Server{
+		// browsers send their page as Origin, any page may connect
+		Handshake: func(_ *websocket.Config, req *http.Request) error {
+			if remote, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err != nil || !allowed(remote, stats) {
+				return errors.New("not allowed")
+			}
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			if draining.Load() {
+				conn.Close()
+				return
+			}
+			stats.accepted()
+			defer stats.closed()
+			defer serverConns.add(func(string) { conn.Close() })()
+			conn.PayloadType = websocket.BinaryFrame
+			req := conn.Request()
+			if remote, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil && req.TLS != nil {
+				logClientIdentity(remote, *req.TLS)
+			}
+			serveStream(ctx, wsStream{conn}, req.RemoteAddr, stats.device())
+		},
+	}
+	tlsConf, err := generateTLSConfig()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Addr: addr, Handler: ws, TLSConfig: tlsConf}
+	// the ALPN of the QUIC listener would keep browsers from negotiating http
+	srv.TLSConfig.NextProtos = []string{"http/1.1"}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	OnShutdown(PhaseAccept, "wss "+addr, func() error {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	})
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	stats.setBound(ln.Addr())
+	err = srv.ServeTLS(ln, "", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
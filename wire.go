@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// Wire corruption flips a byte in UDP datagrams after QUIC built and
+// encrypted them, modelling a lossy medium below the transport. QUIC's
+// integrity check makes the receiver drop every corrupted datagram, so the
+// effect is packet loss that QUIC detects and retransmits, which the
+// quic_lost_packets stat counts.
+type wireCorrupter struct {
+	prob float64
+	mu   sync.Mutex
+	rng  *rand.Rand
+}
+
+func newWireCorrupter(prob float64, seed int64) *wireCorrupter {
+	return &wireCorrupter{prob: prob, rng: rand.New(rand.NewSource(seed))}
+}
+
+// corrupt returns b with a random byte changed, or b itself.
+func (w *wireCorrupter) corrupt(b []byte) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(b) == 0 || w.rng.Float64() >= w.prob {
+		return b, false
+	}
+	c := append([]byte(nil), b...)
+	c[w.rng.Intn(len(c))] ^= byte(w.rng.Intn(255) + 1)
+	return c, true
+}
+
+// corruptConn corrupts the datagrams written to it. It only embeds the
+// net.PacketConn interface, so quic-go can not bypass WriteTo through the
+// batch or OOB methods of the underlying socket.
+type corruptConn struct {
+	net.PacketConn
+	p *Peer
+}
+
+func (c *corruptConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	out, corrupted := b, false
+	if !c.p.bypass.Load() {
+		out, corrupted = c.p.wire.corrupt(b)
+	}
+	if corrupted {
+		c.p.stats.WireCorrupted.Add(1)
+	}
+	if _, err := c.PacketConn.WriteTo(out, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// wrapConn returns the function wrapping the peer's UDP socket, nil when no
+// wire corruption is configured.
+func (p *Peer) wrapConn() func(net.PacketConn) net.PacketConn {
+	if p.wire == nil {
+		return nil
+	}
+	slog.Info("wire corruption enabled below the QUIC layer, corrupted datagrams are dropped by QUIC and retransmitted",
+		"vIP", p.vIP, "probability", p.wire.prob)
+	return func(conn net.PacketConn) net.PacketConn {
+		return &corruptConn{PacketConn: conn, p: p}
+	}
+}
+
+// tracer counts the packets QUIC declared lost on the peer's connections.
+func (p *Peer) tracer(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			p.stats.QUICLostPackets.Add(1)
+		},
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Peers with zero_rtt keep their TLS session tickets in sessionCache, so a
+// re-dial resumes the session and already sends tunnelled packets in its
+// first flight. Early data can be replayed by an attacker; the server only
+// accepts it with the top-level zero_rtt and still waits for the handshake
+// to complete before it forwards anything, so a replayed flight, which can
+// never finish the handshake, is discarded.
+var sessionCache = tls.NewLRUClientSessionCache(64)
+
+// zeroRTT makes the server accept 0-RTT data.
+var zeroRTT bool
+
+// reportResumption logs and counts whether conn resumed a session once its
+// handshake is done.
+func (p *Peer) reportResumption(conn quic.EarlyConnection) {
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		return
+	}
+	state := conn.ConnectionState()
+	params := quicParams(state)
+	p.stats.QUIC.Store(&params)
+	if state.TLS.DidResume {
+		p.stats.Resumptions.Add(1)
+	}
+	if state.Used0RTT {
+		p.stats.ZeroRTTConns.Add(1)
+	}
+	slog.Info("handshake complete", "vIP", p.vIP, "resumed", state.TLS.DidResume, "0rtt", state.Used0RTT,
+		"quic", params.Version, "alpn", params.ALPN, "cipher", params.CipherSuite, "tls", params.TLSVersion)
+}